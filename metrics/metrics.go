@@ -17,6 +17,8 @@ limitations under the License.
 package metrics
 
 import (
+	"strings"
+
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/pusher/k8s-spot-rescheduler/nodes"
 )
@@ -25,72 +27,324 @@ const (
 	reschedulerNamespace = "spot_rescheduler"
 )
 
-var (
-	// nodePodsCount tracks how many pods are nodes by type and by node name.
-	nodePodsCount = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Namespace: reschedulerNamespace,
-			Name:      "node_pods_count",
-			Help:      "Number of pods on each node.",
-		},
-		[]string{"node_type", "node"})
+const (
+	// UnmovableReasonTaintToleration a spot node has a taint the pod doesn't
+	// tolerate.
+	UnmovableReasonTaintToleration = "TaintToleration"
+	// UnmovableReasonMaxPlacements a spot node has been planned as many pods
+	// as its max-placements annotation allows.
+	UnmovableReasonMaxPlacements = "MaxPlacements"
+	// UnmovableReasonMaxPodDensity a spot node already hosts as many pods as
+	// the pod density cap allows.
+	UnmovableReasonMaxPodDensity = "MaxPodDensity"
+	// UnmovableReasonOther any reason not in UnmovableReasons.
+	UnmovableReasonOther = "Other"
+)
 
-	// nodesCount tracks the number of nodes in the cluster.
-	nodesCount = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Namespace: reschedulerNamespace,
-			Name:      "nodes_count",
-			Help:      "Number of nodes in cluster.",
-		}, []string{"node_type"},
-	)
+// UnmovableReasons is the fixed set of reasons unmovable pods are counted
+// under, keeping the cardinality of the reason label bounded. Scheduler
+// predicates are named after the plugin which failed.
+var UnmovableReasons = []string{
+	"CrashLoopBackOff",
+	"UnadvertisedResource",
+	"LastReadyReplica",
+	"RecentlyMoved",
+	"TooYoung",
+	"RestrictedRuntimeClass",
+	"LocalStorage",
+	"ExcludedNamespace",
+	"ReschedulingDisabled",
+	"NodeResourcesFit",
+	"NodeAffinity",
+	"NodeName",
+	"NodePorts",
+	"NodeUnschedulable",
+	"InterPodAffinity",
+	"PodTopologySpread",
+	"VolumeBinding",
+	"VolumeRestrictions",
+	"VolumeZone",
+	"NodeVolumeLimits",
+	UnmovableReasonTaintToleration,
+	UnmovableReasonMaxPlacements,
+	UnmovableReasonMaxPodDensity,
+	UnmovableReasonOther,
+}
 
+// Recorder records the metrics of a single rescheduler. Each rescheduler
+// scope has its own Recorder, whose metric names are prefixed with the scope
+// so that independent reschedulers scraped together can be told apart.
+type Recorder struct {
+	// nodePodsCount tracks how many pods are nodes by type and by node name.
+	nodePodsCount *prometheus.GaugeVec
+	// nodeCPUUtilization tracks the percentage of each node's allocatable CPU
+	// requested by its pods.
+	nodeCPUUtilization *prometheus.GaugeVec
+	// nodesCount tracks the number of nodes in the cluster.
+	nodesCount *prometheus.GaugeVec
+	// requestedCPU tracks the CPU requested on the nodes of each type.
+	requestedCPU *prometheus.GaugeVec
+	// freeCPU tracks the allocatable CPU left over on the nodes of each type.
+	freeCPU *prometheus.GaugeVec
 	// nodeDrainCount counts the number of nodes drained by the rescheduler.
-	nodeDrainCount = prometheus.NewCounterVec(
-		prometheus.CounterOpts{
-			Namespace: reschedulerNamespace,
-			Name:      "node_drain_total",
-			Help:      "Number of nodes drained by rescheduler.",
-		}, []string{"drain_state", "node"},
-	)
-
+	nodeDrainCount *prometheus.CounterVec
 	// evictionsCount counts the number of pods evicted by the rescheduler
-	evictionsCount = prometheus.NewCounter(
-		prometheus.CounterOpts{
-			Namespace: reschedulerNamespace,
-			Name:      "evicted_pods_total",
-			Help:      "Number of pods evicted by the rescheduler.",
-		},
-	)
-)
+	evictionsCount prometheus.Counter
+	// nodeDrainabilityScore tracks the fraction of each on-demand node's
+	// movable CPU which fits onto the spot nodes.
+	nodeDrainabilityScore *prometheus.GaugeVec
+	// minOnDemandNodes tracks the fewest on-demand nodes which could run the
+	// workload without any spot capacity.
+	minOnDemandNodes prometheus.Gauge
+	// consolidationEfficiency tracks the CPU freed on on-demand nodes for
+	// each unit of CPU moved in the last pass which moved pods.
+	consolidationEfficiency prometheus.Gauge
+	// unmovablePodsCount counts the pods found unmovable, by reason.
+	unmovablePodsCount *prometheus.CounterVec
+	// evictionBreakerTripped tracks whether evictions are paused after too
+	// many consecutive eviction failures.
+	evictionBreakerTripped prometheus.Gauge
+	// movedCPU observes the CPU requested by the pods moved in each pass.
+	movedCPU prometheus.Summary
+	// movedPods observes the number of pods moved in each pass.
+	movedPods prometheus.Summary
+}
+
+// NewRecorder creates the metrics of the named scope and registers them with
+// the registerer. Metric names are prefixed with the scope, with characters
+// not allowed in metric names replaced by underscores, unless it is empty.
+func NewRecorder(scope string, registerer prometheus.Registerer) *Recorder {
+	subsystem := metricPrefix(scope)
+	m := &Recorder{
+		nodePodsCount: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: reschedulerNamespace,
+				Subsystem: subsystem,
+				Name:      "node_pods_count",
+				Help:      "Number of pods on each node.",
+			},
+			[]string{"node_type", "node"}),
+		nodeCPUUtilization: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: reschedulerNamespace,
+				Subsystem: subsystem,
+				Name:      "node_cpu_utilization_percent",
+				Help:      "Percentage of each node's allocatable CPU requested by its pods.",
+			},
+			[]string{"node_type", "node"}),
+		nodesCount: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: reschedulerNamespace,
+				Subsystem: subsystem,
+				Name:      "nodes_count",
+				Help:      "Number of nodes in cluster.",
+			}, []string{"node_type"},
+		),
+		requestedCPU: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: reschedulerNamespace,
+				Subsystem: subsystem,
+				Name:      "requested_cpu_millicores",
+				Help:      "CPU requested by all the pods on nodes of each type, in millicores.",
+			}, []string{"node_type"},
+		),
+		freeCPU: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: reschedulerNamespace,
+				Subsystem: subsystem,
+				Name:      "free_cpu_millicores",
+				Help:      "Allocatable CPU not requested by any pod on nodes of each type, in millicores.",
+			}, []string{"node_type"},
+		),
+		nodeDrainCount: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: reschedulerNamespace,
+				Subsystem: subsystem,
+				Name:      "node_drain_total",
+				Help:      "Number of nodes drained by rescheduler.",
+			}, []string{"drain_state", "node"},
+		),
+		evictionsCount: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: reschedulerNamespace,
+				Subsystem: subsystem,
+				Name:      "evicted_pods_total",
+				Help:      "Number of pods evicted by the rescheduler.",
+			},
+		),
+		nodeDrainabilityScore: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: reschedulerNamespace,
+				Subsystem: subsystem,
+				Name:      "node_drainability_score",
+				Help:      "Fraction of the CPU requested by the movable pods on each on-demand node which fits onto the spot nodes.",
+			}, []string{"node"},
+		),
+		minOnDemandNodes: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: reschedulerNamespace,
+				Subsystem: subsystem,
+				Name:      "min_on_demand_nodes",
+				Help:      "Fewest on-demand nodes which could run the cluster's workload if there were no spot capacity left.",
+			},
+		),
+		consolidationEfficiency: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: reschedulerNamespace,
+				Subsystem: subsystem,
+				Name:      "consolidation_efficiency",
+				Help:      "CPU freed on on-demand nodes divided by the CPU moved, for the last pass which moved pods.",
+			},
+		),
+		unmovablePodsCount: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: reschedulerNamespace,
+				Subsystem: subsystem,
+				Name:      "unmovable_pods_total",
+				Help:      "Number of times pods were found unmovable, by reason.",
+			}, []string{"reason"},
+		),
+		evictionBreakerTripped: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: reschedulerNamespace,
+				Subsystem: subsystem,
+				Name:      "eviction_breaker_tripped",
+				Help:      "1 while evictions are paused after too many consecutive eviction failures, otherwise 0.",
+			},
+		),
+		movedCPU: prometheus.NewSummary(
+			prometheus.SummaryOpts{
+				Namespace:  reschedulerNamespace,
+				Subsystem:  subsystem,
+				Name:       "moved_cpu_millicores",
+				Help:       "CPU requested by the pods moved in each pass, in millicores.",
+				Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001},
+			},
+		),
+		movedPods: prometheus.NewSummary(
+			prometheus.SummaryOpts{
+				Namespace:  reschedulerNamespace,
+				Subsystem:  subsystem,
+				Name:       "moved_pods",
+				Help:       "Number of pods moved in each pass.",
+				Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001},
+			},
+		),
+	}
 
-func init() {
-	prometheus.MustRegister(nodePodsCount)
-	prometheus.MustRegister(nodesCount)
-	prometheus.MustRegister(nodeDrainCount)
-	prometheus.MustRegister(evictionsCount)
+	registerer.MustRegister(m.nodePodsCount)
+	registerer.MustRegister(m.nodeCPUUtilization)
+	registerer.MustRegister(m.nodesCount)
+	registerer.MustRegister(m.requestedCPU)
+	registerer.MustRegister(m.freeCPU)
+	registerer.MustRegister(m.nodeDrainCount)
+	registerer.MustRegister(m.evictionsCount)
+	registerer.MustRegister(m.nodeDrainabilityScore)
+	registerer.MustRegister(m.minOnDemandNodes)
+	registerer.MustRegister(m.consolidationEfficiency)
+	registerer.MustRegister(m.unmovablePodsCount)
+	registerer.MustRegister(m.evictionBreakerTripped)
+	registerer.MustRegister(m.movedCPU)
+	registerer.MustRegister(m.movedPods)
+	return m
+}
+
+// Returns the scope as it prefixes metric names, with every character not
+// allowed in a metric name replaced by an underscore.
+func metricPrefix(scope string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' {
+			return r
+		}
+		return '_'
+	}, scope)
 }
 
 // UpdateNodesMap updates the metrics calculated by the nodes map
-func UpdateNodesMap(nm nodes.Map) {
+func (m *Recorder) UpdateNodesMap(nm nodes.Map, config *nodes.Config) {
 	if nm == nil {
 		return
 	}
-	nodesCount.WithLabelValues(nodes.OnDemandNodeLabel).Set(float64(len(nm[nodes.OnDemand])))
-	nodesCount.WithLabelValues(nodes.SpotNodeLabel).Set(float64(len(nm[nodes.Spot])))
-
+	for nodeType, nodeLabel := range map[nodes.NodeType]string{
+		nodes.OnDemand: config.OnDemandNodeLabel(),
+		nodes.Spot:     config.SpotNodeLabel(),
+	} {
+		var requested, free int64
+		for _, nodeInfo := range nm[nodeType] {
+			requested += nodeInfo.RequestedCPU + nodeInfo.DaemonSetCPU
+			free += nodeInfo.FreeCPU
+		}
+		m.nodesCount.WithLabelValues(nodeLabel).Set(float64(len(nm[nodeType])))
+		m.requestedCPU.WithLabelValues(nodeLabel).Set(float64(requested))
+		m.freeCPU.WithLabelValues(nodeLabel).Set(float64(free))
+	}
 }
 
 // UpdateNodePodsCount updates nodePodsCount for a given node
-func UpdateNodePodsCount(nodeType string, nodeName string, numPods int) {
-	nodePodsCount.WithLabelValues(nodeType, nodeName).Set(float64(numPods))
+func (m *Recorder) UpdateNodePodsCount(nodeType string, nodeName string, numPods int) {
+	m.nodePodsCount.WithLabelValues(nodeType, nodeName).Set(float64(numPods))
+}
+
+// UpdateNodeCPUUtilization updates nodeCPUUtilization for a given node
+func (m *Recorder) UpdateNodeCPUUtilization(nodeType string, nodeName string, utilization float64) {
+	m.nodeCPUUtilization.WithLabelValues(nodeType, nodeName).Set(utilization)
 }
 
 // UpdateEvictionsCount adds 1 to the evictions counter
-func UpdateEvictionsCount() {
-	evictionsCount.Add(1)
+func (m *Recorder) UpdateEvictionsCount() {
+	m.evictionsCount.Add(1)
 }
 
 // UpdateNodeDrainCount updates the number drains and drain state for a node
-func UpdateNodeDrainCount(state string, nodeName string) {
-	nodeDrainCount.WithLabelValues(state, nodeName).Add(1)
+func (m *Recorder) UpdateNodeDrainCount(state string, nodeName string) {
+	m.nodeDrainCount.WithLabelValues(state, nodeName).Add(1)
+}
+
+// ObserveMovedResources observes the CPU and number of pods moved in a pass
+func (m *Recorder) ObserveMovedResources(cpu int64, pods int) {
+	m.movedCPU.Observe(float64(cpu))
+	m.movedPods.Observe(float64(pods))
+}
+
+// UpdateNodeDrainabilityScore updates the drainability score of a node
+func (m *Recorder) UpdateNodeDrainabilityScore(nodeName string, score float64) {
+	m.nodeDrainabilityScore.WithLabelValues(nodeName).Set(score)
+}
+
+// UpdateMinOnDemandNodes updates the fewest on-demand nodes needed without spot
+// capacity
+func (m *Recorder) UpdateMinOnDemandNodes(count int) {
+	m.minOnDemandNodes.Set(float64(count))
+}
+
+// UpdateConsolidationEfficiency updates the efficiency of the last pass which
+// moved pods
+func (m *Recorder) UpdateConsolidationEfficiency(efficiency float64) {
+	m.consolidationEfficiency.Set(efficiency)
+}
+
+// UpdateEvictionBreakerTripped updates whether evictions are paused after too
+// many consecutive eviction failures
+func (m *Recorder) UpdateEvictionBreakerTripped(tripped bool) {
+	value := 0.0
+	if tripped {
+		value = 1
+	}
+	m.evictionBreakerTripped.Set(value)
+}
+
+// UpdateUnmovablePodsCount adds 1 to the unmovable pods counter for the reason,
+// counting reasons outside of UnmovableReasons as UnmovableReasonOther
+func (m *Recorder) UpdateUnmovablePodsCount(reason string) {
+	known := false
+	for _, unmovableReason := range UnmovableReasons {
+		if reason == unmovableReason {
+			known = true
+			break
+		}
+	}
+	if !known {
+		reason = UnmovableReasonOther
+	}
+	m.unmovablePodsCount.WithLabelValues(reason).Add(1)
 }
@@ -0,0 +1,166 @@
+/*
+Copyright 2017 Pusher Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/pusher/k8s-spot-rescheduler/nodes"
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestUpdateNodesMap(t *testing.T) {
+	nodeInfo := func(name string, requested, daemonSet, free int64) *nodes.NodeInfo {
+		return &nodes.NodeInfo{
+			Node:         &apiv1.Node{ObjectMeta: metav1.ObjectMeta{Name: name}},
+			RequestedCPU: requested,
+			DaemonSetCPU: daemonSet,
+			FreeCPU:      free,
+		}
+	}
+	nodeMap := nodes.Map{
+		nodes.OnDemand: nodes.NodeInfoArray{
+			nodeInfo("node1", 500, 100, 1400),
+			nodeInfo("node2", 1200, 100, 700),
+		},
+		nodes.Spot: nodes.NodeInfoArray{
+			nodeInfo("node3", 1800, 100, 100),
+		},
+	}
+
+	registry := prometheus.NewRegistry()
+	NewRecorder("", registry).UpdateNodesMap(nodeMap, nodes.NewConfig())
+
+	expected := `
+# HELP spot_rescheduler_free_cpu_millicores Allocatable CPU not requested by any pod on nodes of each type, in millicores.
+# TYPE spot_rescheduler_free_cpu_millicores gauge
+spot_rescheduler_free_cpu_millicores{node_type="kubernetes.io/role=spot-worker"} 100
+spot_rescheduler_free_cpu_millicores{node_type="kubernetes.io/role=worker"} 2100
+# HELP spot_rescheduler_nodes_count Number of nodes in cluster.
+# TYPE spot_rescheduler_nodes_count gauge
+spot_rescheduler_nodes_count{node_type="kubernetes.io/role=spot-worker"} 1
+spot_rescheduler_nodes_count{node_type="kubernetes.io/role=worker"} 2
+# HELP spot_rescheduler_requested_cpu_millicores CPU requested by all the pods on nodes of each type, in millicores.
+# TYPE spot_rescheduler_requested_cpu_millicores gauge
+spot_rescheduler_requested_cpu_millicores{node_type="kubernetes.io/role=spot-worker"} 1900
+spot_rescheduler_requested_cpu_millicores{node_type="kubernetes.io/role=worker"} 1900
+`
+	assert.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(expected),
+		"spot_rescheduler_free_cpu_millicores", "spot_rescheduler_nodes_count", "spot_rescheduler_requested_cpu_millicores"))
+}
+
+func TestRecorderScopes(t *testing.T) {
+	// Two scopes scraped from the same registry don't share any metric
+	registry := prometheus.NewRegistry()
+	poolA := NewRecorder("pool-a", registry)
+	poolB := NewRecorder("pool_b", registry)
+
+	poolA.UpdateEvictionsCount()
+	poolA.UpdateEvictionsCount()
+	poolB.UpdateEvictionsCount()
+
+	expected := `
+# HELP spot_rescheduler_pool_a_evicted_pods_total Number of pods evicted by the rescheduler.
+# TYPE spot_rescheduler_pool_a_evicted_pods_total counter
+spot_rescheduler_pool_a_evicted_pods_total 2
+# HELP spot_rescheduler_pool_b_evicted_pods_total Number of pods evicted by the rescheduler.
+# TYPE spot_rescheduler_pool_b_evicted_pods_total counter
+spot_rescheduler_pool_b_evicted_pods_total 1
+`
+	assert.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(expected),
+		"spot_rescheduler_pool_a_evicted_pods_total", "spot_rescheduler_pool_b_evicted_pods_total"))
+
+	// Registering the same scope twice fails
+	assert.Panics(t, func() { NewRecorder("pool-a", registry) })
+}
+
+func TestObserveMovedResources(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	recorder := NewRecorder("", registry)
+
+	recorder.ObserveMovedResources(1500, 3)
+	recorder.ObserveMovedResources(500, 1)
+
+	count, sum := getSummary(t, registry, "spot_rescheduler_moved_cpu_millicores")
+	assert.Equal(t, uint64(2), count)
+	assert.Equal(t, float64(2000), sum)
+
+	count, sum = getSummary(t, registry, "spot_rescheduler_moved_pods")
+	assert.Equal(t, uint64(2), count)
+	assert.Equal(t, float64(4), sum)
+}
+
+func TestUpdateNodeDrainabilityScore(t *testing.T) {
+	recorder := NewRecorder("", prometheus.NewRegistry())
+
+	recorder.UpdateNodeDrainabilityScore("node1", 0.5)
+	assert.Equal(t, 0.5, testutil.ToFloat64(recorder.nodeDrainabilityScore.WithLabelValues("node1")))
+
+	recorder.UpdateNodeDrainabilityScore("node1", 1)
+	assert.Equal(t, float64(1), testutil.ToFloat64(recorder.nodeDrainabilityScore.WithLabelValues("node1")))
+}
+
+func TestUpdateUnmovablePodsCount(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	recorder := NewRecorder("", registry)
+
+	recorder.UpdateUnmovablePodsCount("NodeResourcesFit")
+	recorder.UpdateUnmovablePodsCount("CrashLoopBackOff")
+	recorder.UpdateUnmovablePodsCount("default/my-pod: something unexpected")
+
+	families, err := registry.Gather()
+	assert.NoError(t, err)
+	reasons := make([]string, 0)
+	for _, family := range families {
+		if family.GetName() != "spot_rescheduler_unmovable_pods_total" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "reason" {
+					reasons = append(reasons, label.GetValue())
+				}
+			}
+		}
+	}
+
+	// Only reasons from the fixed set are used as labels
+	assert.ElementsMatch(t, []string{"NodeResourcesFit", "CrashLoopBackOff", UnmovableReasonOther}, reasons)
+	for _, reason := range reasons {
+		assert.Contains(t, UnmovableReasons, reason)
+	}
+}
+
+// Returns the sample count and sum of the named summary in the registry.
+func getSummary(t *testing.T, registry *prometheus.Registry, name string) (uint64, float64) {
+	families, err := registry.Gather()
+	assert.NoError(t, err)
+
+	for _, family := range families {
+		if family.GetName() == name && len(family.GetMetric()) > 0 {
+			summary := family.GetMetric()[0].GetSummary()
+			return summary.GetSampleCount(), summary.GetSampleSum()
+		}
+	}
+	t.Fatalf("summary %s not found", name)
+	return 0, 0
+}
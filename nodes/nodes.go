@@ -18,29 +18,244 @@ package nodes
 
 import (
 	"context"
+	"fmt"
+	"math"
 	"sort"
 	"strings"
 
+	"github.com/golang/glog"
+	"golang.org/x/sync/errgroup"
 	apiv1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1beta1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/apimachinery/pkg/types"
 	simulator "k8s.io/autoscaler/cluster-autoscaler/simulator"
 	kube_client "k8s.io/client-go/kubernetes"
+	v1lister "k8s.io/client-go/listers/core/v1"
+)
+
+const (
+	// DefaultOnDemandNodeLabel default label for on-demand instances.
+	DefaultOnDemandNodeLabel = "kubernetes.io/role=worker"
+	// DefaultSpotNodeLabel default label for spot instances.
+	DefaultSpotNodeLabel = "kubernetes.io/role=spot-worker"
+	// DefaultReschedulingAnnotation default annotation with which pods opt
+	// out of being rescheduled.
+	DefaultReschedulingAnnotation = "spot-rescheduler.pusher.com/enabled"
+	// DefaultConcurrency default number of nodes whose pods are listed at
+	// once while building a NodesMap.
+	DefaultConcurrency = 8
 )
 
 var (
-	// OnDemandNodeLabel label for on-demand instances.
-	OnDemandNodeLabel = "kubernetes.io/role=worker"
-	// SpotNodeLabel label for spot instances.
-	SpotNodeLabel = "kubernetes.io/role=spot-worker"
 	// OnDemand key for on-demand instances of NodesMap.
 	OnDemand NodeType
 	// Spot key for spot instances of NodesMap.
 	Spot NodeType = 1
-	// Lowest Priority considered on spot nodes
-	PriorityThreshold = 0
 )
 
+// Config holds the settings used to classify nodes and account for their
+// pods. Each rescheduler scope has its own Config.
+type Config struct {
+	// OnDemandNodeLabels label selectors for on-demand instances, such as
+	// "kubernetes.io/role in (worker, on-demand)", tried in order so that
+	// nodes still carrying a legacy label can be matched. The first label is
+	// the one nodes are reported under.
+	OnDemandNodeLabels []string
+	// SpotNodeLabels label selectors for spot instances, tried in order so
+	// that nodes still carrying a legacy label can be matched. The first
+	// label is the one nodes are reported under.
+	SpotNodeLabels []string
+	// PriorityThreshold lowest priority considered on spot nodes.
+	PriorityThreshold int
+	// OnDemandPriorityThreshold lowest priority considered on on-demand
+	// nodes, so that lower priority pods don't keep them from being drained.
+	// All pods on on-demand nodes are considered when nil.
+	OnDemandPriorityThreshold *int
+	// DefaultNodeType type given to nodes matching neither label. Such nodes
+	// are ignored when nil.
+	DefaultNodeType *NodeType
+	// DetectProviderLabels falls back to the capacity type labels well-known
+	// cloud providers and provisioners set, such as karpenter.sh/capacity-type,
+	// for nodes matching neither node label.
+	DetectProviderLabels bool
+	// NodeTypeOverrides forces the type of nodes by name, regardless of their
+	// labels. Overrides also settle the type of nodes matching both a spot and
+	// an on-demand label, which are otherwise left out of the map.
+	NodeTypeOverrides map[string]NodeType
+	// ResourceExtractor works out the resources used by each pod. The
+	// DefaultResourceExtractor is used when nil.
+	ResourceExtractor ResourceExtractor
+	// SpotSortMode is the order spot nodes are sorted in, by most requested
+	// CPU first by default.
+	SpotSortMode SortMode
+	// SortTolerance is how many percentage points the share of its
+	// allocatable CPU requested on a node may change by through incremental
+	// updates before it's moved to its new place in the sorted map. Smaller
+	// changes are left for Map.Sort.
+	SortTolerance float64
+	// IncludeUnavailableNodes keeps cordoned and NotReady nodes in the map,
+	// which are otherwise left out as they can neither be drained usefully nor
+	// take pods.
+	IncludeUnavailableNodes bool
+	// IgnoreTerminatingPods leaves pods which are being deleted out of the
+	// map. Pods which have completed are always left out.
+	IgnoreTerminatingPods bool
+	// ProtectLocalStoragePods treats pods with local storage, which would
+	// lose their data if moved, as unmovable, listing them in the
+	// UnmovablePods of their NodeInfo.
+	ProtectLocalStoragePods bool
+	// ExcludedNamespaces are the namespaces whose pods are never moved. They
+	// still count against their nodes' resources, listed in the UnmovablePods
+	// of their NodeInfo.
+	ExcludedNamespaces map[string]bool
+	// AllowedNamespaces limits the pods in the map to those of these
+	// namespaces, the pods of other namespaces are left out entirely. Pods of
+	// all namespaces are kept when empty.
+	AllowedNamespaces map[string]bool
+	// ReschedulingAnnotation is the annotation which, set to "false" on a pod,
+	// opts it out of being moved. Such pods still count against their nodes'
+	// resources, listed in the UnmovablePods of their NodeInfo. Pods can't opt
+	// out when empty.
+	ReschedulingAnnotation string
+	// Concurrency is how many nodes have their pods listed at once while
+	// building a NodesMap. DefaultConcurrency is used when not positive.
+	Concurrency int
+
+	// selectors are the parsed node labels, set by Validate.
+	selectors map[string]labels.Selector
+}
+
+// ResourceExtractor works out the effective resource usage of a pod, with CPU
+// in MilliValue and other resources in Value.
+type ResourceExtractor interface {
+	Extract(pod *apiv1.Pod) map[apiv1.ResourceName]int64
+}
+
+// ResourceExtractorFunc allows a function to be used as a ResourceExtractor.
+type ResourceExtractorFunc func(pod *apiv1.Pod) map[apiv1.ResourceName]int64
+
+// Extract calls the function.
+func (f ResourceExtractorFunc) Extract(pod *apiv1.Pod) map[apiv1.ResourceName]int64 {
+	return f(pod)
+}
+
+// ResourceBasis is which of their containers' resources pods are accounted for
+// by.
+type ResourceBasis int
+
+const (
+	// Requests accounts for pods by their containers' requests, as the
+	// scheduler does.
+	Requests ResourceBasis = iota
+	// Limits accounts for pods by their containers' limits, so that burstable
+	// pods aren't stacked onto the same nodes. Containers without a limit for a
+	// resource count for none of it.
+	Limits
+	// MaxOfRequestsLimits accounts for pods by the larger of each container's
+	// request and limit, so containers without a limit count for their
+	// request.
+	MaxOfRequestsLimits
+)
+
+// ParseResourceBasis parses the name of the basis pods are accounted for by,
+// either "requests", the default when empty, "limits" or
+// "max-of-requests-limits".
+func ParseResourceBasis(name string) (ResourceBasis, error) {
+	switch name {
+	case "", "requests":
+		return Requests, nil
+	case "limits":
+		return Limits, nil
+	case "max-of-requests-limits":
+		return MaxOfRequestsLimits, nil
+	default:
+		return Requests, fmt.Errorf("unknown resource basis %q: expected 'requests', 'limits' or 'max-of-requests-limits'", name)
+	}
+}
+
+// NewResourceExtractor returns a ResourceExtractor working out the CPU, memory
+// and any other resources, such as nvidia.com/gpu, effectively used by a pod on
+// the given basis, accounting for its init containers and overhead as the
+// scheduler does.
+func NewResourceExtractor(basis ResourceBasis) ResourceExtractor {
+	return ResourceExtractorFunc(func(pod *apiv1.Pod) map[apiv1.ResourceName]int64 {
+		cpu := PodResource(pod, apiv1.ResourceCPU, basis)
+		memory := PodResource(pod, apiv1.ResourceMemory, basis)
+		resources := map[apiv1.ResourceName]int64{
+			apiv1.ResourceCPU:    cpu.MilliValue(),
+			apiv1.ResourceMemory: memory.Value(),
+		}
+		for _, containers := range [][]apiv1.Container{pod.Spec.InitContainers, pod.Spec.Containers} {
+			for _, container := range containers {
+				for _, list := range basis.resourceLists(container.Resources) {
+					for name := range list {
+						if _, found := resources[name]; !found {
+							quantity := PodResource(pod, name, basis)
+							resources[name] = quantity.Value()
+						}
+					}
+				}
+			}
+		}
+		for name := range pod.Spec.Overhead {
+			if _, found := resources[name]; !found {
+				quantity := PodResource(pod, name, basis)
+				resources[name] = quantity.Value()
+			}
+		}
+		return resources
+	})
+}
+
+// DefaultResourceExtractor works out the CPU, memory and any other resources,
+// such as nvidia.com/gpu, effectively requested by a pod, accounting for its
+// init containers and overhead as the scheduler does.
+var DefaultResourceExtractor = NewResourceExtractor(Requests)
+
+// Returns the resource lists of the container the basis accounts for.
+func (b ResourceBasis) resourceLists(resources apiv1.ResourceRequirements) []apiv1.ResourceList {
+	switch b {
+	case Limits:
+		return []apiv1.ResourceList{resources.Limits}
+	case MaxOfRequestsLimits:
+		return []apiv1.ResourceList{resources.Requests, resources.Limits}
+	default:
+		return []apiv1.ResourceList{resources.Requests}
+	}
+}
+
+// Returns the container's quantity of the named resource on the basis, and
+// whether it has any.
+func (b ResourceBasis) containerResource(resources apiv1.ResourceRequirements, name apiv1.ResourceName) (resource.Quantity, bool) {
+	request, hasRequest := resources.Requests[name]
+	limit, hasLimit := resources.Limits[name]
+	switch b {
+	case Limits:
+		return limit, hasLimit
+	case MaxOfRequestsLimits:
+		if hasLimit && (!hasRequest || limit.Cmp(request) > 0) {
+			return limit, true
+		}
+	}
+	return request, hasRequest
+}
+
+// NewConfig returns a Config using the default node labels and rescheduling
+// annotation.
+func NewConfig() *Config {
+	return &Config{
+		OnDemandNodeLabels:     []string{DefaultOnDemandNodeLabel},
+		SpotNodeLabels:         []string{DefaultSpotNodeLabel},
+		ReschedulingAnnotation: DefaultReschedulingAnnotation,
+	}
+}
+
 // NodeInfo struct containing node and it's pods as well information
 // resources on the node.
 type NodeInfo struct {
@@ -48,185 +263,1380 @@ type NodeInfo struct {
 	Pods         []*apiv1.Pod
 	RequestedCPU int64
 	FreeCPU      int64
+	// DaemonSetPods are the DaemonSet and mirror pods on the node, which are
+	// never moved off it and so are left out of Pods and RequestedCPU.
+	DaemonSetPods []*apiv1.Pod
+	// DaemonSetCPU is the CPU requested by the DaemonSetPods, which is still
+	// taken out of FreeCPU.
+	DaemonSetCPU int64
+	// UnmovablePods are the pods in Pods which can't be moved, so the node
+	// can't be fully drained while they run on it.
+	UnmovablePods []*apiv1.Pod
+	// Requested are the resources requested by the Pods, like RequestedCPU
+	// for every resource, with CPU in MilliValue and others in Value.
+	Requested map[apiv1.ResourceName]int64
+	// Free are the allocatable resources of the node left over by all of its
+	// pods, like FreeCPU for every resource.
+	Free map[apiv1.ResourceName]int64
+	// RequestedEphemeralStorage is the ephemeral storage requested by the
+	// Pods in bytes, as in Requested.
+	RequestedEphemeralStorage int64
+	// FreeEphemeralStorage is the allocatable ephemeral storage of the node
+	// left over by all of its pods in bytes, as in Free. Pods requesting more
+	// don't fit, however much CPU is free.
+	FreeEphemeralStorage int64
+
+	// extractor used to account for the pods, the default when nil.
+	extractor ResourceExtractor
+	// sortMode is the order the NodeInfo is sorted in among spot nodes.
+	sortMode SortMode
+	// sortedCPU is the RequestedCPU the NodeInfo was last sorted by.
+	sortedCPU int64
+	// sortedAllocatableCPU is the allocatable CPU of the node when the
+	// NodeInfo was last sorted, in MilliValue.
+	sortedAllocatableCPU int64
 }
 
 // NodeType integer key for keying NodesMap.
 type NodeType int
 
+// OnDemandNodeLabel returns the label on-demand nodes are reported under.
+func (c *Config) OnDemandNodeLabel() string {
+	if len(c.OnDemandNodeLabels) == 0 {
+		return ""
+	}
+	return c.OnDemandNodeLabels[0]
+}
+
+// SpotNodeLabel returns the label spot nodes are reported under.
+func (c *Config) SpotNodeLabel() string {
+	if len(c.SpotNodeLabels) == 0 {
+		return ""
+	}
+	return c.SpotNodeLabels[0]
+}
+
+// RequestedCPU returns the total CPU used by a collection of pods in
+// MilliValue, according to the Config's ResourceExtractor.
+func (c *Config) RequestedCPU(pods []*apiv1.Pod) int64 {
+	return calculateRequestedCPU(c.ResourceExtractor, pods)
+}
+
+// PodResources returns the resources used by the pod, with CPU in MilliValue
+// and others in Value, according to the Config's ResourceExtractor.
+func (c *Config) PodResources(pod *apiv1.Pod) map[apiv1.ResourceName]int64 {
+	return podRequests(c.ResourceExtractor, pod)
+}
+
+// String returns the name of the node type, as parsed by
+// ParseNodeTypeOverrides.
+func (t NodeType) String() string {
+	switch t {
+	case OnDemand:
+		return "on-demand"
+	case Spot:
+		return "spot"
+	default:
+		return fmt.Sprintf("NodeType(%d)", int(t))
+	}
+}
+
+// ParseNodeType parses the name of the type given to nodes matching neither
+// label. An empty name or "ignore" means such nodes are ignored.
+func ParseNodeType(name string) (*NodeType, error) {
+	switch name {
+	case "", "ignore":
+		return nil, nil
+	case "on-demand":
+		return &OnDemand, nil
+	default:
+		return nil, fmt.Errorf("unknown default node type %q: expected 'ignore' or 'on-demand'", name)
+	}
+}
+
+// SortMode is the order spot nodes are sorted in, the planner packing pods onto
+// the first spot nodes.
+type SortMode int
+
+const (
+	// SortByRequestedCPU sorts spot nodes by most requested CPU first.
+	SortByRequestedCPU SortMode = iota
+	// SortByCPURatio sorts spot nodes by the highest ratio of requested to
+	// allocatable CPU first, so that small nearly full nodes come before big
+	// barely used ones when nodes are of different sizes.
+	SortByCPURatio
+)
+
+// ParseSortMode parses the name of the order spot nodes are sorted in, either
+// "requested-cpu", the default when empty, or "cpu-ratio".
+func ParseSortMode(name string) (SortMode, error) {
+	switch name {
+	case "", "requested-cpu":
+		return SortByRequestedCPU, nil
+	case "cpu-ratio":
+		return SortByCPURatio, nil
+	default:
+		return SortByRequestedCPU, fmt.Errorf("unknown spot node sort mode %q: expected 'requested-cpu' or 'cpu-ratio'", name)
+	}
+}
+
+// ParseNodeTypeOverrides parses the types forced on nodes by name, each either
+// "spot" or "on-demand".
+func ParseNodeTypeOverrides(overrides map[string]string) (map[string]NodeType, error) {
+	nodeTypes := make(map[string]NodeType, len(overrides))
+	for nodeName, name := range overrides {
+		switch name {
+		case "spot":
+			nodeTypes[nodeName] = Spot
+		case "on-demand":
+			nodeTypes[nodeName] = OnDemand
+		default:
+			return nil, fmt.Errorf("unknown node type %q for node %s: expected 'spot' or 'on-demand'", name, nodeName)
+		}
+	}
+	return nodeTypes, nil
+}
+
 // NodeInfoArray array of NodeInfo pointers.
 type NodeInfoArray []*NodeInfo
 
 // Map map of NodeInfoArray.
 type Map map[NodeType]NodeInfoArray
 
-// NewNodeMap creates a new NodesMap from a list of Nodes.
-func NewNodeMap(client kube_client.Interface, nodes []*apiv1.Node) (Map, error) {
+// NewNodeMap creates a new NodesMap from a list of Nodes, classifying them
+// according to the given Config, returning an error if any of its node labels
+// isn't a valid label selector. Nodes without any allocatable CPU or matching
+// both a spot and an on-demand label, as returned by Config.ConflictingNodes,
+// are left out. The pods on up to Config.Concurrency nodes are listed at once,
+// stopping at the first error or with ctx.Err() once the context is done.
+func NewNodeMap(ctx context.Context, client kube_client.Interface, nodes []*apiv1.Node, config *Config) (Map, error) {
+	return newNodeMap(ctx, nodes, config, func(ctx context.Context, node *apiv1.Node) ([]*apiv1.Pod, error) {
+		return listPodsOnNode(ctx, client, node)
+	})
+}
+
+// NewNodeMapFromLister creates a new NodesMap like NewNodeMap, but lists the
+// pods of all nodes at once from the given lister, as backed by a shared pod
+// informer, rather than from the API server node by node. The pods are copies
+// of those in the lister's cache, so they can be modified.
+func NewNodeMapFromLister(lister v1lister.PodLister, nodes []*apiv1.Node, config *Config) (Map, error) {
+	allPods, err := lister.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+
+	podsByNode := make(map[string][]*apiv1.Pod)
+	for _, pod := range allPods {
+		if pod.Spec.NodeName != "" {
+			podsByNode[pod.Spec.NodeName] = append(podsByNode[pod.Spec.NodeName], pod)
+		}
+	}
+
+	return newNodeMap(context.Background(), nodes, config, func(_ context.Context, node *apiv1.Node) ([]*apiv1.Pod, error) {
+		pods := make([]*apiv1.Pod, 0, len(podsByNode[node.Name]))
+		for _, pod := range podsByNode[node.Name] {
+			pods = append(pods, pod.DeepCopy())
+		}
+		return pods, nil
+	})
+}
+
+// Builds a NodesMap from a list of Nodes, getting the pods on each node from
+// listPods in a bounded pool of workers. The NodeInfos are only classified and
+// sorted once all of them are built, so the map doesn't depend on the order
+// the workers finish in.
+func newNodeMap(ctx context.Context, nodes []*apiv1.Node, config *Config, listPods func(context.Context, *apiv1.Node) ([]*apiv1.Pod, error)) (Map, error) {
+	if _, err := config.parseNodeLabels(); err != nil {
+		return nil, err
+	}
+	if conflicting := config.ConflictingNodes(nodes); len(conflicting) > 0 {
+		glog.Warningf("Nodes %v match both the spot and on-demand node labels, leaving them out.", conflicting)
+	}
+
+	nodeInfos := make([]*NodeInfo, len(nodes))
+	group, groupCtx := errgroup.WithContext(ctx)
+	workers := make(chan struct{}, config.concurrency())
+	for i, node := range nodes {
+		if !hasAllocatableCPU(node) || config.Unavailable(node) {
+			continue
+		}
+		if groupCtx.Err() != nil {
+			break
+		}
+
+		i, node := i, node
+		workers <- struct{}{}
+		group.Go(func() error {
+			defer func() { <-workers }()
+			if err := groupCtx.Err(); err != nil {
+				return err
+			}
+			podsOnNode, err := listPods(groupCtx, node)
+			if err != nil {
+				return err
+			}
+			nodeInfo := config.newNodeInfo(node, podsOnNode)
+
+			// Sort pods with biggest CPU request first
+			sort.Slice(nodeInfo.Pods, func(i, j int) bool {
+				iCPU := podCPU(config.ResourceExtractor, nodeInfo.Pods[i])
+				jCPU := podCPU(config.ResourceExtractor, nodeInfo.Pods[j])
+				return iCPU > jCPU
+			})
+
+			nodeInfos[i] = nodeInfo
+			return nil
+		})
+	}
+	if err := group.Wait(); err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	nodeMap := Map{
 		OnDemand: make([]*NodeInfo, 0),
 		Spot:     make([]*NodeInfo, 0),
 	}
-
-	for _, node := range nodes {
-		nodeInfo, err := newNodeInfo(client, node)
-		if err != nil {
-			return nil, err
+	for _, nodeInfo := range nodeInfos {
+		if nodeInfo == nil {
+			continue
+		}
+		if nodeType, found := config.nodeType(nodeInfo.Node); found {
+			nodeMap[nodeType] = append(nodeMap[nodeType], nodeInfo)
 		}
+	}
 
-		// Sort pods with biggest CPU request first
-		sort.Slice(nodeInfo.Pods, func(i, j int) bool {
-			iCPU := getPodCPURequests(nodeInfo.Pods[i])
-			jCPU := getPodCPURequests(nodeInfo.Pods[j])
-			return iCPU > jCPU
+	// Sort spot nodes by most requested CPU first and on-demand nodes by
+	// least requested CPU first
+	for nodeType, nodeInfos := range nodeMap {
+		before := nodeType.before
+		sort.Slice(nodeInfos, func(i, j int) bool {
+			return before(nodeInfos[i], nodeInfos[j])
 		})
+	}
 
-		switch true {
-		case isSpotNode(node):
-			nodeMap[Spot] = append(nodeMap[Spot], nodeInfo)
-			continue
-		case isOnDemandNode(node):
-			nodeMap[OnDemand] = append(nodeMap[OnDemand], nodeInfo)
-			continue
-		default:
-			continue
+	return nodeMap, nil
+}
+
+// Returns how many nodes have their pods listed at once.
+func (c *Config) concurrency() int {
+	if c.Concurrency > 0 {
+		return c.Concurrency
+	}
+	return DefaultConcurrency
+}
+
+// Determines whether a NodeInfo is sorted before another in the array of
+// nodes of this type: spot nodes with the most requested CPU, or the highest
+// ratio of requested to allocatable CPU, come first and on-demand nodes with
+// the least requested CPU.
+func (t NodeType) before(a, b *NodeInfo) bool {
+	if t == Spot {
+		if a.sortMode == SortByCPURatio {
+			return a.requestedCPURatio() > b.requestedCPURatio()
 		}
+		return a.RequestedCPU > b.RequestedCPU
 	}
+	return a.RequestedCPU < b.RequestedCPU
+}
 
-	// Sort spot nodes by most requested CPU first
-	sort.Slice(nodeMap[Spot], func(i, j int) bool {
-		return nodeMap[Spot][i].RequestedCPU > nodeMap[Spot][j].RequestedCPU
+// Returns the ratio of the CPU requested by the Pods to the allocatable CPU of
+// the node, 0 if it has none.
+func (n *NodeInfo) requestedCPURatio() float64 {
+	allocatable := n.Node.Status.Allocatable.Cpu().MilliValue()
+	if allocatable <= 0 {
+		return 0
+	}
+	return float64(n.RequestedCPU) / float64(allocatable)
+}
+
+// Returns the ratio of requested to allocatable CPU the NodeInfo was last
+// sorted by, 0 if the node had none.
+func (n *NodeInfo) sortedCPURatio() float64 {
+	if n.sortedAllocatableCPU <= 0 {
+		return 0
+	}
+	return float64(n.sortedCPU) / float64(n.sortedAllocatableCPU)
+}
+
+// Records the requested and allocatable CPU the NodeInfo is sorted by.
+func (n *NodeInfo) markSorted() {
+	n.sortedCPU = n.RequestedCPU
+	n.sortedAllocatableCPU = n.Node.Status.Allocatable.Cpu().MilliValue()
+}
+
+// AddNode adds a NodeInfo without any pods for a new node, classifying it
+// according to the given Config. Returns false if the node is ignored, has no
+// allocatable CPU, is unavailable or is already in the map.
+func (m Map) AddNode(node *apiv1.Node, config *Config) bool {
+	if _, _, found := m.find(node.Name); found || !hasAllocatableCPU(node) || config.Unavailable(node) {
+		return false
+	}
+	nodeType, found := config.nodeType(node)
+	if !found {
+		return false
+	}
+	m[nodeType] = append(m[nodeType], &NodeInfo{
+		Node:      node,
+		Pods:      []*apiv1.Pod{},
+		FreeCPU:   node.Status.Allocatable.Cpu().MilliValue(),
+		Requested: map[apiv1.ResourceName]int64{},
+		Free:      allocatableResources(node),
+		extractor: config.ResourceExtractor,
+		sortMode:  config.SpotSortMode,
 	})
-	// Sort on-demand nodes by least requested CPU first
-	sort.Slice(nodeMap[OnDemand], func(i, j int) bool {
-		return nodeMap[OnDemand][i].RequestedCPU < nodeMap[OnDemand][j].RequestedCPU
+	m.resort(nodeType, len(m[nodeType])-1)
+	return true
+}
+
+// RemoveNode removes the NodeInfo of the named node. Returns false if the node
+// isn't in the map.
+func (m Map) RemoveNode(name string) bool {
+	nodeType, i, found := m.find(name)
+	if !found {
+		return false
+	}
+	m[nodeType] = append(m[nodeType][:i], m[nodeType][i+1:]...)
+	return true
+}
+
+// AddPod adds a pod to the NodeInfo of the node it's scheduled on, keeping the
+// node's pods sorted with the biggest CPU request first, and moves the
+// NodeInfo to its new place in the sorted array if it changed by more than
+// the SortTolerance. Returns false if the pod's node isn't in the map, the pod
+// is already on it or is ignored.
+func (m Map) AddPod(pod *apiv1.Pod, config *Config) bool {
+	nodeType, i, found := m.find(pod.Spec.NodeName)
+	if !found || config.ignorePod(pod, nodeType) {
+		return false
+	}
+	nodeInfo := m[nodeType][i]
+	if podIndex(nodeInfo.Pods, pod) >= 0 || podIndex(nodeInfo.DaemonSetPods, pod) >= 0 {
+		return false
+	}
+
+	cpu := podCPU(nodeInfo.extractor, pod)
+	if isDaemonSetOrMirrorPod(pod) {
+		nodeInfo.DaemonSetPods = append(nodeInfo.DaemonSetPods, pod)
+		nodeInfo.DaemonSetCPU += cpu
+		nodeInfo.FreeCPU -= cpu
+		nodeInfo.account(pod, true, 1)
+		return true
+	}
+	j := sort.Search(len(nodeInfo.Pods), func(j int) bool {
+		return podCPU(nodeInfo.extractor, nodeInfo.Pods[j]) < cpu
 	})
+	pods := make([]*apiv1.Pod, 0, len(nodeInfo.Pods)+1)
+	pods = append(pods, nodeInfo.Pods[:j]...)
+	pods = append(pods, pod)
+	nodeInfo.Pods = append(pods, nodeInfo.Pods[j:]...)
+	nodeInfo.RequestedCPU += cpu
+	nodeInfo.FreeCPU -= cpu
+	nodeInfo.account(pod, false, 1)
+	if config.unmovable(pod) {
+		nodeInfo.UnmovablePods = append(nodeInfo.UnmovablePods, pod)
+	}
+	m.update(nodeType, i, config)
+	return true
+}
 
-	return nodeMap, nil
+// RemovePod removes a pod from the NodeInfo of the node it's scheduled on and
+// moves the NodeInfo to its new place in the sorted array if it changed by
+// more than the SortTolerance. Returns false if the pod isn't in the map.
+func (m Map) RemovePod(pod *apiv1.Pod, config *Config) bool {
+	nodeType, i, found := m.find(pod.Spec.NodeName)
+	if !found {
+		return false
+	}
+	nodeInfo := m[nodeType][i]
+	if j := podIndex(nodeInfo.DaemonSetPods, pod); j >= 0 {
+		cpu := podCPU(nodeInfo.extractor, nodeInfo.DaemonSetPods[j])
+		pods := make([]*apiv1.Pod, 0, len(nodeInfo.DaemonSetPods)-1)
+		pods = append(pods, nodeInfo.DaemonSetPods[:j]...)
+		nodeInfo.DaemonSetPods = append(pods, nodeInfo.DaemonSetPods[j+1:]...)
+		nodeInfo.DaemonSetCPU -= cpu
+		nodeInfo.FreeCPU += cpu
+		nodeInfo.account(pod, true, -1)
+		return true
+	}
+	j := podIndex(nodeInfo.Pods, pod)
+	if j < 0 {
+		return false
+	}
+
+	cpu := podCPU(nodeInfo.extractor, nodeInfo.Pods[j])
+	pods := make([]*apiv1.Pod, 0, len(nodeInfo.Pods)-1)
+	pods = append(pods, nodeInfo.Pods[:j]...)
+	nodeInfo.Pods = append(pods, nodeInfo.Pods[j+1:]...)
+	if k := podIndex(nodeInfo.UnmovablePods, pod); k >= 0 {
+		unmovable := make([]*apiv1.Pod, 0, len(nodeInfo.UnmovablePods)-1)
+		unmovable = append(unmovable, nodeInfo.UnmovablePods[:k]...)
+		nodeInfo.UnmovablePods = append(unmovable, nodeInfo.UnmovablePods[k+1:]...)
+	}
+	nodeInfo.RequestedCPU -= cpu
+	nodeInfo.FreeCPU += cpu
+	nodeInfo.account(pod, false, -1)
+	m.update(nodeType, i, config)
+	return true
 }
 
-func newNodeInfo(client kube_client.Interface, node *apiv1.Node) (*NodeInfo, error) {
-	pods, err := getPodsOnNode(client, node)
-	if err != nil {
-		return nil, err
+// Sort re-sorts the arrays holding NodeInfos whose requested or allocatable
+// CPU changed by less than the Config's SortTolerance since they were last
+// sorted.
+func (m Map) Sort() {
+	for nodeType, nodeInfos := range m {
+		if !nodeInfos.unsorted() {
+			continue
+		}
+		before := nodeType.before
+		sort.SliceStable(nodeInfos, func(i, j int) bool {
+			return before(nodeInfos[i], nodeInfos[j])
+		})
+		for _, nodeInfo := range nodeInfos {
+			nodeInfo.markSorted()
+		}
 	}
-	requestedCPU := calculateRequestedCPU(pods)
+}
 
-	return &NodeInfo{
-		Node:         node,
-		Pods:         pods,
-		RequestedCPU: requestedCPU,
-		FreeCPU:      node.Status.Allocatable.Cpu().MilliValue() - requestedCPU,
-	}, nil
+// Determines whether any of the NodeInfos changed since they were last sorted.
+func (n NodeInfoArray) unsorted() bool {
+	for _, nodeInfo := range n {
+		if nodeInfo.RequestedCPU != nodeInfo.sortedCPU || nodeInfo.Node.Status.Allocatable.Cpu().MilliValue() != nodeInfo.sortedAllocatableCPU {
+			return true
+		}
+	}
+	return false
+}
+
+// Moves the NodeInfo at index i of the array of nodes of this type to its new
+// place once its share of requested to allocatable CPU has changed by more
+// than the Config's SortTolerance since it was last sorted.
+func (m Map) update(nodeType NodeType, i int, config *Config) {
+	nodeInfo := m[nodeType][i]
+	if config.SortTolerance > 0 && nodeInfo.Node.Status.Allocatable.Cpu().MilliValue() > 0 {
+		change := math.Abs(nodeInfo.requestedCPURatio()-nodeInfo.sortedCPURatio()) * 100
+		if change <= config.SortTolerance {
+			return
+		}
+	}
+	m.resort(nodeType, i)
+}
+
+// Returns the type and index of the named node's NodeInfo.
+func (m Map) find(name string) (NodeType, int, bool) {
+	for nodeType, nodeInfos := range m {
+		for i, nodeInfo := range nodeInfos {
+			if nodeInfo.Node.Name == name {
+				return nodeType, i, true
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+// Moves the NodeInfo at index i of the array of nodes of this type to its
+// place in the otherwise sorted array, leaving the other NodeInfos in order.
+func (m Map) resort(nodeType NodeType, i int) {
+	nodeInfos := m[nodeType]
+	nodeInfos[i].markSorted()
+	for ; i > 0 && nodeType.before(nodeInfos[i], nodeInfos[i-1]); i-- {
+		nodeInfos[i], nodeInfos[i-1] = nodeInfos[i-1], nodeInfos[i]
+	}
+	for ; i < len(nodeInfos)-1 && nodeType.before(nodeInfos[i+1], nodeInfos[i]); i++ {
+		nodeInfos[i], nodeInfos[i+1] = nodeInfos[i+1], nodeInfos[i]
+	}
+}
+
+// Returns the index of the pod with the UID in the pods, or -1 if it isn't one
+// of them.
+func podUIDIndex(pods []*apiv1.Pod, uid types.UID) int {
+	for i, pod := range pods {
+		if pod.UID == uid {
+			return i
+		}
+	}
+	return -1
+}
+
+// Returns the index of the pod in the pods by namespace and name, or -1 if it
+// isn't one of them.
+func podIndex(pods []*apiv1.Pod, pod *apiv1.Pod) int {
+	for i, other := range pods {
+		if other.Namespace == pod.Namespace && other.Name == pod.Name {
+			return i
+		}
+	}
+	return -1
+}
+
+// UpdateNode replaces the node of the matching NodeInfo if its allocatable
+// resources have changed, recalculating its free CPU and moving it to its new
+// place in the sorted array as AddPod does, or removes the NodeInfo if the
+// node no longer has any allocatable CPU. Returns whether the NodeInfo was
+// updated.
+func (m Map) UpdateNode(node *apiv1.Node, config *Config) bool {
+	for nodeType, nodeInfos := range m {
+		for i, nodeInfo := range nodeInfos {
+			if nodeInfo.Node.Name != node.Name {
+				continue
+			}
+			if apiequality.Semantic.DeepEqual(nodeInfo.Node.Status.Allocatable, node.Status.Allocatable) {
+				return false
+			}
+			if !hasAllocatableCPU(node) {
+				m[nodeType] = append(nodeInfos[:i], nodeInfos[i+1:]...)
+				return true
+			}
+			nodeInfo.Node = node
+			nodeInfo.FreeCPU = nodeInfo.freeCPU()
+			nodeInfo.resetResources()
+			m.update(nodeType, i, config)
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Config) newNodeInfo(node *apiv1.Node, podsOnNode []*apiv1.Pod) *NodeInfo {
+	pods, daemonSetPods := c.splitPods(node, podsOnNode)
+	nodeInfo := &NodeInfo{
+		Node:          node,
+		Pods:          pods,
+		RequestedCPU:  calculateRequestedCPU(c.ResourceExtractor, pods),
+		DaemonSetPods: daemonSetPods,
+		DaemonSetCPU:  calculateRequestedCPU(c.ResourceExtractor, daemonSetPods),
+		extractor:     c.ResourceExtractor,
+		sortMode:      c.SpotSortMode,
+	}
+	nodeInfo.FreeCPU = nodeInfo.freeCPU()
+	nodeInfo.markSorted()
+	nodeInfo.resetResources()
+	for _, pod := range pods {
+		if c.unmovable(pod) {
+			nodeInfo.UnmovablePods = append(nodeInfo.UnmovablePods, pod)
+		}
+	}
+	return nodeInfo
+}
+
+// Returns the allocatable CPU of the node left over by all of its pods.
+func (n *NodeInfo) freeCPU() int64 {
+	return n.Node.Status.Allocatable.Cpu().MilliValue() - n.RequestedCPU - n.DaemonSetCPU
 }
 
 // AddPod adds a pod to a NodeInfo and updates the relevant resource values.
 func (n *NodeInfo) AddPod(pod *apiv1.Pod) {
 	n.Pods = append(n.Pods, pod)
-	n.RequestedCPU = calculateRequestedCPU(n.Pods)
-	n.FreeCPU = n.Node.Status.Allocatable.Cpu().MilliValue() - n.RequestedCPU
+	n.RequestedCPU = calculateRequestedCPU(n.extractor, n.Pods)
+	n.FreeCPU = n.freeCPU()
+	n.account(pod, false, 1)
+}
+
+// RemovePod removes the pod with the same UID from a NodeInfo, as when
+// simulating draining its node, and updates the relevant resource values.
+// Returns false if the pod isn't one of its Pods.
+func (n *NodeInfo) RemovePod(pod *apiv1.Pod) bool {
+	j := podUIDIndex(n.Pods, pod.UID)
+	if j < 0 {
+		return false
+	}
+	removed := n.Pods[j]
+	pods := make([]*apiv1.Pod, 0, len(n.Pods)-1)
+	pods = append(pods, n.Pods[:j]...)
+	n.Pods = append(pods, n.Pods[j+1:]...)
+	if k := podUIDIndex(n.UnmovablePods, pod.UID); k >= 0 {
+		unmovable := make([]*apiv1.Pod, 0, len(n.UnmovablePods)-1)
+		unmovable = append(unmovable, n.UnmovablePods[:k]...)
+		n.UnmovablePods = append(unmovable, n.UnmovablePods[k+1:]...)
+	}
+	n.RequestedCPU = calculateRequestedCPU(n.extractor, n.Pods)
+	n.FreeCPU = n.freeCPU()
+	n.account(removed, false, -1)
+	return true
+}
+
+// SetPods replaces the Pods of a NodeInfo, as when accounting for them by
+// other requests, and recalculates the relevant resource values. Unmovable
+// pods are replaced by the pods with the same namespace and name.
+func (n *NodeInfo) SetPods(pods []*apiv1.Pod) {
+	n.Pods = pods
+	for i, unmovable := range n.UnmovablePods {
+		if j := podIndex(pods, unmovable); j >= 0 {
+			n.UnmovablePods[i] = pods[j]
+		}
+	}
+	n.RequestedCPU = calculateRequestedCPU(n.extractor, n.Pods)
+	n.FreeCPU = n.freeCPU()
+	n.resetResources()
+}
+
+// Fits determines whether every resource the pod requests, such as CPU, memory
+// and ephemeral storage, fits in the free resources of the node.
+func (n *NodeInfo) Fits(pod *apiv1.Pod) bool {
+	for name, request := range podRequests(n.extractor, pod) {
+		if request <= 0 {
+			continue
+		}
+		free := n.Free[name]
+		if name == apiv1.ResourceCPU {
+			free = n.FreeCPU
+		}
+		if free < request {
+			return false
+		}
+	}
+	return true
 }
 
-// Gets a list of pods that are running on the given node
-func getPodsOnNode(client kube_client.Interface, node *apiv1.Node) ([]*apiv1.Pod, error) {
-	podsOnNode, err := client.CoreV1().Pods(apiv1.NamespaceAll).List(context.Background(),
+// Recalculates the Requested and Free resources from all the pods on the node.
+func (n *NodeInfo) resetResources() {
+	n.Requested = map[apiv1.ResourceName]int64{}
+	n.Free = allocatableResources(n.Node)
+	for _, pod := range n.Pods {
+		n.account(pod, false, 1)
+	}
+	for _, pod := range n.DaemonSetPods {
+		n.account(pod, true, 1)
+	}
+	n.syncEphemeralStorage()
+}
+
+// Adds the resources requested by the pod to the NodeInfo, or takes them away
+// when sign is -1. The requests of DaemonSet pods are only taken out of Free.
+func (n *NodeInfo) account(pod *apiv1.Pod, daemonSet bool, sign int64) {
+	if n.Requested == nil || n.Free == nil {
+		return
+	}
+	for name, request := range podRequests(n.extractor, pod) {
+		if !daemonSet {
+			n.Requested[name] += sign * request
+		}
+		n.Free[name] -= sign * request
+	}
+	n.syncEphemeralStorage()
+}
+
+// Updates the ephemeral storage fields from the Requested and Free resources.
+func (n *NodeInfo) syncEphemeralStorage() {
+	n.RequestedEphemeralStorage = n.Requested[apiv1.ResourceEphemeralStorage]
+	n.FreeEphemeralStorage = n.Free[apiv1.ResourceEphemeralStorage]
+}
+
+// Returns the allocatable resources of the node, with CPU in MilliValue and
+// others in Value.
+func allocatableResources(node *apiv1.Node) map[apiv1.ResourceName]int64 {
+	resources := make(map[apiv1.ResourceName]int64, len(node.Status.Allocatable))
+	for name, quantity := range node.Status.Allocatable {
+		if name == apiv1.ResourceCPU {
+			resources[name] = quantity.MilliValue()
+		} else {
+			resources[name] = quantity.Value()
+		}
+	}
+	return resources
+}
+
+// String summarises the NodeInfo for logging, e.g. "node1: 2 pods, requested
+// 400m CPU, free 1600m CPU".
+func (n *NodeInfo) String() string {
+	return fmt.Sprintf("%s: %d pods, requested %dm CPU, free %dm CPU", n.Node.Name, len(n.Pods), n.RequestedCPU, n.FreeCPU)
+}
+
+// String summarises the map for logging with the totals of the on-demand then
+// the spot nodes, e.g. "on-demand: 2 nodes, 3 pods, requested 1200m CPU, free
+// 2800m CPU; spot: 1 nodes, 0 pods, requested 0m CPU, free 2000m CPU".
+func (m Map) String() string {
+	summaries := make([]string, 0, 2)
+	for _, nodeType := range []NodeType{OnDemand, Spot} {
+		var pods int
+		var requested, free int64
+		for _, nodeInfo := range m[nodeType] {
+			pods += len(nodeInfo.Pods)
+			requested += nodeInfo.RequestedCPU
+			free += nodeInfo.FreeCPU
+		}
+		summaries = append(summaries, fmt.Sprintf("%v: %d nodes, %d pods, requested %dm CPU, free %dm CPU",
+			nodeType, len(m[nodeType]), pods, requested, free))
+	}
+	return strings.Join(summaries, "; ")
+}
+
+// CPUUtilization returns the percentage of the node's allocatable CPU
+// requested by all of its pods, including the DaemonSetPods, or 0 if it has no
+// allocatable CPU.
+func (n *NodeInfo) CPUUtilization() float64 {
+	allocatable := n.Node.Status.Allocatable.Cpu().MilliValue()
+	if allocatable <= 0 {
+		return 0
+	}
+	return float64(n.RequestedCPU+n.DaemonSetCPU) * 100 / float64(allocatable)
+}
+
+// RoundedCPUUtilization returns CPUUtilization rounded to the nearest multiple
+// of precision percentage points, e.g. 1 for whole percents, with halves
+// rounded up. It's left unrounded when precision isn't positive.
+func (n *NodeInfo) RoundedCPUUtilization(precision float64) float64 {
+	return roundToPrecision(n.CPUUtilization(), precision)
+}
+
+// Rounds the value to the nearest multiple of precision.
+func roundToPrecision(value, precision float64) float64 {
+	if precision <= 0 {
+		return value
+	}
+	return math.Round(value/precision) * precision
+}
+
+// Lists all the pods bound to the given node from the API server
+func listPodsOnNode(ctx context.Context, client kube_client.Interface, node *apiv1.Node) ([]*apiv1.Pod, error) {
+	podsOnNode, err := client.CoreV1().Pods(apiv1.NamespaceAll).List(ctx,
 		metav1.ListOptions{FieldSelector: fields.SelectorFromSet(fields.Set{"spec.nodeName": node.Name}).String()})
 	if err != nil {
-		return []*apiv1.Pod{}, err
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
 	}
 
-	pods := make([]*apiv1.Pod, 0)
+	pods := make([]*apiv1.Pod, 0, len(podsOnNode.Items))
 	for i := range podsOnNode.Items {
-		// Ignore pods with priority below threshold on spot nodes
-		if int(*podsOnNode.Items[i].Spec.Priority) < PriorityThreshold && isSpotNode(node) {
-			continue
-		}
 		pods = append(pods, &podsOnNode.Items[i])
 	}
 	return pods, nil
 }
 
+// Splits the pods on a node into those considered for moving and the DaemonSet
+// and mirror pods which are never moved off it, leaving out ignored pods
+func (c *Config) splitPods(node *apiv1.Node, podsOnNode []*apiv1.Pod) ([]*apiv1.Pod, []*apiv1.Pod) {
+	nodeType, _ := c.nodeType(node)
+	pods := make([]*apiv1.Pod, 0)
+	daemonSetPods := make([]*apiv1.Pod, 0)
+	for _, pod := range podsOnNode {
+		switch {
+		case c.ignorePod(pod, nodeType):
+			continue
+		case isDaemonSetOrMirrorPod(pod):
+			daemonSetPods = append(daemonSetPods, pod)
+		default:
+			pods = append(pods, pod)
+		}
+	}
+	return pods, daemonSetPods
+}
+
+// safeToEvictAnnotation marks a pod with local storage as safe to move, as
+// for the cluster-autoscaler.
+const safeToEvictAnnotation = "cluster-autoscaler.kubernetes.io/safe-to-evict"
+
+// IsMovable determines whether the pod can be moved without losing data: pods
+// with emptyDir or hostPath volumes can't, unless annotated as safe to evict
+// like for the cluster-autoscaler.
+func IsMovable(pod *apiv1.Pod) bool {
+	if pod.Annotations[safeToEvictAnnotation] == "true" {
+		return true
+	}
+	for _, volume := range pod.Spec.Volumes {
+		if volume.EmptyDir != nil || volume.HostPath != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// IsReschedulingDisabled determines whether the pod opted out of being moved,
+// with its rescheduling annotation set to "false", much like pods opt out of
+// being evicted by the cluster-autoscaler with its safe-to-evict annotation.
+func (c *Config) IsReschedulingDisabled(pod *apiv1.Pod) bool {
+	return c.ReschedulingAnnotation != "" && pod.Annotations[c.ReschedulingAnnotation] == "false"
+}
+
+// Determines whether the pod is listed in the UnmovablePods of its NodeInfo.
+func (c *Config) unmovable(pod *apiv1.Pod) bool {
+	return c.ExcludedNamespaces[pod.Namespace] || c.IsReschedulingDisabled(pod) ||
+		(c.ProtectLocalStoragePods && !IsMovable(pod))
+}
+
+// Determines whether the pod is managed by a DaemonSet or is the mirror of a
+// static pod, either way it's bound to its node.
+func isDaemonSetOrMirrorPod(pod *apiv1.Pod) bool {
+	if _, found := pod.Annotations[apiv1.MirrorPodAnnotationKey]; found {
+		return true
+	}
+	controller := metav1.GetControllerOf(pod)
+	return controller != nil && controller.Kind == "DaemonSet"
+}
+
+// Determines whether the pod is left out of the NodeInfo of a node of the
+// given type: pods which have completed, terminating pods if configured, pods
+// outside the allowed namespaces and pods with priority below the threshold of
+// their node type are ignored.
+func (c *Config) ignorePod(pod *apiv1.Pod, nodeType NodeType) bool {
+	switch {
+	case pod.Status.Phase == apiv1.PodSucceeded || pod.Status.Phase == apiv1.PodFailed:
+		return true
+	case c.IgnoreTerminatingPods && pod.DeletionTimestamp != nil:
+		return true
+	case len(c.AllowedNamespaces) > 0 && !c.AllowedNamespaces[pod.Namespace]:
+		return true
+	}
+	switch nodeType {
+	case Spot:
+		return podPriority(pod) < c.PriorityThreshold
+	case OnDemand:
+		return c.OnDemandPriorityThreshold != nil && podPriority(pod) < *c.OnDemandPriorityThreshold
+	}
+	return false
+}
+
+// Returns the priority of the pod, 0 if it has none as when the Priority
+// admission controller isn't enabled.
+func podPriority(pod *apiv1.Pod) int {
+	if pod.Spec.Priority == nil {
+		return 0
+	}
+	return int(*pod.Spec.Priority)
+}
+
+// RequestedCPU returns the total requested CPU for a collection of pods in
+// MilliValue.
+func RequestedCPU(pods []*apiv1.Pod) int64 {
+	return calculateRequestedCPU(nil, pods)
+}
+
 // Works out requested CPU for a collection of pods and returns it in MilliValue
 // (Pod requests are stored as MilliValues hence the return type here)
-func calculateRequestedCPU(pods []*apiv1.Pod) int64 {
+func calculateRequestedCPU(extractor ResourceExtractor, pods []*apiv1.Pod) int64 {
 	var CPURequests int64
 	for _, pod := range pods {
-		CPURequests += getPodCPURequests(pod)
+		CPURequests += podCPU(extractor, pod)
 	}
 	return CPURequests
 }
 
-// Returns the total requested CPU  for all of the containers in a given Pod.
-// (Returned as MilliValues)
-func getPodCPURequests(pod *apiv1.Pod) int64 {
-	var CPUTotal int64
+// Returns the CPU used by a pod according to the extractor, or the
+// DefaultResourceExtractor when nil. (Returned as MilliValues)
+func podCPU(extractor ResourceExtractor, pod *apiv1.Pod) int64 {
+	return podRequests(extractor, pod)[apiv1.ResourceCPU]
+}
+
+// Returns all the resources used by a pod according to the extractor, the
+// default when nil.
+func podRequests(extractor ResourceExtractor, pod *apiv1.Pod) map[apiv1.ResourceName]int64 {
+	if extractor == nil {
+		extractor = DefaultResourceExtractor
+	}
+	return extractor.Extract(pod)
+}
+
+// PodResource returns the effective quantity of a pod for the given resource on
+// the basis: the larger of the sum of its containers' quantities and the largest of its
+// init containers' quantities, as init containers run one at a time before the
+// others start, plus the pod's overhead.
+func PodResource(pod *apiv1.Pod, name apiv1.ResourceName, basis ResourceBasis) resource.Quantity {
+	var total resource.Quantity
 	for _, container := range pod.Spec.Containers {
-		CPUTotal += container.Resources.Requests.Cpu().MilliValue()
+		if quantity, found := basis.containerResource(container.Resources, name); found {
+			total.Add(quantity)
+		}
+	}
+	for _, container := range pod.Spec.InitContainers {
+		if quantity, found := basis.containerResource(container.Resources, name); found && quantity.Cmp(total) > 0 {
+			total = quantity.DeepCopy()
+		}
 	}
-	return CPUTotal
+	if overhead, found := pod.Spec.Overhead[name]; found {
+		total.Add(overhead)
+	}
+	return total
 }
 
-// Determines if a node has the spotNodeLabel assigned
-func isSpotNode(node *apiv1.Node) bool {
-	splitLabel := strings.SplitN(SpotNodeLabel, "=", 2)
+// Determines whether the node has any allocatable CPU. Nodes which are still
+// initializing may report none, they can neither be drained nor take pods.
+func hasAllocatableCPU(node *apiv1.Node) bool {
+	if node.Status.Allocatable.Cpu().MilliValue() > 0 {
+		return true
+	}
+	glog.Warningf("Node %s reports no allocatable CPU, ignoring it.", node.Name)
+	return false
+}
+
+// Unavailable determines whether the node is cordoned or not Ready and so left
+// out of the map, unless IncludeUnavailableNodes is set.
+func (c *Config) Unavailable(node *apiv1.Node) bool {
+	if c.IncludeUnavailableNodes {
+		return false
+	}
+	if node.Spec.Unschedulable {
+		glog.V(4).Infof("Skipping node %s as it is cordoned", node.Name)
+		return true
+	}
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == apiv1.NodeReady && condition.Status == apiv1.ConditionTrue {
+			return false
+		}
+	}
+	glog.V(4).Infof("Skipping node %s as it is not Ready", node.Name)
+	return true
+}
 
-	// If "=" found, check for new label schema. If no "=" is found, check for
-	// old label schema
-	switch len(splitLabel) {
-	case 1:
-		_, found := node.ObjectMeta.Labels[SpotNodeLabel]
-		return found
-	case 2:
-		spotLabelKey := splitLabel[0]
-		spotLabelVal := splitLabel[1]
+// Returns the type of the node, from its override or else its labels, falling
+// back to the DefaultNodeType. Returns false if the node should be ignored.
+func (c *Config) nodeType(node *apiv1.Node) (NodeType, bool) {
+	if nodeType, found := c.NodeTypeOverrides[node.Name]; found {
+		return nodeType, true
+	}
+	spot, onDemand := c.isSpotNode(node), c.isOnDemandNode(node)
+	switch {
+	case spot && onDemand:
+		return 0, false
+	case spot:
+		return Spot, true
+	case onDemand:
+		return OnDemand, true
+	case c.DetectProviderLabels && hasAnyLabel(node, providerSpotLabels):
+		return Spot, true
+	case c.DetectProviderLabels && hasAnyLabel(node, providerOnDemandLabels):
+		return OnDemand, true
+	case c.DefaultNodeType != nil:
+		return *c.DefaultNodeType, true
+	default:
+		return 0, false
+	}
+}
 
-		val, _ := node.ObjectMeta.Labels[spotLabelKey]
-		if val == spotLabelVal {
-			return true
+// Validate parses the node labels as label selectors, returning an error for
+// the first one that isn't valid. Parsed selectors are kept for matching
+// nodes against.
+func (c *Config) Validate() error {
+	selectors, err := c.parseNodeLabels()
+	if err != nil {
+		return err
+	}
+	c.selectors = selectors
+	return nil
+}
+
+// Parses the node labels as label selectors by label, returning an error for
+// the first one that isn't valid.
+func (c *Config) parseNodeLabels() (map[string]labels.Selector, error) {
+	selectors := make(map[string]labels.Selector)
+	for _, label := range c.OnDemandNodeLabels {
+		selector, err := parseNodeLabel(label)
+		if err != nil {
+			return nil, fmt.Errorf("the on demand node label %q is not a valid label selector: %v", label, err)
 		}
+		selectors[label] = selector
 	}
-	return false
+	for _, label := range c.SpotNodeLabels {
+		selector, err := parseNodeLabel(label)
+		if err != nil {
+			return nil, fmt.Errorf("the spot node label %q is not a valid label selector: %v", label, err)
+		}
+		selectors[label] = selector
+	}
+	return selectors, nil
 }
 
-// Determines if a node has the OnDemandNodeLabel assigned
-func isOnDemandNode(node *apiv1.Node) bool {
-	splitLabel := strings.SplitN(OnDemandNodeLabel, "=", 2)
+// Returns the selector for the given node label, parsing it if it wasn't
+// validated. Labels that don't parse match no nodes.
+func (c *Config) selector(label string) labels.Selector {
+	if selector, ok := c.selectors[label]; ok {
+		return selector
+	}
+	selector, err := parseNodeLabel(label)
+	if err != nil {
+		glog.Errorf("Node label %q is not a valid label selector: %v", label, err)
+		return labels.Nothing()
+	}
+	return selector
+}
 
-	// If "=" found, check for new label schema. If no "=" is found, check for
-	// old label schema
-	switch len(splitLabel) {
-	case 1:
-		_, found := node.ObjectMeta.Labels[OnDemandNodeLabel]
-		return found
-	case 2:
-		onDemandLabelKey := splitLabel[0]
-		onDemandLabelVal := splitLabel[1]
+// Parses a node label as a label selector. Empty labels are rejected as they
+// would otherwise select every node.
+func parseNodeLabel(label string) (labels.Selector, error) {
+	if strings.TrimSpace(label) == "" {
+		return nil, fmt.Errorf("empty selector")
+	}
+	return labels.Parse(label)
+}
+
+// ConflictingNodes returns the names of the nodes matching both a spot and an
+// on-demand label without an override settling their type. Such nodes are
+// misconfigured, they are left out of the map rather than being counted as
+// either type.
+func (c *Config) ConflictingNodes(nodes []*apiv1.Node) []string {
+	var conflicting []string
+	for _, node := range nodes {
+		if _, found := c.NodeTypeOverrides[node.Name]; found {
+			continue
+		}
+		if c.isSpotNode(node) && c.isOnDemandNode(node) {
+			conflicting = append(conflicting, node.Name)
+		}
+	}
+	return conflicting
+}
+
+// providerSpotLabels are the labels cloud providers and provisioners set on
+// spot nodes, by key.
+var providerSpotLabels = map[string]string{
+	"karpenter.sh/capacity-type":            "spot",
+	"cloud.google.com/gke-spot":             "true",
+	"cloud.google.com/gke-preemptible":      "true",
+	"eks.amazonaws.com/capacityType":        "SPOT",
+	"kubernetes.azure.com/scalesetpriority": "spot",
+}
+
+// providerOnDemandLabels are the labels cloud providers and provisioners set
+// on on-demand nodes, by key.
+var providerOnDemandLabels = map[string]string{
+	"karpenter.sh/capacity-type":     "on-demand",
+	"eks.amazonaws.com/capacityType": "ON_DEMAND",
+}
 
-		val, _ := node.ObjectMeta.Labels[onDemandLabelKey]
-		if val == onDemandLabelVal {
+// Determines if a node has any of the labels.
+func hasAnyLabel(node *apiv1.Node, nodeLabels map[string]string) bool {
+	for key, value := range nodeLabels {
+		if actual, found := node.Labels[key]; found && actual == value {
 			return true
 		}
 	}
 	return false
 }
 
+// Determines if a node has one of the SpotNodeLabels assigned
+func (c *Config) isSpotNode(node *apiv1.Node) bool {
+	_, found := c.matchingLabel(c.SpotNodeLabels, node)
+	return found
+}
+
+// Determines if a node has one of the OnDemandNodeLabels assigned
+func (c *Config) isOnDemandNode(node *apiv1.Node) bool {
+	_, found := c.matchingLabel(c.OnDemandNodeLabels, node)
+	return found
+}
+
+// Returns the first of the labels whose selector matches the node, trying
+// them in order.
+func (c *Config) matchingLabel(nodeLabels []string, node *apiv1.Node) (string, bool) {
+	for i, label := range nodeLabels {
+		if c.selector(label).Matches(labels.Set(node.ObjectMeta.Labels)) {
+			if i > 0 {
+				glog.V(4).Infof("Node %s matched label %s rather than %s", node.Name, label, nodeLabels[0])
+			}
+			return label, true
+		}
+	}
+	return "", false
+}
+
 // CopyNodeInfos returns an array of copies of the NodeInfos in this array.
+// Each copy has its own pod slices, so pods can be added to or removed from a
+// copy, but the Node and pods they point to are shared with the original and
+// mustn't be modified.
 func (n NodeInfoArray) CopyNodeInfos() NodeInfoArray {
 	var arr NodeInfoArray
 	for _, node := range n {
 		nodeInfo := &NodeInfo{
-			Node:         node.Node,
-			Pods:         node.Pods,
-			RequestedCPU: node.RequestedCPU,
-			FreeCPU:      node.FreeCPU,
+			Node:                      node.Node,
+			Pods:                      append([]*apiv1.Pod(nil), node.Pods...),
+			RequestedCPU:              node.RequestedCPU,
+			FreeCPU:                   node.FreeCPU,
+			DaemonSetPods:             append([]*apiv1.Pod(nil), node.DaemonSetPods...),
+			DaemonSetCPU:              node.DaemonSetCPU,
+			UnmovablePods:             append([]*apiv1.Pod(nil), node.UnmovablePods...),
+			Requested:                 copyResources(node.Requested),
+			Free:                      copyResources(node.Free),
+			RequestedEphemeralStorage: node.RequestedEphemeralStorage,
+			FreeEphemeralStorage:      node.FreeEphemeralStorage,
+			extractor:                 node.extractor,
+			sortMode:                  node.sortMode,
+			sortedCPU:                 node.sortedCPU,
+			sortedAllocatableCPU:      node.sortedAllocatableCPU,
 		}
 		arr = append(arr, nodeInfo)
 	}
 	return arr
 }
 
+// Returns a copy of the resources, nil if they're nil.
+func copyResources(resources map[apiv1.ResourceName]int64) map[apiv1.ResourceName]int64 {
+	if resources == nil {
+		return nil
+	}
+	copied := make(map[apiv1.ResourceName]int64, len(resources))
+	for name, value := range resources {
+		copied[name] = value
+	}
+	return copied
+}
+
 func (n NodeInfoArray) GetClusterSnapshot() simulator.ClusterSnapshot {
 	snapshot := simulator.NewDeltaClusterSnapshot()
 	for _, node := range n {
-		snapshot.AddNodeWithPods(node.Node, node.Pods)
+		pods := make([]*apiv1.Pod, 0, len(node.Pods)+len(node.DaemonSetPods))
+		pods = append(pods, node.Pods...)
+		pods = append(pods, node.DaemonSetPods...)
+		snapshot.AddNodeWithPods(node.Node, pods)
 	}
 	return snapshot
 }
+
+// PodMove is a planned move of a pod off an on-demand node onto a spot node.
+type PodMove struct {
+	Pod      *apiv1.Pod
+	FromNode string
+	ToNode   string
+}
+
+// PlanMoves plans moving the pods off the on-demand nodes, least requested
+// first, onto the spot nodes by their free resources, taints and the pods'
+// node selectors and required node affinity. Each pod, biggest CPU request
+// first, goes onto the first spot node it fits in, most requested first, so
+// spot nodes are packed. A node's pods are only moved if they all fit and none
+// is unmovable, as moving some of them wouldn't empty it. Returns the moves and
+// the on-demand nodes they empty, the map itself is left untouched.
+func (m Map) PlanMoves() ([]PodMove, []string) {
+	spotNodeInfos := m[Spot].CopyNodeInfos()
+	var moves []PodMove
+	var emptied []string
+	for _, onDemandNodeInfo := range m[OnDemand] {
+		if len(onDemandNodeInfo.UnmovablePods) > 0 {
+			glog.V(4).Infof("Node %s has unmovable pods", onDemandNodeInfo.Node.Name)
+			continue
+		}
+		planned := spotNodeInfos.CopyNodeInfos()
+		nodeMoves, ok := planNodeMoves(onDemandNodeInfo, planned)
+		if !ok {
+			glog.V(4).Infof("Not all pods of node %s fit onto spot nodes", onDemandNodeInfo.Node.Name)
+			continue
+		}
+		spotNodeInfos = planned
+		moves = append(moves, nodeMoves...)
+		emptied = append(emptied, onDemandNodeInfo.Node.Name)
+	}
+	return moves, emptied
+}
+
+// DrainableNodes returns the on-demand nodes which can be fully emptied onto
+// the existing spot nodes, least requested first, along with the moves
+// emptying them as planned by PlanMoves. Nodes with unmovable pods are never
+// drainable. The map itself is left untouched.
+func (m Map) DrainableNodes() (NodeInfoArray, []PodMove) {
+	moves, emptied := m.PlanMoves()
+	emptiedNodes := make(map[string]bool, len(emptied))
+	for _, name := range emptied {
+		emptiedNodes[name] = true
+	}
+	drainable := make(NodeInfoArray, 0, len(emptied))
+	for _, nodeInfo := range m[OnDemand] {
+		if emptiedNodes[nodeInfo.Node.Name] {
+			drainable = append(drainable, nodeInfo)
+		}
+	}
+	return drainable, moves
+}
+
+// Plans moving all the pods of the on-demand node onto the spot nodes they can
+// schedule onto, adding them to the spot NodeInfos. Returns false if any pod
+// doesn't fit.
+func planNodeMoves(onDemandNodeInfo *NodeInfo, spotNodeInfos NodeInfoArray) ([]PodMove, bool) {
+	moves := make([]PodMove, 0, len(onDemandNodeInfo.Pods))
+	for _, pod := range onDemandNodeInfo.Pods {
+		var target *NodeInfo
+		for _, spotNodeInfo := range spotNodeInfos {
+			if spotNodeInfo.Fits(pod) && CanSchedule(pod, spotNodeInfo.Node) && ToleratesTaints(pod, spotNodeInfo.Node) {
+				target = spotNodeInfo
+				break
+			}
+		}
+		if target == nil {
+			return nil, false
+		}
+		target.AddPod(pod)
+		moves = append(moves, PodMove{
+			Pod:      pod,
+			FromNode: onDemandNodeInfo.Node.Name,
+			ToNode:   target.Node.Name,
+		})
+	}
+	return moves, true
+}
+
+// FindFit returns the node the pod fits best on, the one it would leave the
+// least free CPU on so that larger pods still find room elsewhere, among those
+// it fits on and can schedule onto tolerating their taints. Ties go to the
+// node sorted first. Returns false if the pod fits on none of them.
+func (n NodeInfoArray) FindFit(pod *apiv1.Pod) (*NodeInfo, bool) {
+	var best *NodeInfo
+	for _, nodeInfo := range n {
+		if !nodeInfo.Fits(pod) || !CanSchedule(pod, nodeInfo.Node) || !ToleratesTaints(pod, nodeInfo.Node) {
+			continue
+		}
+		if best == nil || nodeInfo.FreeCPU < best.FreeCPU {
+			best = nodeInfo
+		}
+	}
+	return best, best != nil
+}
+
+// CanSchedule determines whether the pod's node selector and required node
+// affinity allow it onto the node. Other predicates, such as for resources,
+// aren't checked.
+func CanSchedule(pod *apiv1.Pod, node *apiv1.Node) bool {
+	if !labels.SelectorFromSet(pod.Spec.NodeSelector).Matches(labels.Set(node.Labels)) {
+		return false
+	}
+	affinity := pod.Spec.Affinity
+	if affinity == nil || affinity.NodeAffinity == nil || affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution == nil {
+		return true
+	}
+	// The terms are ORed
+	for _, term := range affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms {
+		if matchesNodeSelectorTerm(term, node) {
+			return true
+		}
+	}
+	return false
+}
+
+// Determines whether the node matches all the requirements of the term. Terms
+// without any requirements match no nodes.
+func matchesNodeSelectorTerm(term apiv1.NodeSelectorTerm, node *apiv1.Node) bool {
+	if len(term.MatchExpressions) == 0 && len(term.MatchFields) == 0 {
+		return false
+	}
+	if len(term.MatchExpressions) > 0 {
+		selector, err := nodeSelectorRequirementsAsSelector(term.MatchExpressions)
+		if err != nil || !selector.Matches(labels.Set(node.Labels)) {
+			return false
+		}
+	}
+	// metadata.name is the only field which can be matched, by In or NotIn
+	for _, requirement := range term.MatchFields {
+		if requirement.Key != "metadata.name" {
+			return false
+		}
+		named := false
+		for _, value := range requirement.Values {
+			if value == node.Name {
+				named = true
+			}
+		}
+		switch requirement.Operator {
+		case apiv1.NodeSelectorOpIn:
+			if !named {
+				return false
+			}
+		case apiv1.NodeSelectorOpNotIn:
+			if named {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Converts node selector requirements into a label selector.
+func nodeSelectorRequirementsAsSelector(requirements []apiv1.NodeSelectorRequirement) (labels.Selector, error) {
+	selector := labels.NewSelector()
+	for _, requirement := range requirements {
+		var op selection.Operator
+		switch requirement.Operator {
+		case apiv1.NodeSelectorOpIn:
+			op = selection.In
+		case apiv1.NodeSelectorOpNotIn:
+			op = selection.NotIn
+		case apiv1.NodeSelectorOpExists:
+			op = selection.Exists
+		case apiv1.NodeSelectorOpDoesNotExist:
+			op = selection.DoesNotExist
+		case apiv1.NodeSelectorOpGt:
+			op = selection.GreaterThan
+		case apiv1.NodeSelectorOpLt:
+			op = selection.LessThan
+		default:
+			return nil, fmt.Errorf("%q is not a valid node selector operator", requirement.Operator)
+		}
+		r, err := labels.NewRequirement(requirement.Key, op, requirement.Values)
+		if err != nil {
+			return nil, err
+		}
+		selector = selector.Add(*r)
+	}
+	return selector, nil
+}
+
+// ToleratesTaints determines whether the pod tolerates all the NoSchedule and
+// NoExecute taints of the node, which would otherwise keep it off the node.
+func ToleratesTaints(pod *apiv1.Pod, node *apiv1.Node) bool {
+	for i := range node.Spec.Taints {
+		taint := &node.Spec.Taints[i]
+		if taint.Effect != apiv1.TaintEffectNoSchedule && taint.Effect != apiv1.TaintEffectNoExecute {
+			continue
+		}
+		tolerated := false
+		for j := range pod.Spec.Tolerations {
+			if pod.Spec.Tolerations[j].ToleratesTaint(taint) {
+				tolerated = true
+				break
+			}
+		}
+		if !tolerated {
+			return false
+		}
+	}
+	return true
+}
+
+// DisruptionBlockedPods returns those of the given pods covered by a
+// PodDisruptionBudget which doesn't allow evicting all of its pods among them,
+// so they can't currently be moved together. Budgets without a selector cover
+// no pods.
+func DisruptionBlockedPods(pods []*apiv1.Pod, pdbs []*policyv1.PodDisruptionBudget) []*apiv1.Pod {
+	var blocked []*apiv1.Pod
+	for _, pdb := range pdbs {
+		selector, err := metav1.LabelSelectorAsSelector(pdb.Spec.Selector)
+		if err != nil {
+			glog.Errorf("Failed to parse selector of PodDisruptionBudget %s/%s: %v", pdb.Namespace, pdb.Name, err)
+			continue
+		}
+		if selector.Empty() {
+			continue
+		}
+		var covered []*apiv1.Pod
+		for _, pod := range pods {
+			if pod.Namespace == pdb.Namespace && selector.Matches(labels.Set(pod.Labels)) {
+				covered = append(covered, pod)
+			}
+		}
+		if len(covered) > int(pdb.Status.DisruptionsAllowed) {
+			glog.V(4).Infof("PodDisruptionBudget %s/%s allows %d disruptions, not the %d needed", pdb.Namespace, pdb.Name, pdb.Status.DisruptionsAllowed, len(covered))
+			for _, pod := range covered {
+				if podIndex(blocked, pod) < 0 {
+					blocked = append(blocked, pod)
+				}
+			}
+		}
+	}
+	return blocked
+}
+
+// ApplyDisruptionBudgets adds the pods of each node which can't all be moved
+// off it within the given PodDisruptionBudgets to its UnmovablePods. As the
+// budgets change with every disruption, it's meant for a freshly built map.
+func (m Map) ApplyDisruptionBudgets(pdbs []*policyv1.PodDisruptionBudget) {
+	for _, nodeInfos := range m {
+		for _, nodeInfo := range nodeInfos {
+			for _, pod := range DisruptionBlockedPods(nodeInfo.Pods, pdbs) {
+				if podIndex(nodeInfo.UnmovablePods, pod) < 0 {
+					nodeInfo.UnmovablePods = append(nodeInfo.UnmovablePods, pod)
+				}
+			}
+		}
+	}
+}
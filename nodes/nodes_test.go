@@ -17,47 +17,146 @@ limitations under the License.
 package nodes
 
 import (
+	"context"
 	"fmt"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	apiv1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1beta1"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes/fake"
 	core "k8s.io/client-go/testing"
 )
 
 func TestIsSpotNode(t *testing.T) {
 	spotNode := createTestNodeWithLabel("fooSpotNode", 2000, map[string]string{"foo": "bar"})
+	config := NewConfig()
 
-	SpotNodeLabel = "foo"
-	assert.True(t, isSpotNode(spotNode), "expected node with label 'foo' to be spot node")
+	config.SpotNodeLabels = []string{"foo"}
+	assert.True(t, config.isSpotNode(spotNode), "expected node with label 'foo' to be spot node")
 
-	SpotNodeLabel = "foo=bar"
-	assert.True(t, isSpotNode(spotNode), "expected node with label 'foo' and value 'bar' to be spot node")
+	config.SpotNodeLabels = []string{"foo=bar"}
+	assert.True(t, config.isSpotNode(spotNode), "expected node with label 'foo' and value 'bar' to be spot node")
 
-	SpotNodeLabel = "foo=baz"
-	assert.False(t, isSpotNode(spotNode), "expected node with label 'foo' and value 'bar' to not be spot node")
+	config.SpotNodeLabels = []string{"foo=baz"}
+	assert.False(t, config.isSpotNode(spotNode), "expected node with label 'foo' and value 'bar' to not be spot node")
 }
 
 func TestIsOnDemandNode(t *testing.T) {
 	onDemandNode := createTestNodeWithLabel("fooDemandNode", 2000, map[string]string{"foo": "bar"})
+	config := NewConfig()
 
-	OnDemandNodeLabel = "foo"
-	assert.True(t, isOnDemandNode(onDemandNode), "expected node with label 'foo' to be on demand node")
+	config.OnDemandNodeLabels = []string{"foo"}
+	assert.True(t, config.isOnDemandNode(onDemandNode), "expected node with label 'foo' to be on demand node")
 
-	OnDemandNodeLabel = "foo=bar"
-	assert.True(t, isOnDemandNode(onDemandNode), "expected node with label 'foo' and value 'bar' to be on demand node")
+	config.OnDemandNodeLabels = []string{"foo=bar"}
+	assert.True(t, config.isOnDemandNode(onDemandNode), "expected node with label 'foo' and value 'bar' to be on demand node")
 
-	OnDemandNodeLabel = "foo=baz"
-	assert.False(t, isOnDemandNode(onDemandNode), "expected node with label 'foo' and value 'bar' to not be on demand node")
+	config.OnDemandNodeLabels = []string{"foo=baz"}
+	assert.False(t, config.isOnDemandNode(onDemandNode), "expected node with label 'foo' and value 'bar' to not be on demand node")
+}
+
+func TestLegacyNodeLabels(t *testing.T) {
+	legacySpotNode := createTestNodeWithLabel("legacySpotNode", 2000, map[string]string{"kubernetes.io/role": "spot-worker"})
+	newSpotNode := createTestNodeWithLabel("newSpotNode", 2000, map[string]string{"node-role.kubernetes.io/spot-worker": "true"})
+	config := NewConfig()
+
+	config.SpotNodeLabels = []string{"node-role.kubernetes.io/spot-worker", "kubernetes.io/role=spot-worker"}
+	assert.True(t, config.isSpotNode(newSpotNode), "expected node with the new label to be spot node")
+	assert.True(t, config.isSpotNode(legacySpotNode), "expected node with only the legacy label to be spot node")
+
+	label, found := config.matchingLabel(config.SpotNodeLabels, legacySpotNode)
+	assert.True(t, found)
+	assert.Equal(t, "kubernetes.io/role=spot-worker", label)
+	assert.Equal(t, "node-role.kubernetes.io/spot-worker", config.SpotNodeLabel())
+
+	config.SpotNodeLabels = []string{"node-role.kubernetes.io/spot-worker"}
+	assert.False(t, config.isSpotNode(legacySpotNode), "expected node with only the legacy label to not be spot node")
+}
+
+func TestSetBasedNodeLabels(t *testing.T) {
+	spotNode := createTestNodeWithLabel("spotNode", 2000, map[string]string{"kubernetes.io/role": "spot"})
+	spotWorkerNode := createTestNodeWithLabel("spotWorkerNode", 2000, map[string]string{"kubernetes.io/role": "spot-worker"})
+	workerNode := createTestNodeWithLabel("workerNode", 2000, map[string]string{"kubernetes.io/role": "worker"})
+	config := NewConfig()
+
+	config.SpotNodeLabels = []string{"kubernetes.io/role in (spot, spot-worker)"}
+	assert.NoError(t, config.Validate())
+	assert.True(t, config.isSpotNode(spotNode))
+	assert.True(t, config.isSpotNode(spotWorkerNode))
+	assert.False(t, config.isSpotNode(workerNode))
+
+	config.OnDemandNodeLabels = []string{"kubernetes.io/role,kubernetes.io/role notin (spot, spot-worker)"}
+	assert.NoError(t, config.Validate())
+	assert.True(t, config.isOnDemandNode(workerNode))
+	assert.False(t, config.isOnDemandNode(spotNode))
+}
+
+func TestConfigValidate(t *testing.T) {
+	config := NewConfig()
+	assert.NoError(t, config.Validate(), "expected the default node labels to be valid")
+	assert.True(t, config.isSpotNode(createTestNodeWithLabel("spotNode", 2000, map[string]string{"kubernetes.io/role": "spot-worker"})))
+
+	config.OnDemandNodeLabels = []string{"foo.bar/role=worker"}
+	config.SpotNodeLabels = []string{"foo.bar/node-role"}
+	assert.NoError(t, config.Validate())
+
+	config.OnDemandNodeLabels = []string{"foo.bar/broken=worker=true"}
+	assert.Error(t, config.Validate())
+
+	config.OnDemandNodeLabels = []string{"foo.bar/role=worker"}
+	config.SpotNodeLabels = []string{"foo.bar/node-role", ""}
+	assert.EqualError(t, config.Validate(), `the spot node label "" is not a valid label selector: empty selector`)
+	assert.False(t, config.isSpotNode(createTestNode("node1", 2000)), "expected an empty label to match no nodes")
+}
+
+func TestNewNodeMapInvalidConfig(t *testing.T) {
+	nodes := []*apiv1.Node{
+		createTestNodeWithLabel("node1", 2000, map[string]string{"kubernetes.io/role": "worker"}),
+	}
+
+	// Malformed labels are reported rather than matching no nodes
+	config := NewConfig()
+	config.SpotNodeLabels = []string{"kubernetes.io/role in (spot"}
+	_, err := NewNodeMap(context.Background(), createFakeClientWithPods(nil), nodes, config)
+	assert.Error(t, err)
+
+	// Nodes without any allocatable resources yet are left out
+	registering := createTestNodeWithLabel("node2", 2000, map[string]string{"kubernetes.io/role": "worker"})
+	registering.Status.Allocatable = apiv1.ResourceList{}
+	nodeMap, err := NewNodeMap(context.Background(), createFakeClientWithPods(nil), append(nodes, registering), NewConfig())
+	assert.NoError(t, err)
+	if assert.Equal(t, 1, len(nodeMap[OnDemand])) {
+		assert.Equal(t, "node1", nodeMap[OnDemand][0].Node.Name)
+	}
+	assert.False(t, nodeMap.AddNode(registering, NewConfig()))
+}
+
+func TestNewNodeMapMultipleNodeLabels(t *testing.T) {
+	nodes := []*apiv1.Node{
+		createTestNodeWithLabel("node1", 2000, map[string]string{"eks.amazonaws.com/capacityType": "ON_DEMAND"}),
+		createTestNodeWithLabel("node2", 2000, map[string]string{"node-role.kubernetes.io/spot": "true"}),
+		createTestNodeWithLabel("node3", 2000, map[string]string{"eks.amazonaws.com/capacityType": "SPOT"}),
+	}
+	config := NewConfig()
+	config.OnDemandNodeLabels = []string{"node-role.kubernetes.io/worker", "eks.amazonaws.com/capacityType=ON_DEMAND"}
+	config.SpotNodeLabels = []string{"node-role.kubernetes.io/spot", "eks.amazonaws.com/capacityType=SPOT"}
+
+	nodeMap, err := NewNodeMap(context.Background(), createFakeClientWithPods(nil), nodes, config)
+	assert.NoError(t, err)
+	if assert.Equal(t, 1, len(nodeMap[OnDemand])) {
+		assert.Equal(t, "node1", nodeMap[OnDemand][0].Node.Name, "expected node matching only the second on-demand label to be on demand")
+	}
+	assert.Equal(t, 2, len(nodeMap[Spot]), "expected nodes matching either spot label to be spot nodes")
 }
 
 func TestNewNodeMap(t *testing.T) {
-	OnDemandNodeLabel = "kubernetes.io/role=worker"
-	SpotNodeLabel = "kubernetes.io/role=spot-worker"
+	config := NewConfig()
 
 	spotLabels := map[string]string{
 		"kubernetes.io/role": "spot-worker",
@@ -75,7 +174,7 @@ func TestNewNodeMap(t *testing.T) {
 
 	fakeClient := createFakeClient(t)
 
-	nodeMap, err := NewNodeMap(fakeClient, nodes)
+	nodeMap, err := NewNodeMap(context.Background(), fakeClient, nodes, config)
 	if err != nil {
 		assert.Error(t, err, "Failed to build nodeMap")
 	}
@@ -113,8 +212,8 @@ func TestNewNodeMap(t *testing.T) {
 	// Check pods are sorted by Most RequestedCPU
 	for _, nodeInfo := range append(onDemandNodeInfos, spotNodeInfos...) {
 		for i := 1; i < len(nodeInfo.Pods); i++ {
-			firstPodRequest := getPodCPURequests(nodeInfo.Pods[i-1])
-			secondPodRequest := getPodCPURequests(nodeInfo.Pods[i])
+			firstPodRequest := config.PodResources(nodeInfo.Pods[i-1])[apiv1.ResourceCPU]
+			secondPodRequest := config.PodResources(nodeInfo.Pods[i])[apiv1.ResourceCPU]
 			if firstPodRequest < secondPodRequest {
 				assert.Fail(t, "Pods not sorted by most requested CPU on node %s", nodeInfo.Node.Name)
 			}
@@ -123,6 +222,649 @@ func TestNewNodeMap(t *testing.T) {
 
 }
 
+func TestNewNodeMapCancelled(t *testing.T) {
+	nodes := []*apiv1.Node{
+		createTestNodeWithLabel("node1", 2000, map[string]string{"kubernetes.io/role": "worker"}),
+		createTestNodeWithLabel("node2", 2000, map[string]string{"kubernetes.io/role": "worker"}),
+		createTestNodeWithLabel("node3", 2000, map[string]string{"kubernetes.io/role": "spot-worker"}),
+	}
+
+	// The context is cancelled while the pods on the first node are listed
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	lists := 0
+	fakeClient := &fake.Clientset{}
+	fakeClient.Fake.AddReactor("list", "pods", func(action core.Action) (bool, runtime.Object, error) {
+		lists++
+		cancel()
+		return true, &apiv1.PodList{}, nil
+	})
+
+	// A single worker lists the nodes one at a time
+	config := NewConfig()
+	config.Concurrency = 1
+	_, err := NewNodeMap(ctx, fakeClient, nodes, config)
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, 1, lists, "expected the scan to stop once the context was cancelled")
+}
+
+func TestNewNodeMapConcurrency(t *testing.T) {
+	nodes := make([]*apiv1.Node, 0)
+	podsOnNodes := make(map[string][]apiv1.Pod)
+	for i := 0; i < 50; i++ {
+		name := fmt.Sprintf("node%d", i)
+		role := "worker"
+		if i%3 == 0 {
+			role = "spot-worker"
+		}
+		nodes = append(nodes, createTestNodeWithLabel(name, 4000, map[string]string{"kubernetes.io/role": role}))
+		for j := 0; j < i%5; j++ {
+			pod := createTestPod(fmt.Sprintf("p%dn%d", j, i), int64(100*(i%7+j+1)))
+			pod.Spec.NodeName = name
+			podsOnNodes[name] = append(podsOnNodes[name], *pod)
+		}
+	}
+
+	// The map built by many workers matches the one built by a single worker
+	config := NewConfig()
+	config.Concurrency = 1
+	serial, err := NewNodeMap(context.Background(), createFakeClientWithPods(podsOnNodes), nodes, config)
+	assert.NoError(t, err)
+	config.Concurrency = 16
+	parallel, err := NewNodeMap(context.Background(), createFakeClientWithPods(podsOnNodes), nodes, config)
+	assert.NoError(t, err)
+	assert.Equal(t, serial, parallel)
+	assert.Equal(t, 17, len(parallel[Spot]))
+	assert.Equal(t, 33, len(parallel[OnDemand]))
+
+	// The first error is returned
+	fakeClient := &fake.Clientset{}
+	fakeClient.Fake.AddReactor("list", "pods", func(action core.Action) (bool, runtime.Object, error) {
+		if action.(core.ListAction).GetListRestrictions().Fields.String() == "spec.nodeName=node7" {
+			return true, nil, fmt.Errorf("list failed")
+		}
+		return true, &apiv1.PodList{}, nil
+	})
+	_, err = NewNodeMap(context.Background(), fakeClient, nodes, config)
+	assert.EqualError(t, err, "list failed")
+}
+
+func TestNewNodeMapFromLister(t *testing.T) {
+	config := NewConfig()
+	nodes := []*apiv1.Node{
+		createTestNodeWithLabel("node1", 2000, map[string]string{"kubernetes.io/role": "worker"}),
+		createTestNodeWithLabel("node2", 2000, map[string]string{"kubernetes.io/role": "worker"}),
+		createTestNodeWithLabel("node3", 2000, map[string]string{"kubernetes.io/role": "spot-worker"}),
+	}
+
+	var objects []runtime.Object
+	for i, nodeName := range []string{"node1", "node2", "node2", "node3", ""} {
+		pod := createTestPod(fmt.Sprintf("pod%d", i), 200)
+		pod.Spec.NodeName = nodeName
+		objects = append(objects, pod)
+	}
+	fakeClient := fake.NewSimpleClientset(objects...)
+
+	stopChannel := make(chan struct{})
+	defer close(stopChannel)
+	informerFactory := informers.NewSharedInformerFactory(fakeClient, 0)
+	podLister := informerFactory.Core().V1().Pods().Lister()
+	informerFactory.Start(stopChannel)
+	informerFactory.WaitForCacheSync(stopChannel)
+
+	nodeMap, err := NewNodeMapFromLister(podLister, nodes, config)
+	assert.NoError(t, err)
+	if assert.Equal(t, 2, len(nodeMap[OnDemand])) {
+		assert.Equal(t, "node1", nodeMap[OnDemand][0].Node.Name)
+		assert.Equal(t, 1, len(nodeMap[OnDemand][0].Pods))
+		assert.Equal(t, "node2", nodeMap[OnDemand][1].Node.Name)
+		assert.Equal(t, 2, len(nodeMap[OnDemand][1].Pods))
+		assert.Equal(t, int64(400), nodeMap[OnDemand][1].RequestedCPU)
+	}
+	if assert.Equal(t, 1, len(nodeMap[Spot])) && assert.Equal(t, 1, len(nodeMap[Spot][0].Pods)) {
+		assert.Equal(t, "pod3", nodeMap[Spot][0].Pods[0].Name)
+	}
+
+	// The pods of all nodes were listed at once
+	lists := 0
+	for _, action := range fakeClient.Actions() {
+		if action.Matches("list", "pods") {
+			lists++
+		}
+	}
+	assert.Equal(t, 1, lists)
+
+	// The pods in the map aren't the ones in the lister's cache
+	nodeMap[Spot][0].Pods[0].Spec.NodeName = ""
+	cached, err := podLister.Pods("kube-system").Get("pod3")
+	assert.NoError(t, err)
+	assert.Equal(t, "node3", cached.Spec.NodeName)
+}
+
+func TestNewNodeMapDisjointLabels(t *testing.T) {
+	// Two configs with disjoint labels each only see their own nodes.
+	configA := &Config{
+		OnDemandNodeLabels: []string{"pool=a-on-demand"},
+		SpotNodeLabels:     []string{"pool=a-spot"},
+	}
+	configB := &Config{
+		OnDemandNodeLabels: []string{"pool=b-on-demand"},
+		SpotNodeLabels:     []string{"pool=b-spot"},
+	}
+
+	nodes := []*apiv1.Node{
+		createTestNodeWithLabel("node1", 2000, map[string]string{"pool": "a-on-demand"}),
+		createTestNodeWithLabel("node2", 2000, map[string]string{"pool": "a-spot"}),
+		createTestNodeWithLabel("node3", 2000, map[string]string{"pool": "b-on-demand"}),
+		createTestNodeWithLabel("node4", 2000, map[string]string{"pool": "b-spot"}),
+	}
+
+	fakeClient := createFakeClient(t)
+
+	nodeMapA, err := NewNodeMap(context.Background(), fakeClient, nodes, configA)
+	assert.NoError(t, err)
+	nodeMapB, err := NewNodeMap(context.Background(), fakeClient, nodes, configB)
+	assert.NoError(t, err)
+
+	assert.Equal(t, 1, len(nodeMapA[OnDemand]))
+	assert.Equal(t, "node1", nodeMapA[OnDemand][0].Node.Name)
+	assert.Equal(t, 1, len(nodeMapA[Spot]))
+	assert.Equal(t, "node2", nodeMapA[Spot][0].Node.Name)
+
+	assert.Equal(t, 1, len(nodeMapB[OnDemand]))
+	assert.Equal(t, "node3", nodeMapB[OnDemand][0].Node.Name)
+	assert.Equal(t, 1, len(nodeMapB[Spot]))
+	assert.Equal(t, "node4", nodeMapB[Spot][0].Node.Name)
+}
+
+func TestNewNodeMapDefaultNodeType(t *testing.T) {
+	nodes := []*apiv1.Node{
+		createTestNodeWithLabel("node1", 2000, map[string]string{"kubernetes.io/role": "worker"}),
+		createTestNodeWithLabel("node3", 2000, map[string]string{"kubernetes.io/role": "spot-worker"}),
+		createTestNode("node2", 2000),
+	}
+
+	fakeClient := createFakeClient(t)
+
+	// Unlabelled nodes are ignored by default
+	config := NewConfig()
+	nodeMap, err := NewNodeMap(context.Background(), fakeClient, nodes, config)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(nodeMap[OnDemand]))
+	assert.Equal(t, "node1", nodeMap[OnDemand][0].Node.Name)
+	assert.Equal(t, 1, len(nodeMap[Spot]))
+
+	// Or they can be treated as on-demand nodes
+	config.DefaultNodeType, err = ParseNodeType("on-demand")
+	assert.NoError(t, err)
+	nodeMap, err = NewNodeMap(context.Background(), fakeClient, nodes, config)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(nodeMap[OnDemand]))
+	assert.Equal(t, "node1", nodeMap[OnDemand][0].Node.Name)
+	assert.Equal(t, "node2", nodeMap[OnDemand][1].Node.Name)
+	assert.Equal(t, 1, len(nodeMap[Spot]))
+
+	_, err = ParseNodeType("spot-ish")
+	assert.Error(t, err)
+}
+
+func TestNewNodeMapProviderLabels(t *testing.T) {
+	fakeClient := createFakeClientWithPods(nil)
+	nodes := []*apiv1.Node{
+		createTestNodeWithLabel("gke", 2000, map[string]string{"cloud.google.com/gke-spot": "true"}),
+		createTestNodeWithLabel("karpenterSpot", 2000, map[string]string{"karpenter.sh/capacity-type": "spot"}),
+		createTestNodeWithLabel("karpenterOnDemand", 2000, map[string]string{"karpenter.sh/capacity-type": "on-demand"}),
+		// The configured labels take precedence
+		createTestNodeWithLabel("worker", 2000, map[string]string{"kubernetes.io/role": "worker", "karpenter.sh/capacity-type": "spot"}),
+	}
+
+	// Nodes are only classified by their provider labels if enabled
+	config := NewConfig()
+	nodeMap, err := NewNodeMap(context.Background(), fakeClient, nodes, config)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(nodeMap[OnDemand]))
+	assert.Empty(t, nodeMap[Spot])
+
+	config.DetectProviderLabels = true
+	nodeMap, err = NewNodeMap(context.Background(), fakeClient, nodes, config)
+	assert.NoError(t, err)
+	nodeNames := func(nodeInfos NodeInfoArray) []string {
+		names := make([]string, 0)
+		for _, nodeInfo := range nodeInfos {
+			names = append(names, nodeInfo.Node.Name)
+		}
+		return names
+	}
+	assert.ElementsMatch(t, []string{"gke", "karpenterSpot"}, nodeNames(nodeMap[Spot]))
+	assert.ElementsMatch(t, []string{"karpenterOnDemand", "worker"}, nodeNames(nodeMap[OnDemand]))
+}
+
+func TestNewNodeMapConflictingLabels(t *testing.T) {
+	config := NewConfig()
+	config.OnDemandNodeLabels = []string{"kubernetes.io/role=worker", "node-pool=general"}
+	fakeClient := createFakeClientWithPods(map[string][]apiv1.Pod{
+		"node2": {*createTestPod("p1n2", 300)},
+	})
+	nodes := []*apiv1.Node{
+		createTestNodeWithLabel("node1", 2000, map[string]string{"kubernetes.io/role": "worker"}),
+		createTestNodeWithLabel("node2", 2000, map[string]string{"kubernetes.io/role": "spot-worker", "node-pool": "general"}),
+		createTestNodeWithLabel("node3", 2000, map[string]string{"kubernetes.io/role": "spot-worker"}),
+	}
+
+	// The node labelled both ways is in neither group
+	assert.Equal(t, []string{"node2"}, config.ConflictingNodes(nodes))
+	nodeMap, err := NewNodeMap(context.Background(), fakeClient, nodes, config)
+	assert.NoError(t, err)
+	if assert.Equal(t, 1, len(nodeMap[OnDemand])) {
+		assert.Equal(t, "node1", nodeMap[OnDemand][0].Node.Name)
+	}
+	if assert.Equal(t, 1, len(nodeMap[Spot])) {
+		assert.Equal(t, "node3", nodeMap[Spot][0].Node.Name)
+	}
+	assert.False(t, nodeMap.AddNode(nodes[1], config))
+
+	// An override settles its type
+	config.NodeTypeOverrides = map[string]NodeType{"node2": Spot}
+	assert.Empty(t, config.ConflictingNodes(nodes))
+	nodeMap, err = NewNodeMap(context.Background(), fakeClient, nodes, config)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(nodeMap[Spot]))
+	assert.Equal(t, 1, len(nodeMap[OnDemand]))
+}
+
+func TestNewNodeMapUnavailableNodes(t *testing.T) {
+	cordoned := createTestNodeWithLabel("node1", 2000, map[string]string{"kubernetes.io/role": "worker"})
+	cordoned.Spec.Unschedulable = true
+	notReady := createTestNodeWithLabel("node2", 2000, map[string]string{"kubernetes.io/role": "spot-worker"})
+	notReady.Status.Conditions[0].Status = apiv1.ConditionFalse
+	nodes := []*apiv1.Node{
+		cordoned,
+		notReady,
+		createTestNodeWithLabel("node3", 2000, map[string]string{"kubernetes.io/role": "worker"}),
+		createTestNodeWithLabel("node4", 2000, map[string]string{"kubernetes.io/role": "spot-worker"}),
+	}
+	fakeClient := createFakeClientWithPods(nil)
+
+	// Cordoned and NotReady nodes are left out by default
+	config := NewConfig()
+	nodeMap, err := NewNodeMap(context.Background(), fakeClient, nodes, config)
+	assert.NoError(t, err)
+	if assert.Equal(t, 1, len(nodeMap[OnDemand])) {
+		assert.Equal(t, "node3", nodeMap[OnDemand][0].Node.Name, "expected the cordoned node to be left out")
+	}
+	if assert.Equal(t, 1, len(nodeMap[Spot])) {
+		assert.Equal(t, "node4", nodeMap[Spot][0].Node.Name, "expected the NotReady node to be left out")
+	}
+	assert.False(t, nodeMap.AddNode(cordoned, config))
+
+	// Or they can be included
+	config.IncludeUnavailableNodes = true
+	nodeMap, err = NewNodeMap(context.Background(), fakeClient, nodes, config)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(nodeMap[OnDemand]))
+	assert.Equal(t, 2, len(nodeMap[Spot]))
+}
+
+func TestNewNodeMapNodeTypeOverrides(t *testing.T) {
+	nodes := []*apiv1.Node{
+		createTestNodeWithLabel("node1", 2000, map[string]string{"kubernetes.io/role": "worker"}),
+		createTestNodeWithLabel("node2", 2000, map[string]string{"kubernetes.io/role": "worker"}),
+		createTestNodeWithLabel("node3", 2000, map[string]string{"kubernetes.io/role": "spot-worker"}),
+	}
+
+	fakeClient := createFakeClient(t)
+
+	// node2 is labelled as an on-demand node but treated as a spot node
+	config := NewConfig()
+	overrides, err := ParseNodeTypeOverrides(map[string]string{"node2": "spot"})
+	assert.NoError(t, err)
+	config.NodeTypeOverrides = overrides
+	nodeMap, err := NewNodeMap(context.Background(), fakeClient, nodes, config)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(nodeMap[OnDemand]))
+	assert.Equal(t, "node1", nodeMap[OnDemand][0].Node.Name)
+	assert.Equal(t, 2, len(nodeMap[Spot]))
+	assert.ElementsMatch(t, []string{nodeMap[Spot][0].Node.Name, nodeMap[Spot][1].Node.Name}, []string{"node2", "node3"})
+
+	_, err = ParseNodeTypeOverrides(map[string]string{"node2": "spot-ish"})
+	assert.Error(t, err)
+}
+
+func TestNewNodeMapDaemonSetAndMirrorPods(t *testing.T) {
+	controller := true
+	daemonSetPod := createTestPod("p1n1", 200)
+	daemonSetPod.OwnerReferences = []metav1.OwnerReference{
+		{APIVersion: "apps/v1", Kind: "DaemonSet", Name: "ds", UID: "ds-uid", Controller: &controller},
+	}
+	mirrorPod := createTestPod("p2n1", 100)
+	mirrorPod.Annotations = map[string]string{apiv1.MirrorPodAnnotationKey: "mirror"}
+	fakeClient := createFakeClientWithPods(map[string][]apiv1.Pod{
+		"node1": {*daemonSetPod, *mirrorPod, *createTestPod("p3n1", 300)},
+	})
+
+	nodeMap, err := NewNodeMap(context.Background(), fakeClient, []*apiv1.Node{createTestNodeWithLabel("node1", 2000, map[string]string{"kubernetes.io/role": "worker"})}, NewConfig())
+	assert.NoError(t, err)
+
+	// Only the pod which can be moved counts towards the cost of draining
+	nodeInfo := nodeMap[OnDemand][0]
+	assert.Equal(t, 1, len(nodeInfo.Pods))
+	assert.Equal(t, "p3n1", nodeInfo.Pods[0].Name)
+	assert.Equal(t, int64(300), nodeInfo.RequestedCPU)
+	assert.Equal(t, 2, len(nodeInfo.DaemonSetPods))
+	assert.Equal(t, int64(300), nodeInfo.DaemonSetCPU)
+	assert.Equal(t, int64(1400), nodeInfo.FreeCPU)
+}
+
+func TestNewNodeMapCompletedAndTerminatingPods(t *testing.T) {
+	controller := true
+	completedJobPod := createTestPod("job", 300)
+	completedJobPod.OwnerReferences = []metav1.OwnerReference{{Kind: "Job", Name: "job", Controller: &controller}}
+	completedJobPod.Status.Phase = apiv1.PodSucceeded
+	failedPod := createTestPod("failed", 400)
+	failedPod.Status.Phase = apiv1.PodFailed
+	terminatingPod := createTestPod("terminating", 500)
+	now := metav1.Now()
+	terminatingPod.DeletionTimestamp = &now
+	terminatingPod.Spec.NodeName = "node1"
+	fakeClient := createFakeClientWithPods(map[string][]apiv1.Pod{
+		"node1": {*createTestPod("running", 100), *completedJobPod, *failedPod, *terminatingPod},
+	})
+	nodes := []*apiv1.Node{createTestNodeWithLabel("node1", 2000, map[string]string{"kubernetes.io/role": "worker"})}
+
+	// Completed pods are left out, terminating ones count until they're gone
+	config := NewConfig()
+	nodeMap, err := NewNodeMap(context.Background(), fakeClient, nodes, config)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(nodeMap[OnDemand][0].Pods))
+	assert.Equal(t, int64(600), nodeMap[OnDemand][0].RequestedCPU)
+
+	config.IgnoreTerminatingPods = true
+	nodeMap, err = NewNodeMap(context.Background(), fakeClient, nodes, config)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(nodeMap[OnDemand][0].Pods))
+	assert.Equal(t, int64(100), nodeMap[OnDemand][0].RequestedCPU)
+	assert.False(t, nodeMap.AddPod(terminatingPod, config))
+}
+
+func TestNewNodeMapNilPriority(t *testing.T) {
+	spotLabels := map[string]string{"kubernetes.io/role": "spot-worker"}
+	withoutPriority := createTestPod("p1n1", 300)
+	withoutPriority.Spec.Priority = nil
+	fakeClient := createFakeClientWithPods(map[string][]apiv1.Pod{
+		"node1": {*withoutPriority, *createLowPriorityTestPod("p2n1", 200)},
+	})
+
+	// Pods without a priority are treated as priority 0
+	for threshold, expected := range map[int][]string{-1: {"p1n1", "p2n1"}, 0: {"p1n1"}, 1: {}} {
+		config := NewConfig()
+		config.PriorityThreshold = threshold
+		nodeMap, err := NewNodeMap(context.Background(), fakeClient, []*apiv1.Node{createTestNodeWithLabel("node1", 2000, spotLabels)}, config)
+		assert.NoError(t, err)
+
+		podNames := make([]string, 0)
+		for _, pod := range nodeMap[Spot][0].Pods {
+			podNames = append(podNames, pod.Name)
+		}
+		assert.Equal(t, expected, podNames, "threshold %d", threshold)
+	}
+}
+
+func TestNewNodeMapOnDemandPriorityThreshold(t *testing.T) {
+	fakeClient := createFakeClientWithPods(map[string][]apiv1.Pod{
+		"node1": {*createTestPod("p1n1", 300), *createLowPriorityTestPod("p2n1", 200)},
+	})
+	nodes := []*apiv1.Node{
+		createTestNodeWithLabel("node1", 2000, map[string]string{"kubernetes.io/role": "worker"}),
+	}
+
+	// All pods are considered on on-demand nodes without a threshold
+	config := NewConfig()
+	config.PriorityThreshold = 1
+	nodeMap, err := NewNodeMap(context.Background(), fakeClient, nodes, config)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(nodeMap[OnDemand][0].Pods))
+	assert.Equal(t, int64(500), nodeMap[OnDemand][0].RequestedCPU)
+
+	threshold := 0
+	config.OnDemandPriorityThreshold = &threshold
+	nodeMap, err = NewNodeMap(context.Background(), fakeClient, nodes, config)
+	assert.NoError(t, err)
+	if assert.Equal(t, 1, len(nodeMap[OnDemand][0].Pods)) {
+		assert.Equal(t, "p1n1", nodeMap[OnDemand][0].Pods[0].Name)
+	}
+	assert.Equal(t, int64(300), nodeMap[OnDemand][0].RequestedCPU)
+}
+
+func TestNewNodeMapSpotSortMode(t *testing.T) {
+	spotLabels := map[string]string{"kubernetes.io/role": "spot-worker"}
+	fakeClient := createFakeClientWithPods(map[string][]apiv1.Pod{
+		"big":   {*createTestPod("p1big", 3000)},
+		"small": {*createTestPod("p1small", 1800)},
+	})
+	nodes := []*apiv1.Node{
+		createTestNodeWithLabel("big", 16000, spotLabels),
+		createTestNodeWithLabel("small", 2000, spotLabels),
+	}
+	spotNodeNames := func(nodeMap Map) []string {
+		names := make([]string, 0)
+		for _, nodeInfo := range nodeMap[Spot] {
+			names = append(names, nodeInfo.Node.Name)
+		}
+		return names
+	}
+
+	// The big node has the most requested CPU but the small one is fuller
+	config := NewConfig()
+	nodeMap, err := NewNodeMap(context.Background(), fakeClient, nodes, config)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"big", "small"}, spotNodeNames(nodeMap))
+
+	config.SpotSortMode, err = ParseSortMode("cpu-ratio")
+	assert.NoError(t, err)
+	nodeMap, err = NewNodeMap(context.Background(), fakeClient, nodes, config)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"small", "big"}, spotNodeNames(nodeMap))
+
+	// Incremental updates keep the order
+	pod := createTestPod("p2big", 12000)
+	pod.Spec.NodeName = "big"
+	assert.True(t, nodeMap.AddPod(pod, config))
+	assert.Equal(t, []string{"big", "small"}, spotNodeNames(nodeMap))
+
+	_, err = ParseSortMode("most-free")
+	assert.Error(t, err)
+}
+
+func TestMapIncrementalUpdates(t *testing.T) {
+	config := NewConfig()
+	onDemandLabels := map[string]string{"kubernetes.io/role": "worker"}
+	spotLabels := map[string]string{"kubernetes.io/role": "spot-worker"}
+
+	nodeMap, err := NewNodeMap(context.Background(), createFakeClient(t), []*apiv1.Node{
+		createTestNodeWithLabel("node1", 2000, onDemandLabels),
+		createTestNodeWithLabel("node2", 2000, onDemandLabels),
+		createTestNodeWithLabel("node3", 2000, spotLabels),
+		createTestNodeWithLabel("node4", 2000, spotLabels),
+	}, config)
+	assert.NoError(t, err)
+
+	scheduled := func(pod *apiv1.Pod, nodeName string) *apiv1.Pod {
+		pod.Spec.NodeName = nodeName
+		return pod
+	}
+	newPod := scheduled(createTestPod("p3n1", 1000), "node1")
+	removedPod := scheduled(createTestPod("p1n2", 500), "node2")
+	node5 := createTestNodeWithLabel("node5", 2000, onDemandLabels)
+	node6 := createTestNodeWithLabel("node6", 2000, spotLabels)
+
+	assert.True(t, nodeMap.AddPod(newPod, config))
+	assert.False(t, nodeMap.AddPod(newPod, config), "pod already added")
+	assert.True(t, nodeMap.RemovePod(removedPod, config))
+	assert.False(t, nodeMap.RemovePod(removedPod, config), "pod already removed")
+	assert.True(t, nodeMap.AddNode(node5, config))
+	assert.False(t, nodeMap.AddNode(node5, config), "node already added")
+	assert.True(t, nodeMap.AddPod(scheduled(createTestPod("p1n5", 200), "node5"), config))
+	assert.True(t, nodeMap.RemoveNode("node3"))
+	assert.False(t, nodeMap.RemoveNode("node3"), "node already removed")
+	assert.True(t, nodeMap.AddNode(node6, config))
+	assert.True(t, nodeMap.AddPod(scheduled(createTestPod("p1n6", 800), "node6"), config))
+	assert.True(t, nodeMap.AddPod(scheduled(createTestPod("p2n6", 900), "node6"), config))
+	assert.False(t, nodeMap.AddPod(scheduled(createTestPod("p1n9", 100), "node9"), config), "node not in map")
+
+	// The deltas leave the map as a full rebuild would
+	pods := map[string][]apiv1.Pod{
+		"node1": {*createTestPod("p1n1", 100), *createTestPod("p2n1", 300), *newPod},
+		"node2": {*createTestPod("p2n2", 300), *createTestPod("p3n2", 400)},
+		"node4": {
+			*createTestPod("p1n4", 500),
+			*createTestPod("p2n4", 200),
+			*createTestPod("p3n4", 400),
+			*createTestPod("p4n4", 100),
+			*createTestPod("p5n4", 300),
+		},
+		"node5": {*createTestPod("p1n5", 200)},
+		"node6": {*createTestPod("p1n6", 800), *createTestPod("p2n6", 900)},
+	}
+	rebuilt, err := NewNodeMap(context.Background(), createFakeClientWithPods(pods), []*apiv1.Node{
+		createTestNodeWithLabel("node1", 2000, onDemandLabels),
+		createTestNodeWithLabel("node2", 2000, onDemandLabels),
+		createTestNodeWithLabel("node4", 2000, spotLabels),
+		node5,
+		node6,
+	}, config)
+	assert.NoError(t, err)
+
+	summarize := func(nodeInfos NodeInfoArray) []string {
+		summary := make([]string, 0, len(nodeInfos))
+		for _, nodeInfo := range nodeInfos {
+			podNames := make([]string, 0, len(nodeInfo.Pods))
+			for _, pod := range nodeInfo.Pods {
+				podNames = append(podNames, pod.Name)
+			}
+			summary = append(summary, fmt.Sprintf("%s %d/%d %v", nodeInfo.Node.Name, nodeInfo.RequestedCPU, nodeInfo.FreeCPU, podNames))
+		}
+		return summary
+	}
+	assert.Equal(t, []string{
+		"node5 200/1800 [p1n5]",
+		"node2 700/1300 [p3n2 p2n2]",
+		"node1 1400/600 [p3n1 p2n1 p1n1]",
+	}, summarize(nodeMap[OnDemand]))
+	assert.Equal(t, summarize(rebuilt[OnDemand]), summarize(nodeMap[OnDemand]))
+	assert.Equal(t, summarize(rebuilt[Spot]), summarize(nodeMap[Spot]))
+}
+
+func TestMapSortTolerance(t *testing.T) {
+	config := NewConfig()
+	// 100m of the nodes' 2000m allocatable
+	config.SortTolerance = 5
+	onDemandLabels := map[string]string{"kubernetes.io/role": "worker"}
+
+	fakeClient := createFakeClientWithPods(map[string][]apiv1.Pod{
+		"node1": {*createTestPod("p1n1", 500)},
+		"node2": {*createTestPod("p1n2", 540)},
+		"node3": {*createTestPod("p1n3", 700)},
+	})
+	nodeMap, err := NewNodeMap(context.Background(), fakeClient, []*apiv1.Node{
+		createTestNodeWithLabel("node1", 2000, onDemandLabels),
+		createTestNodeWithLabel("node2", 2000, onDemandLabels),
+		createTestNodeWithLabel("node3", 2000, onDemandLabels),
+	}, config)
+	assert.NoError(t, err)
+
+	nodeNames := func() []string {
+		names := make([]string, 0, len(nodeMap[OnDemand]))
+		for _, nodeInfo := range nodeMap[OnDemand] {
+			names = append(names, nodeInfo.Node.Name)
+		}
+		return names
+	}
+	addPod := func(name string, cpu int64, nodeName string) {
+		pod := createTestPod(name, cpu)
+		pod.Spec.NodeName = nodeName
+		assert.True(t, nodeMap.AddPod(pod, config))
+	}
+
+	// Small changes aren't re-sorted straight away
+	addPod("p2n1", 30, "node1")
+	addPod("p3n1", 30, "node1")
+	assert.Equal(t, []string{"node1", "node2", "node3"}, nodeNames())
+	nodeMap.Sort()
+	assert.Equal(t, []string{"node2", "node1", "node3"}, nodeNames())
+
+	// Small changes adding up to more than the tolerance are
+	addPod("p4n1", 50, "node1")
+	addPod("p5n1", 50, "node1")
+	addPod("p6n1", 50, "node1")
+	assert.Equal(t, []string{"node2", "node3", "node1"}, nodeNames())
+
+	// Sorting again leaves a sorted map as it is
+	nodeMap.Sort()
+	assert.Equal(t, []string{"node2", "node3", "node1"}, nodeNames())
+	for i := 1; i < len(nodeMap[OnDemand]); i++ {
+		assert.True(t, nodeMap[OnDemand][i-1].RequestedCPU <= nodeMap[OnDemand][i].RequestedCPU)
+	}
+}
+
+func TestNewNodeMapUnreadyPods(t *testing.T) {
+	nodes := []*apiv1.Node{
+		createTestNodeWithLabel("node7", 2000, map[string]string{"kubernetes.io/role": "spot-worker"}),
+	}
+	fakeClient := createFakeClient(t)
+
+	nodeMap, err := NewNodeMap(context.Background(), fakeClient, nodes, NewConfig())
+	assert.NoError(t, err)
+
+	// Scheduled pods reserve their capacity whether or not they are Ready
+	nodeInfo := nodeMap[Spot][0]
+	assert.Equal(t, 2, len(nodeInfo.Pods))
+	assert.Equal(t, int64(1000), nodeInfo.RequestedCPU)
+	assert.Equal(t, int64(1000), nodeInfo.FreeCPU)
+}
+
+func TestUpdateNode(t *testing.T) {
+	nodes := []*apiv1.Node{
+		createTestNodeWithLabel("node1", 2000, map[string]string{"kubernetes.io/role": "worker"}),
+		createTestNodeWithLabel("node3", 2000, map[string]string{"kubernetes.io/role": "spot-worker"}),
+	}
+	fakeClient := createFakeClient(t)
+	config := NewConfig()
+
+	nodeMap, err := NewNodeMap(context.Background(), fakeClient, nodes, config)
+	assert.NoError(t, err)
+	nodeInfo := nodeMap[Spot][0]
+	assert.Equal(t, int64(1200), nodeInfo.FreeCPU)
+
+	// Nothing changes while the allocatable is the same
+	assert.False(t, nodeMap.UpdateNode(nodes[1].DeepCopy(), config))
+
+	// The spot node's allocatable CPU shrinks
+	updated := createTestNodeWithLabel("node3", 1500, map[string]string{"kubernetes.io/role": "spot-worker"})
+	assert.True(t, nodeMap.UpdateNode(updated, config))
+	assert.Equal(t, updated, nodeInfo.Node)
+	assert.Equal(t, int64(800), nodeInfo.RequestedCPU)
+	assert.Equal(t, int64(700), nodeInfo.FreeCPU)
+
+	// Unknown nodes are ignored
+	assert.False(t, nodeMap.UpdateNode(createTestNode("node9", 1000), config))
+
+	// By ratio, node2 with 1200 of 2000 requested comes before node3 with 800
+	config.SpotSortMode = SortByCPURatio
+	config.SortTolerance = 10
+	spotLabels := map[string]string{"kubernetes.io/role": "spot-worker"}
+	nodeMap, err = NewNodeMap(context.Background(), fakeClient, []*apiv1.Node{
+		createTestNodeWithLabel("node2", 2000, spotLabels),
+		createTestNodeWithLabel("node3", 2000, spotLabels),
+	}, config)
+	assert.NoError(t, err)
+	assert.Equal(t, "node2", nodeMap[Spot][0].Node.Name)
+
+	// Once node3's allocatable CPU halves it is fuller than node2
+	assert.True(t, nodeMap.UpdateNode(createTestNodeWithLabel("node3", 1000, spotLabels), config))
+	assert.Equal(t, "node3", nodeMap[Spot][0].Node.Name)
+	assert.Equal(t, "node2", nodeMap[Spot][1].Node.Name)
+}
+
 func TestAddPod(t *testing.T) {
 
 	nodeInfo1 := createTestNodeInfo(createTestNode("node1", 2000), []*apiv1.Pod{}, 0)
@@ -141,7 +883,58 @@ func TestAddPod(t *testing.T) {
 	assert.Equal(t, int64(979), nodeInfo1.FreeCPU)
 }
 
-func TestGetPodsOnNode(t *testing.T) {
+func TestSetPods(t *testing.T) {
+	pod1 := createTestPod("pod1", 300)
+	nodeInfo := createTestNodeInfo(createTestNode("node1", 2000), []*apiv1.Pod{pod1}, 300)
+	nodeInfo.UnmovablePods = []*apiv1.Pod{pod1}
+
+	smaller := pod1.DeepCopy()
+	smaller.Spec.Containers[0].Resources.Requests[apiv1.ResourceCPU] = *resource.NewMilliQuantity(100, resource.DecimalSI)
+	pod2 := createTestPod("pod2", 200)
+	nodeInfo.SetPods([]*apiv1.Pod{smaller, pod2})
+
+	assert.Equal(t, int64(300), nodeInfo.RequestedCPU)
+	assert.Equal(t, int64(1700), nodeInfo.FreeCPU)
+	assert.Equal(t, int64(300), nodeInfo.Requested[apiv1.ResourceCPU])
+	assert.Equal(t, []*apiv1.Pod{smaller}, nodeInfo.UnmovablePods)
+}
+
+func TestRoundedCPUUtilization(t *testing.T) {
+	node := createTestNode("node1", 2000)
+
+	tests := []struct {
+		requested int64
+		precision float64
+		expected  float64
+	}{
+		// Halves round up
+		{1010, 1, 51},
+		{1009, 1, 50},
+		{1005, 0.5, 50.5},
+		{1004, 0.5, 50},
+		{1015, 0.5, 51},
+		{1990, 1, 100},
+		{0, 1, 0},
+		{2000, 5, 100},
+		{1050, 5, 55},
+		{1049, 5, 50},
+		// Unrounded without a precision
+		{1009, 0, 50.45},
+	}
+	for _, test := range tests {
+		nodeInfo := createTestNodeInfo(node, []*apiv1.Pod{}, test.requested)
+		assert.Equal(t, test.expected, nodeInfo.RoundedCPUUtilization(test.precision), "%dm at precision %v", test.requested, test.precision)
+	}
+
+	// Internal precision is kept
+	nodeInfo := createTestNodeInfo(node, []*apiv1.Pod{}, 1009)
+	assert.Equal(t, 50.45, nodeInfo.CPUUtilization())
+
+	nodeInfo = createTestNodeInfo(createTestNode("node2", 0), []*apiv1.Pod{}, 0)
+	assert.Equal(t, float64(0), nodeInfo.RoundedCPUUtilization(1))
+}
+
+func TestListPodsOnNode(t *testing.T) {
 	spotLabels := map[string]string{
 		"kubernetes.io/role": "spot-worker",
 	}
@@ -158,8 +951,14 @@ func TestGetPodsOnNode(t *testing.T) {
 	node6 := createTestNodeWithLabel("node6", 2000, onDemandLabels)
 
 	fakeClient := createFakeClient(t)
+	config := NewConfig()
+	movablePods := func(node *apiv1.Node) ([]*apiv1.Pod, error) {
+		podsOnNode, err := listPodsOnNode(context.Background(), fakeClient, node)
+		pods, _ := config.splitPods(node, podsOnNode)
+		return pods, err
+	}
 
-	podsOnNode1, err := getPodsOnNode(fakeClient, node1)
+	podsOnNode1, err := movablePods(node1)
 	if err != nil {
 		assert.Error(t, err, "Found error in getting pods on node")
 	}
@@ -167,7 +966,7 @@ func TestGetPodsOnNode(t *testing.T) {
 	assert.Equal(t, "p1n1", podsOnNode1[0].Name)
 	assert.Equal(t, "p2n1", podsOnNode1[1].Name)
 
-	podsOnNode2, err := getPodsOnNode(fakeClient, node2)
+	podsOnNode2, err := movablePods(node2)
 	if err != nil {
 		assert.Error(t, err, "Found error in getting pods on node")
 	}
@@ -176,7 +975,7 @@ func TestGetPodsOnNode(t *testing.T) {
 	assert.Equal(t, "p2n2", podsOnNode2[1].Name)
 	assert.Equal(t, "p3n2", podsOnNode2[2].Name)
 
-	podsOnNode3, err := getPodsOnNode(fakeClient, node3)
+	podsOnNode3, err := movablePods(node3)
 	if err != nil {
 		assert.Error(t, err, "Found error in getting pods on node")
 	}
@@ -184,7 +983,7 @@ func TestGetPodsOnNode(t *testing.T) {
 	assert.Equal(t, "p1n3", podsOnNode3[0].Name)
 	assert.Equal(t, "p2n3", podsOnNode3[1].Name)
 
-	podsOnNode4, err := getPodsOnNode(fakeClient, node4)
+	podsOnNode4, err := movablePods(node4)
 	if err != nil {
 		assert.Error(t, err, "Found error in getting pods on node")
 	}
@@ -195,7 +994,7 @@ func TestGetPodsOnNode(t *testing.T) {
 	assert.Equal(t, "p4n4", podsOnNode4[3].Name)
 	assert.Equal(t, "p5n4", podsOnNode4[4].Name)
 
-	podsOnNode5, err := getPodsOnNode(fakeClient, node5)
+	podsOnNode5, err := movablePods(node5)
 	if err != nil {
 		assert.Error(t, err, "Found error in getting pods on node")
 	}
@@ -204,7 +1003,7 @@ func TestGetPodsOnNode(t *testing.T) {
 	assert.Equal(t, "p4n5", podsOnNode5[1].Name)
 	assert.Equal(t, "p5n5", podsOnNode5[2].Name)
 
-	podsOnNode6, err := getPodsOnNode(fakeClient, node6)
+	podsOnNode6, err := movablePods(node6)
 	if err != nil {
 		assert.Error(t, err, "Found error in getting pods on node")
 	}
@@ -232,25 +1031,165 @@ func TestCalculateRequestedCPU(t *testing.T) {
 		createTestPod("p3n3", 300),
 	}
 
-	pods1Request := calculateRequestedCPU(pods1)
+	pods1Request := calculateRequestedCPU(nil, pods1)
 	assert.Equal(t, int64(400), pods1Request)
 
-	pods2Request := calculateRequestedCPU(pods2)
+	pods2Request := calculateRequestedCPU(nil, pods2)
 	assert.Equal(t, int64(800), pods2Request)
 
-	pods3Request := calculateRequestedCPU(pods3)
+	pods3Request := calculateRequestedCPU(nil, pods3)
 	assert.Equal(t, int64(1300), pods3Request)
 }
 
-func TestGetPodCPURequests(t *testing.T) {
+func TestResourceBasis(t *testing.T) {
+	pod := createTestPod("burstable", 200)
+	pod.Spec.Containers[0].Resources.Limits = apiv1.ResourceList{
+		apiv1.ResourceCPU:    *resource.NewMilliQuantity(500, resource.DecimalSI),
+		apiv1.ResourceMemory: resource.MustParse("1Gi"),
+	}
+	pod.Spec.Containers = append(pod.Spec.Containers, apiv1.Container{
+		Resources: apiv1.ResourceRequirements{
+			Requests: apiv1.ResourceList{
+				apiv1.ResourceCPU: *resource.NewMilliQuantity(100, resource.DecimalSI),
+			},
+		},
+	})
+
+	// The second container has no limit
+	for name, expected := range map[string]int64{"requests": 300, "limits": 500, "max-of-requests-limits": 600} {
+		basis, err := ParseResourceBasis(name)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, NewResourceExtractor(basis).Extract(pod)[apiv1.ResourceCPU], name)
+	}
+	assert.Equal(t, int64(0), DefaultResourceExtractor.Extract(pod)[apiv1.ResourceMemory])
+	assert.Equal(t, int64(1<<30), NewResourceExtractor(Limits).Extract(pod)[apiv1.ResourceMemory])
+
+	// The basis flows through to the requested and free CPU of nodes
+	pod.Spec.NodeName = "node1"
+	fakeClient := createFakeClientWithPods(map[string][]apiv1.Pod{"node1": {*pod}})
+	nodes := []*apiv1.Node{createTestNodeWithLabel("node1", 2000, map[string]string{"kubernetes.io/role": "worker"})}
+	config := NewConfig()
+	config.ResourceExtractor = NewResourceExtractor(MaxOfRequestsLimits)
+	nodeMap, err := NewNodeMap(context.Background(), fakeClient, nodes, config)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(600), nodeMap[OnDemand][0].RequestedCPU)
+	assert.Equal(t, int64(1400), nodeMap[OnDemand][0].FreeCPU)
+
+	_, err = ParseResourceBasis("usage")
+	assert.Error(t, err)
+}
+
+func TestCustomResourceExtractor(t *testing.T) {
+	nodes := []*apiv1.Node{
+		createTestNodeWithLabel("node1", 2000, map[string]string{"kubernetes.io/role": "worker"}),
+	}
+	fakeClient := createFakeClient(t)
+
+	// Count every pod as using 1 CPU, whatever it requests
+	config := NewConfig()
+	config.ResourceExtractor = ResourceExtractorFunc(func(pod *apiv1.Pod) map[apiv1.ResourceName]int64 {
+		return map[apiv1.ResourceName]int64{apiv1.ResourceCPU: 1000}
+	})
+
+	nodeMap, err := NewNodeMap(context.Background(), fakeClient, nodes, config)
+	assert.NoError(t, err)
+	nodeInfo := nodeMap[OnDemand][0]
+	assert.Equal(t, int64(2000), nodeInfo.RequestedCPU)
+	assert.Equal(t, int64(0), nodeInfo.FreeCPU)
+	assert.Equal(t, int64(2000), config.RequestedCPU(nodeInfo.Pods))
+
+	// Pods added later are accounted for the same way
+	nodeInfo.AddPod(createTestPod("pod1", 100))
+	assert.Equal(t, int64(3000), nodeInfo.RequestedCPU)
+	assert.Equal(t, int64(-1000), nodeInfo.FreeCPU)
+
+	// The default extractor sums container requests
+	assert.Equal(t, int64(400), NewConfig().RequestedCPU(nodeInfo.Pods[:2]))
+}
+
+func TestPodCPURequests(t *testing.T) {
+	config := NewConfig()
 	pod1 := createTestPod("pod1", 100)
 	pod2 := createTestPod("pod2", 200)
 
-	pod1Request := getPodCPURequests(pod1)
-	assert.Equal(t, int64(100), pod1Request)
+	assert.Equal(t, int64(100), config.PodResources(pod1)[apiv1.ResourceCPU])
+	assert.Equal(t, int64(200), config.PodResources(pod2)[apiv1.ResourceCPU])
+	assert.Equal(t, int64(300), config.RequestedCPU([]*apiv1.Pod{pod1, pod2}))
+
+	// An init container requesting more than the containers together sets
+	// the pod's request
+	initPod := createTestPod("initPod", 100)
+	initPod.Spec.Containers = append(initPod.Spec.Containers, initPod.Spec.Containers[0])
+	initPod.Spec.InitContainers = []apiv1.Container{
+		{Resources: apiv1.ResourceRequirements{Requests: apiv1.ResourceList{apiv1.ResourceCPU: *resource.NewMilliQuantity(500, resource.DecimalSI)}}},
+		{Resources: apiv1.ResourceRequirements{Requests: apiv1.ResourceList{apiv1.ResourceCPU: *resource.NewMilliQuantity(150, resource.DecimalSI)}}},
+	}
+	assert.Equal(t, int64(500), config.PodResources(initPod)[apiv1.ResourceCPU])
+
+	initPod.Spec.InitContainers = initPod.Spec.InitContainers[1:]
+	assert.Equal(t, int64(200), config.PodResources(initPod)[apiv1.ResourceCPU], "expected the containers' requests to be summed")
+
+	// Overhead is added on top
+	initPod.Spec.Overhead = apiv1.ResourceList{
+		apiv1.ResourceCPU:    *resource.NewMilliQuantity(250, resource.DecimalSI),
+		apiv1.ResourceMemory: *resource.NewQuantity(1024, resource.BinarySI),
+	}
+	assert.Equal(t, int64(450), config.PodResources(initPod)[apiv1.ResourceCPU])
+	assert.Equal(t, int64(1024), config.PodResources(initPod)[apiv1.ResourceMemory])
+}
+
+func TestString(t *testing.T) {
+	nodeMap := Map{
+		OnDemand: NodeInfoArray{
+			createTestNodeInfo(createTestNode("node1", 2000), []*apiv1.Pod{createTestPod("p1n1", 100), createTestPod("p2n1", 300)}, 400),
+			createTestNodeInfo(createTestNode("node2", 2000), []*apiv1.Pod{createTestPod("p1n2", 800)}, 800),
+		},
+		Spot: NodeInfoArray{
+			createTestNodeInfo(createTestNode("spot1", 4000), []*apiv1.Pod{}, 0),
+		},
+	}
 
-	pod2Request := getPodCPURequests(pod2)
-	assert.Equal(t, int64(200), pod2Request)
+	assert.Equal(t, "node1: 2 pods, requested 400m CPU, free 1600m CPU", nodeMap[OnDemand][0].String())
+	assert.Equal(t, "on-demand: 2 nodes, 3 pods, requested 1200m CPU, free 2800m CPU; "+
+		"spot: 1 nodes, 0 pods, requested 0m CPU, free 4000m CPU", nodeMap.String())
+	assert.Equal(t, "on-demand: 0 nodes, 0 pods, requested 0m CPU, free 0m CPU; "+
+		"spot: 0 nodes, 0 pods, requested 0m CPU, free 0m CPU", Map{}.String())
+}
+
+func TestNodeInfoRemovePod(t *testing.T) {
+	pod1 := createTestPod("p1n1", 300)
+	pod1.UID = "uid-1"
+	pod2 := createTestPod("p2n1", 200)
+	pod2.UID = "uid-2"
+	fakeClient := createFakeClientWithPods(map[string][]apiv1.Pod{"node1": {*pod1, *pod2}})
+	nodes := []*apiv1.Node{createTestNodeWithLabel("node1", 2000, map[string]string{"kubernetes.io/role": "worker"})}
+	nodeMap, err := NewNodeMap(context.Background(), fakeClient, nodes, NewConfig())
+	assert.NoError(t, err)
+	nodeInfo := nodeMap[OnDemand][0]
+
+	// Pods are matched by UID
+	assert.True(t, nodeInfo.RemovePod(pod1))
+	if assert.Equal(t, 1, len(nodeInfo.Pods)) {
+		assert.Equal(t, "p2n1", nodeInfo.Pods[0].Name)
+	}
+	assert.Equal(t, int64(200), nodeInfo.RequestedCPU)
+	assert.Equal(t, int64(1800), nodeInfo.FreeCPU)
+	assert.Equal(t, int64(200), nodeInfo.Requested[apiv1.ResourceCPU])
+	assert.Equal(t, int64(1800), nodeInfo.Free[apiv1.ResourceCPU])
+
+	// Removing a pod which isn't there changes nothing
+	assert.False(t, nodeInfo.RemovePod(pod1))
+	absent := createTestPod("p2n1", 200)
+	absent.UID = "uid-3"
+	assert.False(t, nodeInfo.RemovePod(absent))
+	assert.Equal(t, 1, len(nodeInfo.Pods))
+	assert.Equal(t, int64(200), nodeInfo.RequestedCPU)
+
+	// It undoes AddPod
+	nodeInfo.AddPod(pod1)
+	assert.True(t, nodeInfo.RemovePod(pod1))
+	assert.Equal(t, int64(200), nodeInfo.RequestedCPU)
+	assert.Equal(t, int64(1800), nodeInfo.FreeCPU)
 }
 
 func TestCopyNodeInfos(t *testing.T) {
@@ -295,6 +1234,486 @@ func TestCopyNodeInfos(t *testing.T) {
 	assert.Equal(t, len(pods1), len(nodeInfos[0].Pods))
 	assert.Equal(t, len(pods2), len(nodeInfos[1].Pods))
 	assert.Equal(t, len(pods3), len(nodeInfos[2].Pods))
+
+	// Reassigning pods in the copy leaves the original's pods in place
+	nodeInfosCopy[0].Pods[0] = pod2
+	nodeInfosCopy[1].Pods = nodeInfosCopy[1].Pods[:1]
+	assert.Equal(t, "p1n1", nodeInfos[0].Pods[0].Name)
+	assert.Equal(t, []*apiv1.Pod{pods2[0], pods2[1]}, nodeInfos[1].Pods)
+	assert.True(t, pods3[0] == nodeInfosCopy[2].Pods[0], "expected the copies to share the pods themselves")
+}
+
+func TestPlanMoves(t *testing.T) {
+	onDemandPods := []*apiv1.Pod{
+		createTestPod("p1n1", 300),
+		createTestPod("p2n1", 200),
+		createTestPod("p1n2", 1500),
+		createTestPod("p1n3", 1900),
+	}
+	spotPod := createTestPod("p1s1", 600)
+	nodeMap := Map{
+		OnDemand: NodeInfoArray{
+			createTestNodeInfo(createTestNode("node1", 2000), onDemandPods[0:2], 500),
+			createTestNodeInfo(createTestNode("node2", 2000), onDemandPods[2:3], 1500),
+			createTestNodeInfo(createTestNode("node3", 2000), onDemandPods[3:4], 1900),
+		},
+		Spot: NodeInfoArray{
+			createTestNodeInfo(createTestNode("spot1", 1000), []*apiv1.Pod{spotPod}, 600),
+			createTestNodeInfo(createTestNode("spot2", 2000), []*apiv1.Pod{}, 0),
+		},
+	}
+
+	moves, emptied := nodeMap.PlanMoves()
+	assert.Equal(t, []PodMove{
+		{Pod: onDemandPods[0], FromNode: "node1", ToNode: "spot1"},
+		{Pod: onDemandPods[1], FromNode: "node1", ToNode: "spot2"},
+		{Pod: onDemandPods[2], FromNode: "node2", ToNode: "spot2"},
+	}, moves)
+	assert.Equal(t, []string{"node1", "node2"}, emptied, "expected node3's pod not to fit")
+
+	// The map itself is left untouched
+	assert.Equal(t, []*apiv1.Pod{spotPod}, nodeMap[Spot][0].Pods)
+	assert.Equal(t, int64(400), nodeMap[Spot][0].FreeCPU)
+	assert.Equal(t, 0, len(nodeMap[Spot][1].Pods))
+	assert.Equal(t, int64(2000), nodeMap[Spot][1].FreeCPU)
+	assert.Equal(t, 2, len(nodeMap[OnDemand][0].Pods))
+}
+
+func TestDrainableNodes(t *testing.T) {
+	nodeMap := Map{
+		OnDemand: NodeInfoArray{
+			createTestNodeInfo(createTestNode("node1", 2000), []*apiv1.Pod{createTestPod("p1n1", 600)}, 600),
+			createTestNodeInfo(createTestNode("node2", 2000), []*apiv1.Pod{createTestPod("p1n2", 900)}, 900),
+		},
+		Spot: NodeInfoArray{
+			createTestNodeInfo(createTestNode("spot1", 2000), []*apiv1.Pod{}, 1000),
+		},
+	}
+
+	// Once node1 is emptied there's no room left for the pod on node2
+	drainable, moves := nodeMap.DrainableNodes()
+	if assert.Equal(t, 1, len(drainable)) {
+		assert.True(t, drainable[0] == nodeMap[OnDemand][0])
+	}
+	if assert.Equal(t, 1, len(moves)) {
+		assert.True(t, moves[0].Pod == nodeMap[OnDemand][0].Pods[0])
+		assert.Equal(t, "node1", moves[0].FromNode)
+		assert.Equal(t, "spot1", moves[0].ToNode)
+	}
+	assert.Equal(t, int64(1000), nodeMap[Spot][0].RequestedCPU, "expected the map to be left untouched")
+
+	// Nodes with unmovable pods aren't drainable
+	nodeMap[OnDemand][0].UnmovablePods = nodeMap[OnDemand][0].Pods
+	drainable, moves = nodeMap.DrainableNodes()
+	if assert.Equal(t, 1, len(drainable)) {
+		assert.Equal(t, "node2", drainable[0].Node.Name)
+	}
+	if assert.Equal(t, 1, len(moves)) {
+		assert.Equal(t, "p1n2", moves[0].Pod.Name)
+		assert.Equal(t, "node2", moves[0].FromNode)
+		assert.Equal(t, "spot1", moves[0].ToNode)
+	}
+}
+
+func TestCanSchedule(t *testing.T) {
+	spot1 := createTestNodeWithLabel("spot1", 2000, map[string]string{"kubernetes.io/role": "spot-worker", "zone": "a"})
+	spot2 := createTestNodeWithLabel("spot2", 2000, map[string]string{"kubernetes.io/role": "spot-worker", "zone": "b"})
+
+	pod := createTestPod("pod1", 100)
+	assert.True(t, CanSchedule(pod, spot1))
+	assert.True(t, CanSchedule(pod, spot2))
+
+	pod.Spec.NodeSelector = map[string]string{"zone": "b"}
+	assert.False(t, CanSchedule(pod, spot1))
+	assert.True(t, CanSchedule(pod, spot2))
+
+	pod.Spec.NodeSelector = nil
+	pod.Spec.Affinity = &apiv1.Affinity{
+		NodeAffinity: &apiv1.NodeAffinity{
+			RequiredDuringSchedulingIgnoredDuringExecution: &apiv1.NodeSelector{
+				NodeSelectorTerms: []apiv1.NodeSelectorTerm{
+					{MatchExpressions: []apiv1.NodeSelectorRequirement{{Key: "zone", Operator: apiv1.NodeSelectorOpIn, Values: []string{"a", "c"}}}},
+				},
+			},
+		},
+	}
+	assert.True(t, CanSchedule(pod, spot1))
+	assert.False(t, CanSchedule(pod, spot2))
+
+	// Terms are ORed
+	terms := &pod.Spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms
+	*terms = append(*terms, apiv1.NodeSelectorTerm{
+		MatchFields: []apiv1.NodeSelectorRequirement{{Key: "metadata.name", Operator: apiv1.NodeSelectorOpIn, Values: []string{"spot2"}}},
+	})
+	assert.True(t, CanSchedule(pod, spot2))
+
+	// An empty term matches no nodes
+	*terms = []apiv1.NodeSelectorTerm{{}}
+	assert.False(t, CanSchedule(pod, spot1))
+}
+
+func TestPlanMovesNodeSelector(t *testing.T) {
+	pod := createTestPod("p1n1", 300)
+	pod.Spec.NodeSelector = map[string]string{"zone": "b"}
+	nodeMap := Map{
+		OnDemand: NodeInfoArray{
+			createTestNodeInfo(createTestNode("node1", 2000), []*apiv1.Pod{pod}, 300),
+		},
+		Spot: NodeInfoArray{
+			createTestNodeInfo(createTestNodeWithLabel("spot1", 2000, map[string]string{"zone": "a"}), []*apiv1.Pod{}, 0),
+			createTestNodeInfo(createTestNodeWithLabel("spot2", 2000, map[string]string{"zone": "b"}), []*apiv1.Pod{}, 0),
+		},
+	}
+
+	moves, emptied := nodeMap.PlanMoves()
+	assert.Equal(t, []PodMove{{Pod: pod, FromNode: "node1", ToNode: "spot2"}}, moves)
+	assert.Equal(t, []string{"node1"}, emptied)
+
+	// No spot node matches
+	pod.Spec.NodeSelector = map[string]string{"zone": "c"}
+	moves, emptied = nodeMap.PlanMoves()
+	assert.Empty(t, moves)
+	assert.Empty(t, emptied)
+}
+
+func TestToleratesTaints(t *testing.T) {
+	spot := createTestNode("spot1", 2000)
+	spot.Spec.Taints = []apiv1.Taint{
+		{Key: "spotInstance", Value: "true", Effect: apiv1.TaintEffectNoSchedule},
+		{Key: "node-role.kubernetes.io/spot-worker", Effect: apiv1.TaintEffectPreferNoSchedule},
+	}
+
+	pod := createTestPod("pod1", 100)
+	assert.False(t, ToleratesTaints(pod, spot), "expected the NoSchedule taint not to be tolerated")
+	assert.True(t, ToleratesTaints(pod, createTestNode("spot2", 2000)))
+
+	pod.Spec.Tolerations = []apiv1.Toleration{
+		{Key: "spotInstance", Operator: apiv1.TolerationOpEqual, Value: "true", Effect: apiv1.TaintEffectNoSchedule},
+	}
+	assert.True(t, ToleratesTaints(pod, spot), "expected PreferNoSchedule taints to be ignored")
+
+	spot.Spec.Taints = append(spot.Spec.Taints, apiv1.Taint{Key: "draining", Effect: apiv1.TaintEffectNoExecute})
+	assert.False(t, ToleratesTaints(pod, spot))
+}
+
+func TestPlanMovesTaints(t *testing.T) {
+	tainted := createTestNode("spot1", 2000)
+	tainted.Spec.Taints = []apiv1.Taint{{Key: "spotInstance", Value: "true", Effect: apiv1.TaintEffectNoSchedule}}
+	toleratingPod := createTestPod("p1n1", 500)
+	toleratingPod.Spec.Tolerations = []apiv1.Toleration{{Key: "spotInstance", Operator: apiv1.TolerationOpExists}}
+	pod := createTestPod("p2n1", 300)
+	nodeMap := Map{
+		OnDemand: NodeInfoArray{
+			createTestNodeInfo(createTestNode("node1", 2000), []*apiv1.Pod{toleratingPod, pod}, 800),
+		},
+		Spot: NodeInfoArray{
+			createTestNodeInfo(tainted, []*apiv1.Pod{}, 0),
+			createTestNodeInfo(createTestNode("spot2", 1000), []*apiv1.Pod{}, 0),
+		},
+	}
+
+	moves, emptied := nodeMap.PlanMoves()
+	assert.Equal(t, []PodMove{
+		{Pod: toleratingPod, FromNode: "node1", ToNode: "spot1"},
+		{Pod: pod, FromNode: "node1", ToNode: "spot2"},
+	}, moves)
+	assert.Equal(t, []string{"node1"}, emptied)
+}
+
+func TestFindFit(t *testing.T) {
+	spotNodeInfos := NodeInfoArray{
+		createTestNodeInfo(createTestNode("spot1", 2000), []*apiv1.Pod{}, 1700),
+		createTestNodeInfo(createTestNode("spot2", 2000), []*apiv1.Pod{}, 1000),
+		createTestNodeInfo(createTestNode("spot3", 2000), []*apiv1.Pod{}, 1400),
+	}
+
+	// The pod doesn't fit on spot1 and leaves the least free CPU on spot3
+	pod := createTestPod("pod", 500)
+	nodeInfo, found := spotNodeInfos.FindFit(pod)
+	if assert.True(t, found) {
+		assert.Equal(t, "spot3", nodeInfo.Node.Name)
+	}
+
+	// Nodes the pod can't schedule onto are skipped
+	spotNodeInfos[2].Node.Spec.Taints = []apiv1.Taint{{Key: "dedicated", Value: "batch", Effect: apiv1.TaintEffectNoSchedule}}
+	nodeInfo, found = spotNodeInfos.FindFit(pod)
+	if assert.True(t, found) {
+		assert.Equal(t, "spot2", nodeInfo.Node.Name)
+	}
+
+	// Nothing fits a pod larger than any node's free CPU
+	nodeInfo, found = spotNodeInfos.FindFit(createTestPod("large", 1200))
+	assert.False(t, found)
+	assert.Nil(t, nodeInfo)
+}
+
+func TestIsMovable(t *testing.T) {
+	emptyDirPod := createTestPod("emptyDir", 100)
+	emptyDirPod.Spec.Volumes = []apiv1.Volume{
+		{Name: "scratch", VolumeSource: apiv1.VolumeSource{EmptyDir: &apiv1.EmptyDirVolumeSource{}}},
+	}
+	assert.False(t, IsMovable(emptyDirPod))
+
+	hostPathPod := createTestPod("hostPath", 100)
+	hostPathPod.Spec.Volumes = []apiv1.Volume{
+		{Name: "logs", VolumeSource: apiv1.VolumeSource{HostPath: &apiv1.HostPathVolumeSource{Path: "/var/log"}}},
+	}
+	assert.False(t, IsMovable(hostPathPod))
+
+	pvcPod := createTestPod("pvc", 100)
+	pvcPod.Spec.Volumes = []apiv1.Volume{
+		{Name: "data", VolumeSource: apiv1.VolumeSource{PersistentVolumeClaim: &apiv1.PersistentVolumeClaimVolumeSource{ClaimName: "data"}}},
+	}
+	assert.True(t, IsMovable(pvcPod), "expected a pod with only a PVC to be movable")
+
+	emptyDirPod.Annotations = map[string]string{"cluster-autoscaler.kubernetes.io/safe-to-evict": "true"}
+	assert.True(t, IsMovable(emptyDirPod), "expected a pod annotated safe to evict to be movable")
+}
+
+func TestNewNodeMapLocalStoragePods(t *testing.T) {
+	emptyDirPod := createTestPod("emptyDir", 300)
+	emptyDirPod.Spec.NodeName = "node1"
+	emptyDirPod.Spec.Volumes = []apiv1.Volume{
+		{Name: "scratch", VolumeSource: apiv1.VolumeSource{EmptyDir: &apiv1.EmptyDirVolumeSource{}}},
+	}
+	fakeClient := createFakeClientWithPods(map[string][]apiv1.Pod{
+		"node1": {*emptyDirPod, *createTestPod("p2n1", 200)},
+		"node2": {*createTestPod("p1n2", 600)},
+	})
+	nodes := []*apiv1.Node{
+		createTestNodeWithLabel("node1", 2000, map[string]string{"kubernetes.io/role": "worker"}),
+		createTestNodeWithLabel("node2", 2000, map[string]string{"kubernetes.io/role": "worker"}),
+		createTestNodeWithLabel("node3", 2000, map[string]string{"kubernetes.io/role": "spot-worker"}),
+	}
+
+	// Pods with local storage are only unmovable if configured
+	config := NewConfig()
+	nodeMap, err := NewNodeMap(context.Background(), fakeClient, nodes, config)
+	assert.NoError(t, err)
+	assert.Empty(t, nodeMap[OnDemand][0].UnmovablePods)
+	_, emptied := nodeMap.PlanMoves()
+	assert.Equal(t, []string{"node1", "node2"}, emptied)
+
+	config.ProtectLocalStoragePods = true
+	nodeMap, err = NewNodeMap(context.Background(), fakeClient, nodes, config)
+	assert.NoError(t, err)
+	if assert.Equal(t, 1, len(nodeMap[OnDemand][0].UnmovablePods)) {
+		assert.Equal(t, "emptyDir", nodeMap[OnDemand][0].UnmovablePods[0].Name)
+	}
+	assert.Empty(t, nodeMap[OnDemand][1].UnmovablePods)
+	_, emptied = nodeMap.PlanMoves()
+	assert.Equal(t, []string{"node2"}, emptied, "expected node1 not to be emptied")
+
+	// The unmovable pods follow incremental updates
+	assert.True(t, nodeMap.RemovePod(nodeMap[OnDemand][0].UnmovablePods[0], config))
+	assert.Empty(t, nodeMap[OnDemand][0].UnmovablePods)
+}
+
+func TestIsReschedulingDisabled(t *testing.T) {
+	config := NewConfig()
+	pod := createTestPod("pod", 100)
+	assert.False(t, config.IsReschedulingDisabled(pod), "expected a pod without the annotation to be movable")
+
+	pod.Annotations = map[string]string{"spot-rescheduler.pusher.com/enabled": "true"}
+	assert.False(t, config.IsReschedulingDisabled(pod))
+
+	pod.Annotations["spot-rescheduler.pusher.com/enabled"] = "false"
+	assert.True(t, config.IsReschedulingDisabled(pod))
+
+	// The annotation key is configurable
+	config.ReschedulingAnnotation = "example.com/reschedule"
+	assert.False(t, config.IsReschedulingDisabled(pod))
+	pod.Annotations["example.com/reschedule"] = "false"
+	assert.True(t, config.IsReschedulingDisabled(pod))
+
+	config.ReschedulingAnnotation = ""
+	assert.False(t, config.IsReschedulingDisabled(pod), "expected pods not to opt out without an annotation")
+}
+
+func TestNewNodeMapReschedulingDisabled(t *testing.T) {
+	optedOutPod := createTestPod("optedOut", 300)
+	optedOutPod.Spec.NodeName = "node1"
+	optedOutPod.Annotations = map[string]string{"spot-rescheduler.pusher.com/enabled": "false"}
+	fakeClient := createFakeClientWithPods(map[string][]apiv1.Pod{
+		"node1": {*optedOutPod, *createTestPod("p2n1", 200)},
+	})
+	nodes := []*apiv1.Node{
+		createTestNodeWithLabel("node1", 2000, map[string]string{"kubernetes.io/role": "worker"}),
+		createTestNodeWithLabel("node2", 2000, map[string]string{"kubernetes.io/role": "spot-worker"}),
+	}
+
+	nodeMap, err := NewNodeMap(context.Background(), fakeClient, nodes, NewConfig())
+	assert.NoError(t, err)
+	onDemandNodeInfo := nodeMap[OnDemand][0]
+	assert.Equal(t, int64(500), onDemandNodeInfo.RequestedCPU, "expected the opted out pod to still count")
+	if assert.Equal(t, 1, len(onDemandNodeInfo.UnmovablePods)) {
+		assert.Equal(t, "optedOut", onDemandNodeInfo.UnmovablePods[0].Name)
+	}
+	_, emptied := nodeMap.PlanMoves()
+	assert.Empty(t, emptied, "expected node1 not to be emptied")
+}
+
+func TestApplyDisruptionBudgets(t *testing.T) {
+	replica1 := createTestPod("web-1", 300)
+	replica1.Labels = map[string]string{"app": "web"}
+	replica2 := createTestPod("web-2", 300)
+	replica2.Labels = map[string]string{"app": "web"}
+	otherPod := createTestPod("other", 300)
+	pdb := &policyv1.PodDisruptionBudget{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "web"},
+		Spec: policyv1.PodDisruptionBudgetSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}},
+		},
+		Status: policyv1.PodDisruptionBudgetStatus{DisruptionsAllowed: 0},
+	}
+
+	newMap := func() Map {
+		return Map{
+			OnDemand: NodeInfoArray{
+				createTestNodeInfo(createTestNode("node1", 2000), []*apiv1.Pod{replica1, replica2}, 600),
+				createTestNodeInfo(createTestNode("node2", 2000), []*apiv1.Pod{otherPod}, 300),
+			},
+			Spot: NodeInfoArray{
+				createTestNodeInfo(createTestNode("spot1", 2000), []*apiv1.Pod{}, 0),
+			},
+		}
+	}
+
+	// The budget allows no disruptions, so neither replica can be moved
+	nodeMap := newMap()
+	nodeMap.ApplyDisruptionBudgets([]*policyv1.PodDisruptionBudget{pdb})
+	assert.Equal(t, []*apiv1.Pod{replica1, replica2}, nodeMap[OnDemand][0].UnmovablePods)
+	assert.Empty(t, nodeMap[OnDemand][1].UnmovablePods)
+	_, emptied := nodeMap.PlanMoves()
+	assert.Equal(t, []string{"node2"}, emptied)
+
+	// Allowing one disruption isn't enough to move both replicas together
+	pdb.Status.DisruptionsAllowed = 1
+	assert.Equal(t, []*apiv1.Pod{replica1, replica2}, DisruptionBlockedPods([]*apiv1.Pod{replica1, replica2, otherPod}, []*policyv1.PodDisruptionBudget{pdb}))
+	assert.Empty(t, DisruptionBlockedPods([]*apiv1.Pod{replica1, otherPod}, []*policyv1.PodDisruptionBudget{pdb}))
+
+	pdb.Status.DisruptionsAllowed = 2
+	nodeMap = newMap()
+	nodeMap.ApplyDisruptionBudgets([]*policyv1.PodDisruptionBudget{pdb})
+	assert.Empty(t, nodeMap[OnDemand][0].UnmovablePods)
+}
+
+func TestExtendedResources(t *testing.T) {
+	gpu := apiv1.ResourceName("nvidia.com/gpu")
+	gpuPod := createTestPod("gpu", 500)
+	gpuPod.Spec.NodeName = "node1"
+	gpuPod.Spec.Containers[0].Resources.Requests[gpu] = *resource.NewQuantity(1, resource.DecimalSI)
+	assert.Equal(t, int64(1), DefaultResourceExtractor.Extract(gpuPod)[gpu])
+
+	gpuNode := func(name string, labels map[string]string, gpus int64) *apiv1.Node {
+		node := createTestNodeWithLabel(name, 2000, labels)
+		node.Status.Allocatable[gpu] = *resource.NewQuantity(gpus, resource.DecimalSI)
+		return node
+	}
+	fakeClient := createFakeClientWithPods(map[string][]apiv1.Pod{
+		"node1": {*gpuPod},
+	})
+	config := NewConfig()
+	nodeMap, err := NewNodeMap(context.Background(), fakeClient, []*apiv1.Node{
+		gpuNode("node1", map[string]string{"kubernetes.io/role": "worker"}, 2),
+		createTestNodeWithLabel("node2", 2000, map[string]string{"kubernetes.io/role": "spot-worker"}),
+	}, config)
+	assert.NoError(t, err)
+	onDemandNodeInfo := nodeMap[OnDemand][0]
+	assert.Equal(t, int64(1), onDemandNodeInfo.Requested[gpu])
+	assert.Equal(t, int64(1), onDemandNodeInfo.Free[gpu])
+	assert.Equal(t, int64(500), onDemandNodeInfo.Requested[apiv1.ResourceCPU])
+	assert.Equal(t, onDemandNodeInfo.FreeCPU, onDemandNodeInfo.Free[apiv1.ResourceCPU])
+
+	// The spot node has plenty of CPU but no GPU
+	assert.False(t, nodeMap[Spot][0].Fits(gpuPod))
+	_, emptied := nodeMap.PlanMoves()
+	assert.Empty(t, emptied)
+
+	assert.True(t, nodeMap.AddNode(gpuNode("node3", map[string]string{"kubernetes.io/role": "spot-worker"}, 1), config))
+	moves, _ := nodeMap.PlanMoves()
+	assert.Equal(t, []PodMove{{Pod: gpuPod, FromNode: "node1", ToNode: "node3"}}, moves)
+
+	// Incremental updates keep the resources up to date
+	assert.True(t, nodeMap.RemovePod(gpuPod, config))
+	assert.Equal(t, int64(0), onDemandNodeInfo.Requested[gpu])
+	assert.Equal(t, int64(2), onDemandNodeInfo.Free[gpu])
+}
+
+func TestEphemeralStorage(t *testing.T) {
+	storagePod := createTestPod("storage", 500)
+	storagePod.Spec.NodeName = "node1"
+	storagePod.Spec.Containers[0].Resources.Requests[apiv1.ResourceEphemeralStorage] = resource.MustParse("2Gi")
+	assert.Equal(t, int64(2<<30), DefaultResourceExtractor.Extract(storagePod)[apiv1.ResourceEphemeralStorage])
+
+	storageNode := func(name string, labels map[string]string, storage string) *apiv1.Node {
+		node := createTestNodeWithLabel(name, 2000, labels)
+		node.Status.Allocatable[apiv1.ResourceEphemeralStorage] = resource.MustParse(storage)
+		return node
+	}
+	fakeClient := createFakeClientWithPods(map[string][]apiv1.Pod{
+		"node1": {*storagePod},
+	})
+	config := NewConfig()
+	nodeMap, err := NewNodeMap(context.Background(), fakeClient, []*apiv1.Node{
+		storageNode("node1", map[string]string{"kubernetes.io/role": "worker"}, "10Gi"),
+		storageNode("node2", map[string]string{"kubernetes.io/role": "spot-worker"}, "1Gi"),
+	}, config)
+	assert.NoError(t, err)
+	onDemandNodeInfo := nodeMap[OnDemand][0]
+	assert.Equal(t, int64(2<<30), onDemandNodeInfo.RequestedEphemeralStorage)
+	assert.Equal(t, int64(8<<30), onDemandNodeInfo.FreeEphemeralStorage)
+	copied := nodeMap[OnDemand].CopyNodeInfos()[0]
+	assert.Equal(t, int64(2<<30), copied.RequestedEphemeralStorage)
+	assert.Equal(t, int64(8<<30), copied.FreeEphemeralStorage)
+
+	// The spot node has plenty of CPU but too little ephemeral storage
+	spotNodeInfo := nodeMap[Spot][0]
+	assert.Equal(t, int64(1<<30), spotNodeInfo.FreeEphemeralStorage)
+	assert.False(t, spotNodeInfo.Fits(storagePod))
+	_, found := nodeMap[Spot].FindFit(storagePod)
+	assert.False(t, found)
+	_, emptied := nodeMap.PlanMoves()
+	assert.Empty(t, emptied)
+
+	// Incremental updates keep the ephemeral storage up to date
+	assert.True(t, nodeMap.RemovePod(storagePod, config))
+	assert.Equal(t, int64(0), onDemandNodeInfo.RequestedEphemeralStorage)
+	assert.Equal(t, int64(10<<30), onDemandNodeInfo.FreeEphemeralStorage)
+}
+
+func TestNewNodeMapNamespaces(t *testing.T) {
+	systemPod := createTestPod("system", 300)
+	appPod := createTestPod("app", 200)
+	appPod.Namespace = "app"
+	otherPod := createTestPod("other", 100)
+	otherPod.Namespace = "other"
+	fakeClient := createFakeClientWithPods(map[string][]apiv1.Pod{
+		"node1": {*systemPod, *appPod, *otherPod},
+	})
+	nodes := []*apiv1.Node{createTestNodeWithLabel("node1", 2000, map[string]string{"kubernetes.io/role": "worker"})}
+
+	// Pods of excluded namespaces still count but are unmovable
+	config := NewConfig()
+	config.ExcludedNamespaces = map[string]bool{"kube-system": true}
+	nodeMap, err := NewNodeMap(context.Background(), fakeClient, nodes, config)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(nodeMap[OnDemand][0].Pods))
+	assert.Equal(t, int64(600), nodeMap[OnDemand][0].RequestedCPU)
+	if assert.Equal(t, 1, len(nodeMap[OnDemand][0].UnmovablePods)) {
+		assert.Equal(t, "system", nodeMap[OnDemand][0].UnmovablePods[0].Name)
+	}
+
+	// Pods of namespaces which aren't allowed are left out
+	config = NewConfig()
+	config.AllowedNamespaces = map[string]bool{"app": true}
+	nodeMap, err = NewNodeMap(context.Background(), fakeClient, nodes, config)
+	assert.NoError(t, err)
+	if assert.Equal(t, 1, len(nodeMap[OnDemand][0].Pods)) {
+		assert.Equal(t, "app", nodeMap[OnDemand][0].Pods[0].Name)
+	}
+	assert.Equal(t, int64(200), nodeMap[OnDemand][0].RequestedCPU)
+	assert.Empty(t, nodeMap[OnDemand][0].UnmovablePods)
 }
 
 func createTestPod(name string, cpu int64) *apiv1.Pod {
@@ -384,6 +1803,16 @@ func createTestNodeInfo(node *apiv1.Node, pods []*apiv1.Pod, requests int64) *No
 	return nodeInfo
 }
 
+// Returns a fake client listing the given pods on each node.
+func createFakeClientWithPods(pods map[string][]apiv1.Pod) *fake.Clientset {
+	fakeClient := &fake.Clientset{}
+	fakeClient.Fake.AddReactor("list", "pods", func(action core.Action) (bool, runtime.Object, error) {
+		nodeName := strings.TrimPrefix(action.(core.ListAction).GetListRestrictions().Fields.String(), "spec.nodeName=")
+		return true, &apiv1.PodList{Items: pods[nodeName]}, nil
+	})
+	return fakeClient
+}
+
 func createFakeClient(t *testing.T) *fake.Clientset {
 	pods1 := []apiv1.Pod{
 		*createTestPod("p1n1", 100),
@@ -421,6 +1850,16 @@ func createFakeClient(t *testing.T) *fake.Clientset {
 		*createTestPod("p5n6", 300),
 	}
 
+	unreadyPod := createTestPod("p2n7", 700)
+	unreadyPod.Status.Phase = apiv1.PodPending
+	unreadyPod.Status.Conditions = []apiv1.PodCondition{
+		{Type: apiv1.PodReady, Status: apiv1.ConditionFalse},
+	}
+	pods7 := []apiv1.Pod{
+		*createTestPod("p1n7", 300),
+		*unreadyPod,
+	}
+
 	fakeClient := &fake.Clientset{}
 	fakeClient.Fake.AddReactor("list", "pods", func(action core.Action) (bool, runtime.Object, error) {
 		listAction, ok := action.(core.ListAction)
@@ -441,6 +1880,8 @@ func createFakeClient(t *testing.T) *fake.Clientset {
 			podList.Items = pods5
 		case "spec.nodeName=node6":
 			podList.Items = pods6
+		case "spec.nodeName=node7":
+			podList.Items = pods7
 		default:
 			t.Fatalf("unexpected list restrictions: %v", restrictions)
 		}
@@ -17,30 +17,48 @@ limitations under the License.
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	goflag "flag"
 	"fmt"
+	"io/ioutil"
+	"math"
 	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/pusher/k8s-spot-rescheduler/metrics"
 	"github.com/pusher/k8s-spot-rescheduler/nodes"
 	"github.com/pusher/k8s-spot-rescheduler/scaler"
+	authorizationv1 "k8s.io/api/authorization/v1"
 	apiv1 "k8s.io/api/core/v1"
 	policyv1 "k8s.io/api/policy/v1beta1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/clock"
 	simulator "k8s.io/autoscaler/cluster-autoscaler/simulator"
 	autoscaler_drain "k8s.io/autoscaler/cluster-autoscaler/utils/drain"
 	kube_utils "k8s.io/autoscaler/cluster-autoscaler/utils/kubernetes"
+	"k8s.io/client-go/informers"
 	kube_client "k8s.io/client-go/kubernetes"
 	v1core "k8s.io/client-go/kubernetes/typed/core/v1"
+	v1lister "k8s.io/client-go/listers/core/v1"
 	kube_restclient "k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
 	kube_record "k8s.io/client-go/tools/record"
 
 	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	flag "github.com/spf13/pflag"
 )
@@ -50,6 +68,10 @@ var (
 		`rescheduler: rescheduler --running-in-cluster=true`,
 		flag.ExitOnError)
 
+	preflight = flags.Bool("preflight", true,
+		`Check on startup that the rescheduler has all the permissions it needs,
+		 rather than failing part way through a housekeeping pass.`)
+
 	inCluster = flags.Bool("running-in-cluster", true,
 		`Optional, if this controller is running in a kubernetes cluster, use the
 		 pod secrets for creating a Kubernetes client.`)
@@ -63,9 +85,165 @@ var (
 	housekeepingInterval = flags.Duration("housekeeping-interval", 10*time.Second,
 		`How often rescheduler takes actions.`)
 
+	eventDebounce = flags.Duration("event-debounce", 0,
+		`Also run a housekeeping pass when nodes or pods change, once no change
+		 has been seen for this long so that bursts of changes only cause one
+		 pass. A steady stream of changes still runs a pass at least every
+		 housekeeping-interval. Passes only run every housekeeping-interval
+		 when 0.`)
+
+	loopDeadline = flags.Duration("loop-deadline", 0,
+		`How long a single housekeeping pass may run for before its remaining
+		 work is aborted. Passes are not limited when 0.`)
+
+	drainedNodeLabel = flags.String("drained-node-label", "",
+		`Label to add to on-demand nodes once they have been fully drained, in the
+		 form <label_name>=<label_value>, so that they can be removed. No label
+		 is added when empty.`)
+
+	drainedNodeAnnotation = flags.String("drained-node-annotation", "",
+		`Annotation to add to on-demand nodes once they have been fully drained,
+		 in the form <annotation_name>=<annotation_value>. No annotation is added
+		 when empty.`)
+
+	cordonedTargetPolicy = flags.String("cordoned-target-policy", cordonedTargetIgnore,
+		`What to do when the spot node a pod was planned onto has been cordoned
+		 by the time the pod is evicted, either 'ignore', 'reselect' or 'abort'.`)
+
+	doNotDrainBeforeAnnotation = flags.String("do-not-drain-before-annotation", "spot-rescheduler.pusher.com/do-not-drain-before",
+		`Annotation holding an RFC3339 timestamp before which a node is not
+		 drained. Nodes are never deferred when empty.`)
+
+	drainWebhookURL = flags.String("drain-webhook-url", "",
+		`URL a JSON notification naming the node and the pods moved off it is
+		 posted to each time an on-demand node is fully drained. No notification
+		 is sent when empty.`)
+
+	drainWebhookTimeout = flags.Duration("drain-webhook-timeout", 10*time.Second,
+		`How long to wait for the drain webhook to respond before giving up on
+		 the notification.`)
+
+	allUnmovableReasons = flags.Bool("all-unmovable-reasons", false,
+		`Check and report every reason a pod can't be moved, rather than only
+		 the first one found.`)
+
+	moveEvents = flags.Bool("move-events", false,
+		`Record an Event on each pod moved, detailing the nodes it was moved
+		 between and the resources it requests, as a durable audit record.`)
+
+	directionFile = flags.String("direction-file", "",
+		`Path of a file read every housekeeping pass which says which nodes pods
+		 are moved onto, either 'spot' or 'on-demand'. Pods are always moved onto
+		 spot nodes when empty.`)
+
+	minOnDemandNodeBuffer = flags.Int("min-on-demand-nodes", 0,
+		`Number of on-demand nodes running pods to keep as a buffer against spot
+		 nodes being reclaimed, even if their pods could move onto spot nodes.`)
+
+	maxEvictionsPerNodePerRun = flags.Int("max-evictions-per-node-per-run", 0,
+		`Maximum number of pods evicted from an on-demand node in a single
+		 housekeeping pass, the rest are moved in later passes. Pods are not
+		 limited when 0.`)
+
+	maxDrainsPerRun = flags.Int("max-drains-per-run", 1,
+		`Maximum number of on-demand nodes drained in a single housekeeping pass.`)
+
+	optimizeDrains = flags.Bool("optimize-drains", false,
+		`Search for the combination of on-demand nodes, up to
+		 --max-drains-per-run, that empties the most nodes instead of draining
+		 them in order while their pods fit.`)
+
+	usageBasedPacking = flags.Bool("usage-based-packing", false,
+		`Pack pods onto nodes by the usage reported by metrics-server, scaled by
+		 --usage-headroom, instead of by their requests. Pods without reported
+		 usage are packed by their requests.`)
+
+	usageHeadroom = flags.Float64("usage-headroom", 1.2,
+		`Factor the observed usage of pods is multiplied by when packing by
+		 usage.`)
+
+	respectResourceQuotas = flags.Bool("respect-resource-quotas", false,
+		`Only move as many pods of a namespace at once as fit in the headroom of
+		 its ResourceQuotas, since evicted pods are still counted against the
+		 quota while their replacements are created. The rest are moved in later
+		 passes.`)
+
+	evictionFailureThreshold = flags.Int("eviction-failure-threshold", 0,
+		`Number of evictions failing in a row after which evictions are paused
+		 for --eviction-failure-cooldown. Evictions are never paused when 0.`)
+
+	evictionFailureCooldown = flags.Duration("eviction-failure-cooldown", 10*time.Minute,
+		`How long evictions are paused for once --eviction-failure-threshold
+		 evictions in a row have failed.`)
+
 	nodeDrainDelay = flags.Duration("node-drain-delay", 10*time.Minute,
 		`How long the scheduler should wait between draining nodes.`)
 
+	replicaEvictionDelay = flags.Duration("replica-eviction-delay", 0,
+		`How long to wait after evicting a pod before evicting the next pod with
+		 the same controller, similar to minReadySeconds. Pods are evicted all at
+		 once when 0.`)
+
+	orderStatefulSetEvictions = flags.Bool("order-statefulset-evictions", false,
+		`Evict the pods of a StatefulSet one at a time in reverse ordinal order,
+		 waiting for each pod to be deleted before evicting the next.`)
+
+	skipCrashLoopingPods = flags.Bool("skip-crash-looping-pods", false,
+		`Treat pods in CrashLoopBackOff as unmovable, so the nodes they run on
+		 aren't drained.`)
+
+	protectLastReadyReplica = flags.Bool("protect-last-ready-replica", false,
+		`Treat pods which are the only Ready replica of their controller as
+		 unmovable, even if no PodDisruptionBudget covers them.`)
+
+	minPodAge = flags.Duration("min-pod-age", 0,
+		`Minimum time since a pod started, or was created if it hasn't started,
+		 before it is moved. Nodes running younger pods aren't drained. Pods of
+		 any age are moved when 0.`)
+
+	deprioritizePreferNoSchedule = flags.Bool("deprioritize-prefer-no-schedule", false,
+		`Consider on-demand nodes with a PreferNoSchedule taint their pods don't
+		 tolerate for draining only after all other nodes.`)
+
+	pendingPodSpec = flags.String("pending-pod-spec", "",
+		`Path to a JSON pod manifest. Rather than draining nodes, move the
+		 fewest pods off an on-demand node onto spot nodes to make room for the
+		 pod there.`)
+
+	utilizationPrecision = flags.Float64("utilization-precision", 1,
+		`Precision, in percentage points, node CPU utilization is rounded to
+		 when exported as a metric, e.g. 1 for whole percents. Decisions always
+		 use the unrounded utilization. Not rounded when 0.`)
+
+	maxPodsPerSpotNode = flags.Int("max-pods-per-spot-node", 0,
+		`Most pods a spot node may host once pods are moved onto it, to avoid
+		 noisy neighbours on densely packed nodes. Unlimited when 0.`)
+
+	restrictedRuntimeClasses = flags.StringArray("restricted-runtime-class", []string{},
+		`Runtime class whose pods are only moved onto spot nodes labelled
+		 runtime.spot-rescheduler.pusher.com/<runtime_class_name>. May be
+		 repeated.`)
+
+	spreadReplicas = flags.Bool("spread-replicas", false,
+		`Place pods of the same controller on distinct spot nodes where they fit,
+		 rather than packing them onto the fullest spot node, to avoid
+		 correlated failures.`)
+
+	moveCooldown = flags.Duration("move-cooldown", 0,
+		`How long after moving a pod the rescheduler won't move a pod with the
+		 same name again, or a pod of the same controller created since, to
+		 avoid pods flapping between nodes. Pods may be moved again straight
+		 away when 0.`)
+
+	nodeMapMaxAge = flags.Duration("node-map-max-age", 0,
+		`How long the map of nodes and their pods may be reused between passes
+		 before it is rebuilt from the API. The map is rebuilt as soon as a node
+		 or pod changes, and on every pass when 0.`)
+
+	warmUpPeriod = flags.Duration("warm-up-period", 0,
+		`How long after startup the rescheduler should only observe the cluster
+		 before it starts draining nodes.`)
+
 	podEvictionTimeout = flags.Duration("pod-eviction-timeout", 2*time.Minute,
 		`How long should the rescheduler attempt to retrieve successful pod
 		 evictions for.`)
@@ -77,6 +255,10 @@ var (
 	listenAddress = flags.String("listen-address", "localhost:9235",
 		`Address to listen on for serving prometheus metrics`)
 
+	moveHistorySize = flags.Int("move-history-size", 100,
+		`Number of the most recent pod moves served as JSON on /moves at the
+		 listen address. No history is kept when 0.`)
+
 	home = homeDir()
 
 	kubeconfig = flags.String("kubeconfig", filepath.Join(home, ".kube", "config"), "(optional) absolute path to the kubeconfig file")
@@ -84,6 +266,17 @@ var (
 	deleteNonReplicatedPods = flags.Bool("delete-non-replicated-pods", false, `Delete non-replicated pods running on on-demand instance. Note that some non-replicated pods will not be rescheduled.`)
 
 	showVersion = flags.Bool("version", false, "Show version information and exit.")
+
+	hypotheticalSpotNode = flags.StringToString("hypothetical-spot-node", map[string]string{},
+		`Optional, allocatable resources of an additional spot node, eg.
+		 cpu=4,memory=16Gi. Each pass logs how many more on-demand nodes could be
+		 drained if such a node were added.`)
+
+	scope = flags.String("scope", "",
+		`Optional, name of the set of nodes this rescheduler manages. Allows
+		 several reschedulers to run independently within one cluster. The
+		 scope prefixes the name of every metric and the component events are
+		 reported as.`)
 )
 
 func main() {
@@ -95,18 +288,79 @@ func main() {
 	flags.Set("logtostderr", "true")
 
 	// Add nodes labels as flags
-	flags.StringVar(&nodes.OnDemandNodeLabel,
+	nodeConfig := nodes.NewConfig()
+	flags.StringArrayVar(&nodeConfig.OnDemandNodeLabels,
 		"on-demand-node-label",
-		"kubernetes.io/role=worker",
-		`Name of label on nodes to be considered for draining.`)
-	flags.StringVar(&nodes.SpotNodeLabel,
+		nodeConfig.OnDemandNodeLabels,
+		`Label selector for nodes to be considered for draining, such as
+		 'kubernetes.io/role in (worker, on-demand)'. May be repeated, labels
+		 are tried in order and the first is the one reported in metrics.`)
+	flags.StringArrayVar(&nodeConfig.SpotNodeLabels,
 		"spot-node-label",
-		"kubernetes.io/role=spot-worker",
-		`Name of label on nodes to be considered as targets for pods.`)
+		nodeConfig.SpotNodeLabels,
+		`Label selector for nodes to be considered as targets for pods. May be
+		 repeated, labels are tried in order and the first is the one reported in
+		 metrics.`)
 
-	flags.IntVar(&nodes.PriorityThreshold, "priority-threshold", 0,
+	flags.IntVar(&nodeConfig.PriorityThreshold, "priority-threshold", 0,
 		`Lowest priority to consider while evaluating spot nodes`)
 
+	onDemandPriorityThreshold := flags.Int("on-demand-priority-threshold", 0,
+		`Lowest priority to consider while evaluating on-demand nodes, lower
+		 priority pods don't keep them from being drained. All pods are
+		 considered when not set.`)
+
+	flags.BoolVar(&nodeConfig.DetectProviderLabels, "detect-provider-labels", false,
+		`Classify nodes matching neither node label by the capacity type labels
+		 of well-known cloud providers and provisioners, such as
+		 karpenter.sh/capacity-type.`)
+
+	resourceBasis := flags.String("resource-basis", "requests",
+		`Which of their containers' resources to account for pods by, either
+		 'requests', 'limits' or 'max-of-requests-limits'.`)
+
+	spotSortMode := flags.String("spot-node-sort", "requested-cpu",
+		`Order to pack pods onto spot nodes in, either 'requested-cpu' for the
+		 most requested CPU first or 'cpu-ratio' for the highest ratio of
+		 requested to allocatable CPU first.`)
+
+	defaultNodeType := flags.String("default-node-type", "ignore",
+		`How to treat nodes matching neither node label, either 'ignore' or
+		 'on-demand'.`)
+
+	flags.BoolVar(&nodeConfig.IgnoreTerminatingPods, "ignore-terminating-pods", false,
+		`Leave pods which are being deleted out of the requested resources of
+		 their nodes, as if they had already gone.`)
+
+	flags.BoolVar(&nodeConfig.ProtectLocalStoragePods, "protect-local-storage-pods", false,
+		`Treat pods with emptyDir or hostPath volumes as unmovable, unless
+		 annotated cluster-autoscaler.kubernetes.io/safe-to-evict=true.`)
+
+	excludedNamespaces := flags.StringArray("excluded-namespace", []string{},
+		`Namespace whose pods are never moved, though they still count against
+		 their nodes' resources. May be repeated.`)
+
+	flags.StringVar(&nodeConfig.ReschedulingAnnotation, "rescheduling-annotation", nodes.DefaultReschedulingAnnotation,
+		`Annotation which, set to "false" on a pod, opts it out of being moved,
+		 though it still counts against its node's resources. Pods can't opt
+		 out when empty.`)
+
+	allowedNamespaces := flags.StringArray("allowed-namespace", []string{},
+		`Namespace whose pods are considered, the pods of other namespaces are
+		 left out entirely. May be repeated, all namespaces are considered when
+		 not set.`)
+
+	flags.BoolVar(&nodeConfig.IncludeUnavailableNodes, "include-unavailable-nodes", false,
+		`Consider cordoned and NotReady nodes, both for draining and as targets
+		 for pods.`)
+
+	flags.IntVar(&nodeConfig.Concurrency, "node-map-concurrency", nodes.DefaultConcurrency,
+		`How many nodes to list the pods of at once while building the node map.`)
+
+	nodeTypeOverrides := flags.StringToString("node-type-override", map[string]string{},
+		`Type to treat nodes as by name regardless of their labels, in the form
+		 <node_name>=<spot|on-demand>. May be repeated or comma separated.`)
+
 	flags.Parse(os.Args)
 
 	if *showVersion {
@@ -114,17 +368,75 @@ func main() {
 		os.Exit(0)
 	}
 
-	err := validateArgs(nodes.OnDemandNodeLabel, nodes.SpotNodeLabel)
+	err := nodeConfig.Validate()
+	if err != nil {
+		fmt.Printf("Error: %s", err)
+		os.Exit(1)
+	}
+
+	nodeConfig.DefaultNodeType, err = nodes.ParseNodeType(*defaultNodeType)
+	if err != nil {
+		fmt.Printf("Error: %s", err)
+		os.Exit(1)
+	}
+
+	basis, err := nodes.ParseResourceBasis(*resourceBasis)
+	if err != nil {
+		fmt.Printf("Error: %s", err)
+		os.Exit(1)
+	}
+	nodeConfig.ResourceExtractor = nodes.NewResourceExtractor(basis)
+
+	nodeConfig.SpotSortMode, err = nodes.ParseSortMode(*spotSortMode)
+	if err != nil {
+		fmt.Printf("Error: %s", err)
+		os.Exit(1)
+	}
+
+	nodeConfig.NodeTypeOverrides, err = nodes.ParseNodeTypeOverrides(*nodeTypeOverrides)
+	if err != nil {
+		fmt.Printf("Error: %s", err)
+		os.Exit(1)
+	}
+
+	if flags.Changed("on-demand-priority-threshold") {
+		nodeConfig.OnDemandPriorityThreshold = onDemandPriorityThreshold
+	}
+
+	nodeConfig.ExcludedNamespaces = toSet(*excludedNamespaces)
+	nodeConfig.AllowedNamespaces = toSet(*allowedNamespaces)
+
+	err = validateCordonedTargetPolicy(*cordonedTargetPolicy)
+	if err != nil {
+		fmt.Printf("Error: %s", err)
+		os.Exit(1)
+	}
+
+	hypotheticalSpotNodeAllocatable, err := parseResourceList(*hypotheticalSpotNode)
 	if err != nil {
 		fmt.Printf("Error: %s", err)
 		os.Exit(1)
 	}
 
+	var pendingPod *apiv1.Pod
+	if *pendingPodSpec != "" {
+		pendingPod, err = loadPod(*pendingPodSpec)
+		if err != nil {
+			fmt.Printf("Error: %s", err)
+			os.Exit(1)
+		}
+	}
+
 	glog.Infof("Running Rescheduler")
 
+	metricsRecorder := metrics.NewRecorder(*scope, prometheus.DefaultRegisterer)
+
+	history := newMoveHistory(*moveHistorySize)
+
 	// Register metrics from metrics.go
 	go func() {
 		http.Handle("/metrics", promhttp.Handler())
+		http.Handle("/moves", history)
 		err := http.ListenAndServe(*listenAddress, nil)
 		glog.Fatalf("Failed to start metrics: %v", err)
 	}()
@@ -134,14 +446,20 @@ func main() {
 		glog.Fatalf("Failed to create kube client: %v", err)
 	}
 
-	recorder := createEventRecorder(kubeClient)
+	if *preflight {
+		if err := checkPermissions(context.Background(), kubeClient, requiredPermissions()); err != nil {
+			glog.Fatalf("Preflight check failed: %v", err)
+		}
+	}
+
+	recorder := createEventRecorder(kubeClient, componentName(*scope))
 
 	// This is where the leader election used to be
 
-	run(kubeClient, recorder)
+	run(kubeClient, recorder, metricsRecorder, nodeConfig, hypotheticalSpotNodeAllocatable, pendingPod, history)
 }
 
-func run(kubeClient kube_client.Interface, recorder kube_record.EventRecorder) {
+func run(kubeClient kube_client.Interface, recorder kube_record.EventRecorder, metricsRecorder *metrics.Recorder, nodeConfig *nodes.Config, hypotheticalSpotNode apiv1.ResourceList, pendingPod *apiv1.Pod, history *moveHistory) {
 
 	stopChannel := make(chan struct{})
 
@@ -151,267 +469,2701 @@ func run(kubeClient kube_client.Interface, recorder kube_record.EventRecorder) {
 		glog.Fatalf("Failed to create predicate checker: %v", err)
 	}
 
-	nodeLister := kube_utils.NewReadyNodeLister(kubeClient, stopChannel)
-	podDisruptionBudgetLister := kube_utils.NewPodDisruptionBudgetLister(kubeClient, stopChannel)
-	unschedulablePodLister := kube_utils.NewUnschedulablePodLister(kubeClient, stopChannel)
+	// Shared informers for nodes and pods, the rescheduler will not act until
+	// they have synced.
+	informerFactory := informers.NewSharedInformerFactory(kubeClient, 0)
+	nodeInformer := informerFactory.Core().V1().Nodes().Informer()
+	podInformer := informerFactory.Core().V1().Pods()
+	cachesSynced := []cache.InformerSynced{
+		nodeInformer.HasSynced,
+		podInformer.Informer().HasSynced,
+	}
+	var quotaLister resourceQuotaLister
+	if *respectResourceQuotas {
+		quotaInformer := informerFactory.Core().V1().ResourceQuotas()
+		quotaLister = informerResourceQuotaLister{quotaInformer.Lister()}
+		cachesSynced = append(cachesSynced, quotaInformer.Informer().HasSynced)
+	}
+	informerFactory.Start(stopChannel)
+
+	r := &rescheduler{
+		kubeClient:                kubeClient,
+		recorder:                  recorder,
+		metrics:                   metricsRecorder,
+		predicateChecker:          predicateChecker,
+		nodeConfig:                nodeConfig,
+		nodeLister:                kube_utils.NewReadyNodeLister(kubeClient, stopChannel),
+		podDisruptionBudgetLister: kube_utils.NewPodDisruptionBudgetLister(kubeClient, stopChannel),
+		unschedulablePodLister:    kube_utils.NewUnschedulablePodLister(kubeClient, stopChannel),
+		allPodLister:              podInformer.Lister(),
+		resourceQuotaLister:       quotaLister,
+		cachesSynced:              cachesSynced,
+		warmUpUntil:               time.Now().Add(*warmUpPeriod),
+		hypotheticalSpotNode:      hypotheticalSpotNode,
+		pendingPod:                pendingPod,
+		skipCrashLoopingPods:      *skipCrashLoopingPods,
+		protectLastReadyReplica:   *protectLastReadyReplica,
+		minPodAge:                 *minPodAge,
+		spreadReplicas:            *spreadReplicas,
+		avoidPreferNoSchedule:     *deprioritizePreferNoSchedule,
+		restrictedRuntimeClasses:  toSet(*restrictedRuntimeClasses),
+		maxPodsPerSpotNode:        *maxPodsPerSpotNode,
+		drainedNodeLabel:          *drainedNodeLabel,
+		drainedNodeAnnotation:     *drainedNodeAnnotation,
+		drainWebhookURL:           *drainWebhookURL,
+		drainWebhookClient:        &http.Client{Timeout: *drainWebhookTimeout},
+		moveEvents:                *moveEvents,
+		allUnmovableReasons:       *allUnmovableReasons,
+		notBeforeAnnotation:       *doNotDrainBeforeAnnotation,
+		cordonedTargetPolicy:      *cordonedTargetPolicy,
+		maxEvictionsPerNodePerRun: *maxEvictionsPerNodePerRun,
+		respectResourceQuotas:     *respectResourceQuotas,
+		maxDrainsPerRun:           *maxDrainsPerRun,
+		usageHeadroom:             *usageHeadroom,
+		optimizeDrains:            *optimizeDrains,
+		minOnDemandNodes:          *minOnDemandNodeBuffer,
+		decideDirection:           fileDirectionDecider(*directionFile),
+		nodeMapCache: nodeMapCache{
+			maxAge: *nodeMapMaxAge,
+		},
+		recentMoves: recentMoves{
+			cooldown: *moveCooldown,
+		},
+		moveHistory: history,
+		evictionBreaker: evictionBreaker{
+			threshold: *evictionFailureThreshold,
+			cooldown:  *evictionFailureCooldown,
+		},
+		// Set nextDrainTime to now to ensure we start processing straight away.
+		nextDrainTime: time.Now(),
+	}
+
+	if *usageBasedPacking {
+		r.usageSource = metricsServerUsageSource{kubeClient}
+	}
+
+	// A cached node map would miss the pods and nodes changing since it was
+	// built, so any change has it rebuilt on the next pass.
+	if *nodeMapMaxAge > 0 {
+		nodeInformer.AddEventHandler(r.nodeMapCache.invalidateOnChange())
+		podInformer.Informer().AddEventHandler(r.nodeMapCache.invalidateOnChange())
+	}
+
+	glog.V(2).Info("Waiting for caches to sync.")
+	if !cache.WaitForCacheSync(stopChannel, cachesSynced...) {
+		glog.Fatalf("Failed to sync caches")
+	}
+
+	reconcile := func() {
+		ctx, cancel := loopContext(*loopDeadline)
+		r.Reconcile(ctx)
+		cancel()
+	}
 
-	// Set nextDrainTime to now to ensure we start processing straight away.
-	nextDrainTime := time.Now()
+	// When debouncing, every pass goes through the debouncer so that passes
+	// never overlap. A steady stream of events still lets a pass run at least
+	// once per housekeeping interval.
+	var d *debouncer
+	if *eventDebounce > 0 {
+		d = newDebouncer(clock.RealClock{}, *eventDebounce, *housekeepingInterval)
+		handler := cache.ResourceEventHandlerFuncs{
+			AddFunc:    func(interface{}) { d.Trigger() },
+			UpdateFunc: func(interface{}, interface{}) { d.Trigger() },
+			DeleteFunc: func(interface{}) { d.Trigger() },
+		}
+		nodeInformer.AddEventHandler(handler)
+		podInformer.Informer().AddEventHandler(handler)
+		go d.Run(stopChannel, reconcile)
+	}
 
 	for {
 		select {
 		// Run forever, every housekeepingInterval seconds
 		case <-time.After(*housekeepingInterval):
-			{
-				// Don't do anything if we are waiting for the drain delay timer
-				if time.Until(nextDrainTime) > 0 {
-					glog.V(2).Infof("Waiting %s for drain delay timer.", time.Until(nextDrainTime).Round(time.Second))
-					continue
-				}
+			if d != nil {
+				d.Trigger()
+			} else {
+				reconcile()
+			}
+		}
+	}
+}
 
-				// Don't run if pods are unschedulable.
-				// Attempt to not make things worse.
-				unschedulablePods, err := unschedulablePodLister.List()
-				if err != nil {
-					glog.Errorf("Failed to get unschedulable pods: %v", err)
-				}
-				if len(unschedulablePods) > 0 {
-					glog.V(2).Info("Waiting for unschedulable pods to be scheduled.")
-					continue
-				}
+// debouncer coalesces bursts of triggers, running a function once no trigger
+// has arrived for a quiet period, or once the first trigger of a burst has
+// waited for the maximum wait, whichever comes first.
+type debouncer struct {
+	clock    clock.Clock
+	quiet    time.Duration
+	maxWait  time.Duration
+	triggers chan struct{}
+}
 
-				glog.V(3).Info("Starting node processing.")
+// newDebouncer returns a debouncer timed by the clock, waiting for the given
+// quiet period but never longer than maxWait after the first trigger of a
+// burst.
+func newDebouncer(debounceClock clock.Clock, quiet, maxWait time.Duration) *debouncer {
+	return &debouncer{
+		clock:    debounceClock,
+		quiet:    quiet,
+		maxWait:  maxWait,
+		triggers: make(chan struct{}, 1),
+	}
+}
 
-				// Get all nodes in the cluster
-				allNodes, err := nodeLister.List()
-				if err != nil {
-					glog.Errorf("Failed to list nodes: %v", err)
-					continue
-				}
+// Trigger asks for the function to be run once things have quietened down.
+// It never blocks.
+func (d *debouncer) Trigger() {
+	select {
+	case d.triggers <- struct{}{}:
+	default:
+	}
+}
 
-				// Build a map of nodeInfo structs.
-				// NodeInfo is used to map pods onto nodes and see their available
-				// resources.
-				nodeMap, err := nodes.NewNodeMap(kubeClient, allNodes)
-				if err != nil {
-					glog.Errorf("Failed to build node map; %v", err)
-					continue
-				}
+// Run runs fn after each burst of triggers until stop is closed. Triggers
+// arriving while fn runs cause it to run again afterwards. A steady stream of
+// triggers still runs fn at least once every maxWait.
+func (d *debouncer) Run(stop <-chan struct{}, fn func()) {
+	var quiet clock.Timer
+	var deadline time.Time
+	var fire <-chan time.Time
+	for {
+		select {
+		case <-stop:
+			if quiet != nil {
+				quiet.Stop()
+			}
+			return
+		case <-d.triggers:
+			if fire == nil {
+				deadline = d.clock.Now().Add(d.maxWait)
+			}
+			wait := d.quiet
+			if remaining := deadline.Sub(d.clock.Now()); remaining < wait {
+				wait = remaining
+			}
+			if quiet != nil {
+				quiet.Stop()
+			}
+			quiet = d.clock.NewTimer(wait)
+			fire = quiet.C()
+		case <-fire:
+			quiet = nil
+			fire = nil
+			fn()
+		}
+	}
+}
 
-				// Update metrics.
-				metrics.UpdateNodesMap(nodeMap)
+// Returns the context a single housekeeping pass runs in, limited to the
+// deadline unless it is 0.
+func loopContext(deadline time.Duration) (context.Context, context.CancelFunc) {
+	if deadline <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), deadline)
+}
 
-				// Get PodDisruptionBudgets
-				allPDBs, err := podDisruptionBudgetLister.List()
-				if err != nil {
-					glog.Errorf("Failed to list PDBs: %v", err)
-					continue
-				}
+// nodeLister lists the nodes the rescheduler should consider.
+type nodeLister interface {
+	List() ([]*apiv1.Node, error)
+}
 
-				// Get onDemand and spot nodeInfoArrays
-				// These are sorted when the nodeMap is created.
-				onDemandNodeInfos := nodeMap[nodes.OnDemand]
-				spotNodeInfos := nodeMap[nodes.Spot]
-				spotSnapshot := spotNodeInfos.GetClusterSnapshot()
+// podLister lists pods matching some predefined criteria.
+type podLister interface {
+	List() ([]*apiv1.Pod, error)
+}
 
-				// Update spot node metrics
-				updateSpotNodeMetrics(spotNodeInfos, allPDBs)
+// podDisruptionBudgetLister lists the PodDisruptionBudgets in the cluster.
+type podDisruptionBudgetLister interface {
+	List() ([]*policyv1.PodDisruptionBudget, error)
+}
 
-				// No on demand nodes so nothing to do.
-				if len(onDemandNodeInfos) < 1 {
-					glog.V(2).Info("No nodes to process.")
-				}
+// resourceQuotaLister lists the ResourceQuotas in the cluster.
+type resourceQuotaLister interface {
+	List() ([]*apiv1.ResourceQuota, error)
+}
 
-				// Go through each onDemand node in turn
-				// Build a plan to move pods onto other nodes
-				// In the case that all can be moved, drain the node
-				for _, nodeInfo := range onDemandNodeInfos {
+// informerResourceQuotaLister lists ResourceQuotas from a shared informer.
+type informerResourceQuotaLister struct {
+	lister v1lister.ResourceQuotaLister
+}
 
-					// Get a list of pods that we would need to move onto other nodes
-					allPods, blockingPod, err := autoscaler_drain.GetPodsForDeletionOnNodeDrain(nodeInfo.Pods, allPDBs, *deleteNonReplicatedPods, false, false, nil, 0, time.Now())
-					if blockingPod != nil {
-						glog.Infof("BlockingPod: %v", err)
-					}
-					if err != nil {
-						glog.Errorf("Failed to get pods for consideration: %v", err)
-						continue
-					}
+func (l informerResourceQuotaLister) List() ([]*apiv1.ResourceQuota, error) {
+	return l.lister.List(labels.Everything())
+}
 
-					podsForDeletion := make([]*apiv1.Pod, 0)
-					for _, pod := range allPods {
-						controlledByDaemonSet := false
-						for _, owner := range pod.GetOwnerReferences() {
-							if *owner.Controller && owner.Kind == "DaemonSet" {
-								controlledByDaemonSet = true
-								break
-							}
-						}
-
-						if controlledByDaemonSet {
-							glog.V(4).Infof("Ignoring pod %s which is controlled by DaemonSet", podID(pod))
-							continue
-						}
-
-						podsForDeletion = append(podsForDeletion, pod)
-					}
+// rescheduler holds the clients, listers and state shared between
+// housekeeping passes.
+type rescheduler struct {
+	kubeClient                kube_client.Interface
+	recorder                  kube_record.EventRecorder
+	metrics                   *metrics.Recorder
+	predicateChecker          simulator.PredicateChecker
+	nodeConfig                *nodes.Config
+	nodeLister                nodeLister
+	podDisruptionBudgetLister podDisruptionBudgetLister
+	unschedulablePodLister    podLister
+	// allPodLister lists the pods the node map is built from. The pods on
+	// each node are listed from the API server instead when nil.
+	allPodLister v1lister.PodLister
+	// resourceQuotaLister is only set when respecting resource quotas.
+	resourceQuotaLister resourceQuotaLister
+
+	// cachesSynced report whether the informers backing the rescheduler have
+	// synced. No node is drained until they all have.
+	cachesSynced []cache.InformerSynced
+	// warmUpUntil is the time until which the rescheduler only observes the
+	// cluster and does not drain any node.
+	warmUpUntil time.Time
+	// skipCrashLoopingPods treats pods in CrashLoopBackOff as unmovable.
+	skipCrashLoopingPods bool
+	// protectLastReadyReplica treats the only Ready replica of a controller
+	// as unmovable.
+	protectLastReadyReplica bool
+	// minPodAge treats pods that started more recently as unmovable, 0 for no
+	// minimum.
+	minPodAge time.Duration
+	// spreadReplicas places pods of the same controller on distinct spot nodes
+	// where they fit.
+	spreadReplicas bool
+	// avoidPreferNoSchedule considers on-demand nodes with a
+	// PreferNoSchedule taint their pods don't tolerate last.
+	avoidPreferNoSchedule bool
+	// pendingPod, if set, is the pod pods are moved off an on-demand node to
+	// make room for, rather than draining nodes.
+	pendingPod *apiv1.Pod
+	// restrictedRuntimeClasses are the runtime classes whose pods are only
+	// moved onto spot nodes labelled as supporting them.
+	restrictedRuntimeClasses map[string]bool
+	// maxPodsPerSpotNode caps how many pods a spot node hosts once pods are
+	// moved onto it, unlimited when 0.
+	maxPodsPerSpotNode int
+	// drainedNodeLabel is added to nodes once fully drained, if set.
+	drainedNodeLabel string
+	// drainedNodeAnnotation is added to nodes once fully drained, if set.
+	drainedNodeAnnotation string
+	// drainWebhookURL is notified each time a node is fully drained, if set.
+	drainWebhookURL string
+	// drainWebhookClient posts the notifications to the drain webhook.
+	drainWebhookClient *http.Client
+	// moveEvents records an Event on each pod moved.
+	moveEvents bool
+	// allUnmovableReasons reports every reason a pod can't be moved rather
+	// than only the first.
+	allUnmovableReasons bool
+	// notBeforeAnnotation holds the time before which a node isn't
+	// drained, nodes are never deferred when empty.
+	notBeforeAnnotation string
+	// cordonedTargetPolicy is what to do when a pod's planned spot node has
+	// been cordoned by the time the pod is evicted.
+	cordonedTargetPolicy string
+	// maxEvictionsPerNodePerRun caps how many pods are evicted from a node in
+	// a single pass, 0 for no limit.
+	maxEvictionsPerNodePerRun int
+	// maxDrainsPerRun caps how many nodes are drained in a single pass, one
+	// node is drained when not positive.
+	maxDrainsPerRun int
+	// optimizeDrains drains the combination of nodes that empties the most
+	// nodes rather than draining them in order.
+	optimizeDrains bool
+	// usageSource reports the observed usage pods are packed by instead of
+	// their requests, pods are packed by their requests when nil.
+	usageSource usageSource
+	// usageHeadroom is the factor observed usage is multiplied by.
+	usageHeadroom float64
+	// respectResourceQuotas limits the pods moved at once to the headroom of
+	// their namespaces' ResourceQuotas.
+	respectResourceQuotas bool
+	// minOnDemandNodes is the number of on-demand nodes running pods which
+	// are never drained.
+	minOnDemandNodes int
+	// decideDirection decides which way pods are moved each pass, they are
+	// always moved onto spot nodes when nil.
+	decideDirection func() Direction
+	// hypotheticalSpotNode is the allocatable of an additional spot node to
+	// consider for capacity planning, if any.
+	hypotheticalSpotNode apiv1.ResourceList
+	// nodeMapCache keeps the node map between passes.
+	nodeMapCache nodeMapCache
+	// recentMoves remembers the pods moved recently.
+	recentMoves recentMoves
+	// moveHistory records each pod move for the /moves endpoint.
+	moveHistory *moveHistory
+	// evictionBreaker pauses evictions while they keep failing.
+	evictionBreaker evictionBreaker
+	// nextDrainTime is the earliest time the next node may be drained.
+	nextDrainTime time.Time
+}
 
-					// Update the number of pods on this node's metrics
-					metrics.UpdateNodePodsCount(nodes.OnDemandNodeLabel, nodeInfo.Node.Name, len(podsForDeletion))
-					if len(podsForDeletion) < 1 {
-						// No pods so should just wait for node to be autoscaled away.
-						glog.V(2).Infof("No pods on %s, skipping.", nodeInfo.Node.Name)
-						continue
-					}
+// nodeMapCache keeps a node map between passes until it is older than maxAge
+// or a node or pod changes, after which it is rebuilt from the API. A maxAge of
+// 0 rebuilds the map on every pass.
+type nodeMapCache struct {
+	sync.Mutex
+	clock   clock.Clock
+	maxAge  time.Duration
+	nodeMap nodes.Map
+	builtAt time.Time
+	// generation counts invalidations, so that a map built while one happens
+	// isn't kept.
+	generation int
+}
 
-					glog.V(2).Infof("Considering %s for removal", nodeInfo.Node.Name)
+// get returns the cached node map, rebuilding it with build if there is none
+// or it is older than the cache's maxAge.
+func (c *nodeMapCache) get(build func() (nodes.Map, error)) (nodes.Map, error) {
+	c.Lock()
+	if c.clock == nil {
+		c.clock = clock.RealClock{}
+	}
+	if c.nodeMap != nil && c.clock.Since(c.builtAt) < c.maxAge {
+		defer c.Unlock()
+		return c.nodeMap, nil
+	}
+	generation := c.generation
+	c.Unlock()
 
-					// Checks whether or not a node can be drained
-					spotSnapshot.Fork()
-					err = canDrainNode(predicateChecker, spotSnapshot, spotNodeInfos, podsForDeletion)
-					if err != nil {
-						glog.V(2).Infof("Cannot drain node: %v", err)
-						spotSnapshot.Revert()
-						continue
-					}
+	nodeMap, err := build()
+	if err != nil {
+		return nil, err
+	}
 
-					// If building plan was successful, can drain node.
-					glog.V(2).Infof("All pods on %v can be moved. Will drain node.", nodeInfo.Node.Name)
-					// Drain the node - places eviction on each pod moving them in turn.
-					err = drainNode(kubeClient, recorder, nodeInfo.Node, podsForDeletion, int(maxGracefulTermination.Seconds()), *podEvictionTimeout)
-					if err != nil {
-						glog.Errorf("Failed to drain node: %v", err)
-					}
-					// Add the drain delay to allow system to stabilise
-					nextDrainTime = time.Now().Add(*nodeDrainDelay)
-					break
-				}
+	c.Lock()
+	defer c.Unlock()
+	if c.generation == generation {
+		c.nodeMap = nodeMap
+		c.builtAt = c.clock.Now()
+	}
+	return nodeMap, nil
+}
 
-				glog.V(3).Info("Finished processing nodes.")
-			}
+// invalidate forces the node map to be rebuilt on the next get.
+func (c *nodeMapCache) invalidate() {
+	c.Lock()
+	defer c.Unlock()
+	c.nodeMap = nil
+	c.generation++
+}
+
+// invalidateOnChange returns an event handler invalidating the cache whenever
+// a watched object is added, updated or deleted.
+func (c *nodeMapCache) invalidateOnChange() cache.ResourceEventHandlerFuncs {
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { c.invalidate() },
+		UpdateFunc: func(interface{}, interface{}) { c.invalidate() },
+		DeleteFunc: func(interface{}) { c.invalidate() },
+	}
+}
+
+// recentMoves remembers which pods were moved within the cooldown so that
+// they, or the pods replacing them, aren't moved again straight away. A
+// cooldown of 0 remembers nothing.
+type recentMoves struct {
+	clock    clock.Clock
+	cooldown time.Duration
+	movedAt  map[string]time.Time
+}
+
+// record remembers that the pods were moved now.
+func (m *recentMoves) record(pods []*apiv1.Pod) {
+	if m.cooldown <= 0 {
+		return
+	}
+	if m.clock == nil {
+		m.clock = clock.RealClock{}
+	}
+	if m.movedAt == nil {
+		m.movedAt = make(map[string]time.Time)
+	}
+
+	// Forget pods whose cooldown has passed
+	for id, movedAt := range m.movedAt {
+		if m.clock.Since(movedAt) >= m.cooldown {
+			delete(m.movedAt, id)
+		}
+	}
+	for _, pod := range pods {
+		m.movedAt[podID(pod)] = m.clock.Now()
+		if key, found := replacementKey(pod); found {
+			m.movedAt[key] = m.clock.Now()
 		}
 	}
 }
 
-func homeDir() string {
-	if h := os.Getenv("HOME"); h != "" {
-		return h
+// recentlyMoved determines whether the pod, or the pod it replaces, was moved
+// within the cooldown.
+func (m *recentMoves) recentlyMoved(pod *apiv1.Pod) bool {
+	if movedAt, found := m.movedAt[podID(pod)]; found && m.clock.Since(movedAt) < m.cooldown {
+		return true
 	}
-	return os.Getenv("USERPROFILE") // windows
+	key, found := replacementKey(pod)
+	if !found {
+		return false
+	}
+	// Creation timestamps only have a resolution of seconds
+	movedAt, found := m.movedAt[key]
+	return found && m.clock.Since(movedAt) < m.cooldown && !pod.CreationTimestamp.Time.Before(movedAt.Truncate(time.Second))
 }
 
-// Configure the kube client used to access the api, either from kubeconfig or
-//from pod environment if running in the cluster
-func createKubeClient(flags *flag.FlagSet, inCluster bool) (kube_client.Interface, error) {
-	var config *kube_restclient.Config
-	var err error
-	if inCluster {
-		// Load config from Kubernetes well known location.
-		config, err = kube_restclient.InClusterConfig()
-	} else {
+// Returns the key remembering moves of the pod's controller, which pods
+// created after the move are taken to replace the moved pods. Pods keeping
+// their name when replaced, such as a StatefulSet's, and pods without a
+// controller are only remembered by name.
+func replacementKey(pod *apiv1.Pod) (string, bool) {
+	controller := metav1.GetControllerOf(pod)
+	if controller == nil || controller.Kind == "StatefulSet" {
+		return "", false
+	}
+	return fmt.Sprintf("%s/%s", controller.Kind, controller.UID), true
+}
 
-		// use the current context in kubeconfig
-		config, err = clientcmd.BuildConfigFromFlags("", *kubeconfig)
-		if err != nil {
-			panic(err.Error())
-		}
+// MoveRecord describes the move of a pod off a node.
+type MoveRecord struct {
+	Pod    string    `json:"pod"`
+	From   string    `json:"from"`
+	To     string    `json:"to"`
+	Time   time.Time `json:"time"`
+	Result string    `json:"result"`
+}
 
+// moveHistory keeps the most recent pod moves in a ring buffer.
+type moveHistory struct {
+	sync.Mutex
+	clock   clock.Clock
+	records []MoveRecord
+	// next is the index the next record is written to once records is full.
+	next int
+}
+
+// Creates a move history holding up to size records, or nil if size is not
+// positive. A nil history records nothing.
+func newMoveHistory(size int) *moveHistory {
+	if size <= 0 {
+		return nil
+	}
+	return &moveHistory{
+		clock:   clock.RealClock{},
+		records: make([]MoveRecord, 0, size),
+	}
+}
+
+// add records the result of moving the pod, replacing the oldest record once
+// the history is full.
+func (h *moveHistory) add(pod *apiv1.Pod, from, to string, err error) {
+	if h == nil {
+		return
+	}
+	h.Lock()
+	defer h.Unlock()
+
+	record := MoveRecord{
+		Pod:    podID(pod),
+		From:   from,
+		To:     to,
+		Time:   h.clock.Now(),
+		Result: "Success",
 	}
 	if err != nil {
-		return nil, fmt.Errorf("error connecting to the client: %v", err)
+		record.Result = err.Error()
 	}
-	config.ContentType = *contentType
-	return kube_client.NewForConfigOrDie(config), nil
+
+	if len(h.records) < cap(h.records) {
+		h.records = append(h.records, record)
+		return
+	}
+	h.records[h.next] = record
+	h.next = (h.next + 1) % len(h.records)
 }
 
-// Create an event broadcaster so that we can call events when we modify the system
-func createEventRecorder(client kube_client.Interface) kube_record.EventRecorder {
-	eventBroadcaster := kube_record.NewBroadcaster()
-	eventBroadcaster.StartLogging(glog.Infof)
-	eventBroadcaster.StartRecordingToSink(&v1core.EventSinkImpl{Interface: v1core.New(client.CoreV1().RESTClient()).Events("")})
-	return eventBroadcaster.NewRecorder(runtime.NewScheme(), apiv1.EventSource{Component: "rescheduler"})
+// list returns the recorded moves, oldest first.
+func (h *moveHistory) list() []MoveRecord {
+	if h == nil {
+		return []MoveRecord{}
+	}
+	h.Lock()
+	defer h.Unlock()
+
+	records := make([]MoveRecord, 0, len(h.records))
+	records = append(records, h.records[h.next:]...)
+	return append(records, h.records[:h.next]...)
 }
 
-// Determines if any of the nodes meet the predicates that allow the Pod to be
-// scheduled on the node, and returns the node if it finds a suitable one.
-// Currently sorts nodes by most requested CPU in an attempt to fill fuller
-// nodes first (Attempting to bin pack)
-func findSpotNodeForPod(predicateChecker simulator.PredicateChecker, spotSnapshot simulator.ClusterSnapshot, nodes nodes.NodeInfoArray, pod *apiv1.Pod) string {
-	for _, nodeInfo := range nodes {
-		// Pretend pod isn't scheduled
-		pod.Spec.NodeName = ""
+// ServeHTTP serves the recorded moves as JSON.
+func (h *moveHistory) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(h.list()); err != nil {
+		glog.Errorf("Failed to serve move history: %v", err)
+	}
+}
 
-		// Check with the schedulers predicates to find a node to schedule on
-		err := predicateChecker.CheckPredicates(spotSnapshot, pod, nodeInfo.Node.Name)
-		if err == nil {
-			return nodeInfo.Node.Name
-		} else {
-			glog.V(4).Infof("Pod %s can't be rescheduled on node %s: %v", podID(pod), nodeInfo.Node.Name, err)
+// podUsage is the observed resource usage of each container of a pod, by
+// container name.
+type podUsage map[string]apiv1.ResourceList
+
+// usageSource reports the observed resource usage of pods.
+type usageSource interface {
+	// Usage returns the usage of each pod it has observed, by podID.
+	Usage(ctx context.Context) (map[string]podUsage, error)
+}
+
+// metricsServerUsageSource reads pod usage from the metrics.k8s.io API served
+// by metrics-server.
+type metricsServerUsageSource struct {
+	client kube_client.Interface
+}
+
+// podMetricsList is the part of a metrics.k8s.io PodMetricsList that is used.
+type podMetricsList struct {
+	Items []struct {
+		metav1.ObjectMeta `json:"metadata"`
+		Containers        []struct {
+			Name  string             `json:"name"`
+			Usage apiv1.ResourceList `json:"usage"`
+		} `json:"containers"`
+	} `json:"items"`
+}
+
+func (s metricsServerUsageSource) Usage(ctx context.Context) (map[string]podUsage, error) {
+	raw, err := s.client.CoreV1().RESTClient().Get().AbsPath("/apis/metrics.k8s.io/v1beta1/pods").DoRaw(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get pod metrics: %v", err)
+	}
+	var list podMetricsList
+	if err := json.Unmarshal(raw, &list); err != nil {
+		return nil, fmt.Errorf("failed to decode pod metrics: %v", err)
+	}
+
+	usage := make(map[string]podUsage, len(list.Items))
+	for _, item := range list.Items {
+		containers := make(podUsage, len(item.Containers))
+		for _, container := range item.Containers {
+			containers[container.Name] = container.Usage
 		}
+		usage[fmt.Sprintf("%s/%s", item.Namespace, item.Name)] = containers
 	}
+	return usage, nil
+}
 
-	return ""
+// Returns copies of the node infos whose pods request their observed usage
+// multiplied by headroom, with their requested and free resources
+// recalculated to match.
+func rightsizeNodeInfos(nodeInfos nodes.NodeInfoArray, usage map[string]podUsage, headroom float64) nodes.NodeInfoArray {
+	rightsized := nodeInfos.CopyNodeInfos()
+	for _, nodeInfo := range rightsized {
+		pods := make([]*apiv1.Pod, 0, len(nodeInfo.Pods))
+		for _, pod := range nodeInfo.Pods {
+			pods = append(pods, rightsizePod(pod, usage[podID(pod)], headroom))
+		}
+		nodeInfo.SetPods(pods)
+	}
+	return rightsized
 }
 
-// Goes through a list of pods and works out new nodes to place them on.
-// Returns an error if any of the pods won't fit onto existing spot nodes.
-func canDrainNode(predicateChecker simulator.PredicateChecker, spotSnapshot simulator.ClusterSnapshot, nodes nodes.NodeInfoArray, pods []*apiv1.Pod) error {
+// Returns a copy of the pod whose containers request their observed CPU and
+// memory usage multiplied by headroom, or the pod itself if it has no
+// observed usage.
+func rightsizePod(pod *apiv1.Pod, usage podUsage, headroom float64) *apiv1.Pod {
+	if len(usage) == 0 {
+		return pod
+	}
 
-	for _, pod := range pods {
-		// Works out if a spot node is available for rescheduling
-		nodeName := findSpotNodeForPod(predicateChecker, spotSnapshot, nodes, pod)
-		if nodeName == "" {
-			return fmt.Errorf("pod %s can't be rescheduled on any existing spot node", podID(pod))
+	rightsized := pod.DeepCopy()
+	for i := range rightsized.Spec.Containers {
+		container := &rightsized.Spec.Containers[i]
+		observed, found := usage[container.Name]
+		if !found {
+			continue
+		}
+		if container.Resources.Requests == nil {
+			container.Resources.Requests = apiv1.ResourceList{}
+		}
+		if cpu, found := observed[apiv1.ResourceCPU]; found {
+			container.Resources.Requests[apiv1.ResourceCPU] = *resource.NewMilliQuantity(int64(float64(cpu.MilliValue())*headroom), resource.DecimalSI)
+		}
+		if memory, found := observed[apiv1.ResourceMemory]; found {
+			container.Resources.Requests[apiv1.ResourceMemory] = *resource.NewQuantity(int64(float64(memory.Value())*headroom), resource.BinarySI)
 		}
-		glog.V(4).Infof("Pod %s can be rescheduled on %s, adding to plan.", podID(pod), nodeName)
-		spotSnapshot.AddPod(pod, nodeName)
 	}
+	return rightsized
+}
 
-	return nil
+// evictionBreaker pauses evictions for a cooldown once threshold evictions in
+// a row have failed. It never trips when threshold is 0.
+type evictionBreaker struct {
+	sync.Mutex
+	clock     clock.Clock
+	threshold int
+	cooldown  time.Duration
+
+	failures     int
+	trippedUntil time.Time
 }
 
-// Performs a drain on given node and updates the nextDrainTime variable.
-// Returns an error if the drain fails.
-func drainNode(kubeClient kube_client.Interface, recorder kube_record.EventRecorder, node *apiv1.Node, pods []*apiv1.Pod, maxGracefulTermination int, podEvictionTimeout time.Duration) error {
-	err := scaler.DrainNode(node, pods, kubeClient, recorder, maxGracefulTermination, podEvictionTimeout, scaler.EvictionRetryTime)
-	if err != nil {
-		metrics.UpdateNodeDrainCount("Failure", node.Name)
-		return err
+// record counts the result of an eviction, tripping the breaker once enough
+// evictions in a row have failed. Evictions which were never attempted are
+// not counted. Returns whether it tripped the breaker.
+func (b *evictionBreaker) record(err error) bool {
+	if b.threshold <= 0 {
+		return false
+	}
+	if _, skipped := err.(*scaler.SkippedEvictionError); skipped {
+		return false
+	}
+	b.Lock()
+	defer b.Unlock()
+	if b.clock == nil {
+		b.clock = clock.RealClock{}
 	}
 
-	metrics.UpdateNodeDrainCount("Success", node.Name)
-	return nil
+	if err == nil {
+		b.failures = 0
+		return false
+	}
+	b.failures++
+	if b.failures >= b.threshold {
+		glog.Errorf("%d evictions in a row failed, pausing evictions for %s.", b.failures, b.cooldown)
+		b.failures = 0
+		b.trippedUntil = b.clock.Now().Add(b.cooldown)
+		return true
+	}
+	return false
 }
 
-// Goes through a list of NodeInfos and updates the metrics system with the
-// number of pods that the rescheduler understands (So not daemonsets for
-// instance) that are on each of the nodes, labelling them as spot nodes.
-func updateSpotNodeMetrics(spotNodeInfos nodes.NodeInfoArray, pdbs []*policyv1.PodDisruptionBudget) {
-	for _, nodeInfo := range spotNodeInfos {
-		// Get a list of pods that are on the node (Only the types considered by the rescheduler)
-		podsOnNode, _, err := autoscaler_drain.GetPodsForDeletionOnNodeDrain(nodeInfo.Pods, pdbs, *deleteNonReplicatedPods, false, false, nil, 0, time.Now())
+// pausedFor returns how much longer evictions are paused for, 0 if the
+// breaker isn't tripped.
+func (b *evictionBreaker) pausedFor() time.Duration {
+	if b.threshold <= 0 {
+		return 0
+	}
+	b.Lock()
+	defer b.Unlock()
+	if b.clock == nil {
+		b.clock = clock.RealClock{}
+	}
+
+	if remaining := b.trippedUntil.Sub(b.clock.Now()); remaining > 0 {
+		return remaining
+	}
+	return 0
+}
+
+// Direction is which way a pass moves pods.
+type Direction string
+
+const (
+	// ToSpot moves pods from on-demand nodes onto spot nodes.
+	ToSpot Direction = "spot"
+	// ToOnDemand consolidates pods from spot nodes back onto on-demand nodes.
+	ToOnDemand Direction = "on-demand"
+)
+
+// Returns a direction decider reading the direction from the file at path,
+// or nil if the path is empty. Pods are moved onto spot nodes if the file
+// can't be read or doesn't hold a known direction.
+func fileDirectionDecider(path string) func() Direction {
+	if path == "" {
+		return nil
+	}
+	return func() Direction {
+		contents, err := ioutil.ReadFile(path)
 		if err != nil {
-			glog.Errorf("Failed to update metrics on spot node %s: %v", nodeInfo.Node.Name, err)
-			continue
+			glog.Errorf("Failed to read direction file, moving pods onto spot nodes: %v", err)
+			return ToSpot
+		}
+		switch direction := Direction(strings.TrimSpace(string(contents))); direction {
+		case ToSpot, ToOnDemand:
+			return direction
+		default:
+			glog.Errorf("Unknown direction %q, moving pods onto spot nodes", direction)
+			return ToSpot
 		}
-		metrics.UpdateNodePodsCount(nodes.SpotNodeLabel, nodeInfo.Node.Name, len(podsOnNode))
-
 	}
 }
 
-// Returns the pods Namespace/Name as a string
-func podID(pod *apiv1.Pod) string {
-	return fmt.Sprintf("%s/%s", pod.Namespace, pod.Name)
+// Result describes what a single Reconcile pass did.
+type Result struct {
+	// DrainedNode is the name of the first on-demand node drained during the
+	// pass, empty if no node was drained. Nodes whose drain failed aren't
+	// reported as drained.
+	DrainedNode string
+	// DrainedNodes are the names of all the on-demand nodes drained during the
+	// pass, in the order they were drained, leaving out failed drains.
+	DrainedNodes []string
+	// Rejections records why spot nodes were rejected as targets for pods
+	// during the pass.
+	Rejections Rejections
+	// Discrepancies lists the planned moves of the pass that didn't happen as
+	// planned.
+	Discrepancies []MoveDiscrepancy
+	// Direction is which way the pass moved pods.
+	Direction Direction
+	// EvictionsPaused is true if the pass did nothing because evictions are
+	// paused after too many consecutive eviction failures.
+	EvictionsPaused bool
+	// WarmingUp is true if the pass only observed the cluster because the
+	// rescheduler is still warming up.
+	WarmingUp bool
+	// MovedCPU is the CPU requested by the pods moved during the pass, in
+	// millicores. Only pods which were evicted successfully count.
+	MovedCPU int64
+	// MovedPods is the number of pods evicted successfully during the pass.
+	MovedPods int
+	// FreedCPU is the allocatable CPU of the on-demand node fully drained
+	// during the pass, in millicores.
+	FreedCPU int64
+	// PartialDrain is true if only some of the drained node's pods were
+	// moved because of the per node eviction limit, the rest are moved in
+	// later passes, or because only they needed moving to make room for the
+	// pending pod.
+	PartialDrain bool
+	// PendingPodNode is the on-demand node pods were moved off to make room
+	// for the pending pod, empty if no room was made.
+	PendingPodNode string
+	// UnmovablePods maps pods which can't be moved to the reason why, which
+	// keeps the nodes they run on from being drained.
+	UnmovablePods map[string]UnmovableReason
+	// UnmovableReasons maps pods which can't be moved to all the reasons
+	// why, in the order they are checked, when reporting all reasons.
+	// Otherwise it only holds the first reason, as UnmovablePods does.
+	UnmovableReasons map[string][]UnmovableReason
+	// AdditionalDrainableNodes is how many more on-demand nodes could be
+	// drained if the hypothetical spot node were added to the cluster.
+	AdditionalDrainableNodes int
+	// MinOnDemandNodes is the fewest on-demand nodes which could run the
+	// cluster's workload if there were no spot capacity left.
+	MinOnDemandNodes int
 }
 
-// Checks that the node lablels provided as arguments are in fact, sane.
-func validateArgs(OnDemandNodeLabel string, SpotNodeLabel string) error {
-	if len(strings.Split(OnDemandNodeLabel, "=")) > 2 {
-		return fmt.Errorf("the on demand node label is not correctly formatted: expected '<label_name>' or '<label_name>=<label_value>', but got %s", OnDemandNodeLabel)
+// Efficiency returns the CPU freed on on-demand nodes for each unit of CPU
+// moved during the pass, 0 if nothing was moved.
+func (r Result) Efficiency() float64 {
+	if r.MovedCPU == 0 {
+		return 0
 	}
+	return float64(r.FreedCPU) / float64(r.MovedCPU)
+}
 
-	if len(strings.Split(SpotNodeLabel, "=")) > 2 {
-		return fmt.Errorf("the spot node label is not correctly formatted: expected '<label_name>' or '<label_name>=<label_value>', but got %s", SpotNodeLabel)
-	}
+// UnmovableReason describes why a pod can't be moved off its node.
+type UnmovableReason string
+
+const (
+	// CrashLoopBackOff the pod is crash looping, moving it wouldn't help.
+	CrashLoopBackOff UnmovableReason = "CrashLoopBackOff"
+	// UnadvertisedResource the pod requests a resource none of the spot nodes
+	// advertise, so it could never fit on one.
+	UnadvertisedResource UnmovableReason = "UnadvertisedResource"
+	// LastReadyReplica the pod is the only Ready replica of its controller,
+	// evicting it would leave the controller unavailable.
+	LastReadyReplica UnmovableReason = "LastReadyReplica"
+	// RecentlyMoved the pod was moved within the move cooldown.
+	RecentlyMoved UnmovableReason = "RecentlyMoved"
+	// TooYoung the pod started within the minimum pod age and may still be
+	// initializing.
+	TooYoung UnmovableReason = "TooYoung"
+	// RestrictedRuntimeClass the pod uses a restricted runtime class none of
+	// the spot nodes support.
+	RestrictedRuntimeClass UnmovableReason = "RestrictedRuntimeClass"
+	// LocalStorage the pod has emptyDir or hostPath volumes whose data would
+	// be lost if it were moved.
+	LocalStorage UnmovableReason = "LocalStorage"
+	// ExcludedNamespace the pod is in a namespace whose pods are never moved.
+	ExcludedNamespace UnmovableReason = "ExcludedNamespace"
+	// ReschedulingDisabled the pod opted out of being moved with the
+	// rescheduling annotation.
+	ReschedulingDisabled UnmovableReason = "ReschedulingDisabled"
+	// TaintToleration a spot node has a taint the pod doesn't tolerate.
+	TaintToleration UnmovableReason = metrics.UnmovableReasonTaintToleration
+	// MaxPlacements a spot node has been planned as many pods as its
+	// max-placements annotation allows.
+	MaxPlacements UnmovableReason = metrics.UnmovableReasonMaxPlacements
+	// MaxPodDensity a spot node already hosts as many pods as the pod density
+	// cap allows.
+	MaxPodDensity UnmovableReason = metrics.UnmovableReasonMaxPodDensity
+)
 
+// runtimeClassLabelPrefix prefixes the name of a runtime class in the label of
+// spot nodes which support it, e.g. runtime.spot-rescheduler.pusher.com/gvisor.
+const runtimeClassLabelPrefix = "runtime.spot-rescheduler.pusher.com/"
+
+// maxPlacementsAnnotation limits how many pods the rescheduler plans onto an
+// annotated spot node in a single pass.
+const maxPlacementsAnnotation = "spot-rescheduler.pusher.com/max-placements"
+
+// Policies for a planned spot node which has been cordoned by the time the
+// pod is evicted.
+const (
+	// cordonedTargetIgnore evicts the pod anyway.
+	cordonedTargetIgnore = "ignore"
+	// cordonedTargetReselect plans the pod onto another spot node, aborting
+	// its move if none fits.
+	cordonedTargetReselect = "reselect"
+	// cordonedTargetAbort aborts the pod's move.
+	cordonedTargetAbort = "abort"
+)
+
+// drainPlan maps pods to the spot node they are planned to move onto.
+type drainPlan map[string]string
+
+// drainCandidate is an on-demand node along with the pods that would need to
+// be moved to drain it.
+type drainCandidate struct {
+	nodeInfo *nodes.NodeInfo
+	pods     []*apiv1.Pod
+	// partial is true if the pods are only some of those on the node, moved
+	// to make room rather than to drain it.
+	partial bool
+}
+
+// Rejection records why a spot node was rejected as the target of a pod.
+type Rejection struct {
+	// Pod is the pod rejected, as namespace/name.
+	Pod string
+	// Reason is which of the metrics' fixed set of reasons the rejection
+	// falls under.
+	Reason UnmovableReason
+	// Detail describes the rejection, such as the scheduler predicate's
+	// error.
+	Detail string
+}
+
+func (r Rejection) String() string {
+	return fmt.Sprintf("%s: %s", r.Pod, r.Detail)
+}
+
+// Rejections maps a spot node name to the reasons it was rejected as a
+// target for pods.
+type Rejections map[string][]Rejection
+
+// add records that the pod was rejected by the named spot node for the
+// reason, described by the detail.
+func (r Rejections) add(nodeName string, pod *apiv1.Pod, reason UnmovableReason, detail string) {
+	if r == nil {
+		return
+	}
+	r[nodeName] = append(r[nodeName], Rejection{Pod: podID(pod), Reason: reason, Detail: detail})
+}
+
+// merge records all of the other rejections.
+func (r Rejections) merge(other Rejections) {
+	if r == nil {
+		return
+	}
+	for nodeName, rejections := range other {
+		r[nodeName] = append(r[nodeName], rejections...)
+	}
+}
+
+// reasons returns the distinct reasons of the metrics' fixed set that all of
+// the rejections fall under.
+func (r Rejections) reasons() []string {
+	found := make(map[string]bool)
+	for _, rejections := range r {
+		for _, rejection := range rejections {
+			found[string(rejection.Reason)] = true
+		}
+	}
+	reasons := make([]string, 0, len(found))
+	for reason := range found {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	return reasons
+}
+
+// Works out which of the metrics' fixed set of reasons the message of a
+// scheduler predicate error falls under. Predicate errors are named after the
+// plugin which failed.
+func predicateReason(message string) UnmovableReason {
+	for _, reason := range metrics.UnmovableReasons {
+		if strings.Contains(message, reason) {
+			return UnmovableReason(reason)
+		}
+	}
+	return metrics.UnmovableReasonOther
+}
+
+// Reconcile performs a single housekeeping pass, draining up to
+// maxDrainsPerRun on-demand nodes whose pods can all be moved onto spot nodes.
+// Remaining work is abandoned once the context is done.
+func (r *rescheduler) Reconcile(ctx context.Context) Result {
+	result := Result{
+		Rejections:       make(Rejections),
+		UnmovablePods:    make(map[string]UnmovableReason),
+		UnmovableReasons: make(map[string][]UnmovableReason),
+	}
+
+	// Don't do anything if we are waiting for the drain delay timer
+	if time.Until(r.nextDrainTime) > 0 {
+		glog.V(2).Infof("Waiting %s for drain delay timer.", time.Until(r.nextDrainTime).Round(time.Second))
+		return result
+	}
+
+	// Don't evict anything while evictions keep failing
+	paused := r.evictionBreaker.pausedFor()
+	r.metrics.UpdateEvictionBreakerTripped(paused > 0)
+	if paused > 0 {
+		glog.V(2).Infof("Evictions paused for %s after consecutive eviction failures.", paused.Round(time.Second))
+		result.EvictionsPaused = true
+		return result
+	}
+
+	// Don't run if pods are unschedulable.
+	// Attempt to not make things worse.
+	unschedulablePods, err := r.unschedulablePodLister.List()
+	if err != nil {
+		glog.Errorf("Failed to get unschedulable pods: %v", err)
+	}
+	if len(unschedulablePods) > 0 {
+		glog.V(2).Info("Waiting for unschedulable pods to be scheduled.")
+		return result
+	}
+
+	result.WarmingUp = r.warmingUp()
+
+	glog.V(3).Info("Starting node processing.")
+	defer glog.V(3).Info("Finished processing nodes.")
+
+	// Get all nodes in the cluster
+	allNodes, err := r.nodeLister.List()
+	if err != nil {
+		glog.Errorf("Failed to list nodes: %v", err)
+		return result
+	}
+
+	// Build a map of nodeInfo structs.
+	// NodeInfo is used to map pods onto nodes and see their available
+	// resources.
+	nodeMap, err := r.nodeMapCache.get(func() (nodes.Map, error) {
+		if r.allPodLister != nil {
+			return nodes.NewNodeMapFromLister(r.allPodLister, allNodes, r.nodeConfig)
+		}
+		return nodes.NewNodeMap(ctx, r.kubeClient, allNodes, r.nodeConfig)
+	})
+	if err != nil {
+		glog.Errorf("Failed to build node map; %v", err)
+		return result
+	}
+
+	// A cached map may predate changes to the nodes' allocatable resources
+	// and to their availability. The node lister only lists Ready nodes, so
+	// nodes which were deleted or went NotReady are missing from it.
+	listed := make(map[string]bool, len(allNodes))
+	for _, node := range allNodes {
+		listed[node.Name] = true
+	}
+	for _, nodeInfos := range nodeMap {
+		for _, nodeInfo := range append(nodes.NodeInfoArray(nil), nodeInfos...) {
+			if !listed[nodeInfo.Node.Name] && nodeMap.RemoveNode(nodeInfo.Node.Name) {
+				glog.V(3).Infof("Node %s is gone or no longer Ready, removed its NodeInfo.", nodeInfo.Node.Name)
+			}
+		}
+	}
+	for _, node := range allNodes {
+		if nodeMap.UpdateNode(node, r.nodeConfig) {
+			glog.V(3).Infof("Allocatable resources of node %s changed, updated its NodeInfo.", node.Name)
+		}
+		if r.nodeConfig.Unavailable(node) && nodeMap.RemoveNode(node.Name) {
+			glog.V(3).Infof("Node %s became unavailable, removed its NodeInfo.", node.Name)
+		}
+	}
+
+	// Update metrics.
+	r.metrics.UpdateNodesMap(nodeMap, r.nodeConfig)
+	glog.V(4).Infof("Node map: %v", nodeMap)
+
+	// Get PodDisruptionBudgets
+	allPDBs, err := r.podDisruptionBudgetLister.List()
+	if err != nil {
+		glog.Errorf("Failed to list PDBs: %v", err)
+		return result
+	}
+
+	var quotas []*apiv1.ResourceQuota
+	if r.respectResourceQuotas {
+		quotas, err = r.resourceQuotaLister.List()
+		if err != nil {
+			glog.Errorf("Failed to list resource quotas: %v", err)
+			return result
+		}
+	}
+
+	// Get onDemand and spot nodeInfoArrays
+	// These are sorted when the nodeMap is created.
+	onDemandNodeInfos := nodeMap[nodes.OnDemand]
+	spotNodeInfos := nodeMap[nodes.Spot]
+
+	// Update spot node metrics
+	updateSpotNodeMetrics(r.metrics, spotNodeInfos, allPDBs, r.nodeConfig.SpotNodeLabel())
+
+	// Work out how many on-demand nodes the workload needs without spot nodes
+	result.MinOnDemandNodes = minOnDemandNodes(r.nodeConfig, onDemandNodeInfos, workloadPods(nodeMap))
+	r.metrics.UpdateMinOnDemandNodes(result.MinOnDemandNodes)
+
+	// When consolidating onto on-demand nodes the spot nodes are drained
+	// instead, the rest of the pass treats them as the on-demand nodes.
+	sourceNodeLabel := r.nodeConfig.OnDemandNodeLabel()
+	result.Direction = r.direction()
+	if result.Direction == ToOnDemand {
+		glog.V(2).Info("Moving pods from spot nodes onto on-demand nodes this pass.")
+		sources, err := r.spotSourceNodeInfos(ctx, spotNodeInfos)
+		if err != nil {
+			glog.Errorf("Failed to build the spot nodes' NodeInfos; %v", err)
+			return result
+		}
+		onDemandNodeInfos, spotNodeInfos = sources, onDemandNodeInfos
+		sourceNodeLabel = r.nodeConfig.SpotNodeLabel()
+	}
+
+	// Pack pods by their observed usage rather than their requests
+	if r.usageSource != nil {
+		usage, err := r.usageSource.Usage(ctx)
+		if err != nil {
+			glog.Errorf("Failed to get pod usage, packing pods by their requests: %v", err)
+		} else {
+			onDemandNodeInfos = rightsizeNodeInfos(onDemandNodeInfos, usage, r.usageHeadroom)
+			spotNodeInfos = rightsizeNodeInfos(spotNodeInfos, usage, r.usageHeadroom)
+		}
+	}
+	spotSnapshot := spotNodeInfos.GetClusterSnapshot()
+
+	// No on demand nodes so nothing to do.
+	if len(onDemandNodeInfos) < 1 {
+		glog.V(2).Info("No nodes to process.")
+	}
+
+	// Work out which pods would need to be moved to drain each onDemand node
+	readyReplicas := countReadyReplicas(workloadPods(nodeMap))
+	candidates := r.getDrainCandidates(onDemandNodeInfos, sourceNodeLabel, advertisedResources(spotNodeInfos), supportedRuntimeClasses(spotNodeInfos), readyReplicas, allPDBs, result.UnmovableReasons)
+
+	for id, reasons := range result.UnmovableReasons {
+		result.UnmovablePods[id] = reasons[0]
+		for _, reason := range reasons {
+			r.metrics.UpdateUnmovablePodsCount(string(reason))
+		}
+	}
+
+	if result.Direction == ToSpot {
+		// Work out how much of each node could currently be drained
+		for _, candidate := range candidates {
+			score := drainabilityScore(r.nodeConfig, r.predicateChecker, spotSnapshot, spotNodeInfos, candidate.pods)
+			r.metrics.UpdateNodeDrainabilityScore(candidate.nodeInfo.Node.Name, score)
+		}
+
+		// Work out what an additional spot node would allow for capacity planning
+		if len(r.hypotheticalSpotNode) > 0 {
+			result.AdditionalDrainableNodes = additionalDrainableNodes(r.predicateChecker, spotNodeInfos, candidates, r.hypotheticalSpotNode)
+			glog.V(2).Infof("An additional spot node would allow %d more node(s) to be drained.", result.AdditionalDrainableNodes)
+		}
+	}
+
+	// Only move the pods needed to make room for the pending pod
+	if r.pendingPod != nil {
+		candidate, found := r.findRoomForPod(r.pendingPod, onDemandNodeInfos, candidates, spotSnapshot, spotNodeInfos)
+		candidates = nil
+		if found {
+			glog.V(2).Infof("Moving %d pod(s) off %s to make room for pod %s.", len(candidate.pods), candidate.nodeInfo.Node.Name, podID(r.pendingPod))
+			result.PendingPodNode = candidate.nodeInfo.Node.Name
+			candidates = []drainCandidate{candidate}
+		}
+	}
+
+	// Keep a buffer of on-demand nodes in case spot nodes are reclaimed, never
+	// draining more nodes in a pass than would leave fewer running pods
+	maxDrains := r.maxDrainsPerRun
+	keepBuffer := result.Direction == ToSpot && r.minOnDemandNodes > 0 && r.pendingPod == nil
+	occupied := countOccupiedNodes(onDemandNodeInfos)
+	if keepBuffer {
+		if occupied <= r.minOnDemandNodes {
+			glog.V(2).Infof("Only %d on-demand node(s) running pods, keeping at least %d.", occupied, r.minOnDemandNodes)
+			candidates = nil
+		} else if occupied-r.minOnDemandNodes < maxDrains {
+			maxDrains = occupied - r.minOnDemandNodes
+		}
+	}
+
+	// Nodes tainted PreferNoSchedule for other reasons are drained last
+	if r.avoidPreferNoSchedule {
+		sort.SliceStable(candidates, func(i, j int) bool {
+			return !hasUntoleratedPreferNoSchedule(candidates[i]) && hasUntoleratedPreferNoSchedule(candidates[j])
+		})
+	}
+
+	// Move the nodes that together empty the most nodes to the front
+	if r.optimizeDrains && maxDrains > 1 && r.pendingPod == nil {
+		candidates = optimizeDrainOrder(r.predicateChecker, spotSnapshot, spotNodeInfos, candidates, maxDrains, r.planOptions())
+	}
+
+	// Go through each onDemand node in turn
+	// Build a plan to move pods onto other nodes
+	// In the case that all can be moved, drain the node
+	drains := 0
+	for _, candidate := range candidates {
+		nodeInfo := candidate.nodeInfo
+		podsForDeletion := candidate.pods
+
+		if ctx.Err() != nil {
+			glog.Errorf("Aborting node processing: %v", ctx.Err())
+			break
+		}
+
+		glog.V(2).Infof("Considering %s for removal", nodeInfo.Node.Name)
+
+		// Checks whether or not a node can be drained
+		spotSnapshot.Fork()
+		plan, err := planDrain(r.predicateChecker, spotSnapshot, spotNodeInfos, podsForDeletion, result.Rejections, r.planOptions())
+		if err != nil {
+			glog.V(2).Infof("Cannot drain node: %v", err)
+			if unplaceable, ok := err.(*unplaceablePodError); ok {
+				for _, reason := range unplaceable.reasons {
+					r.metrics.UpdateUnmovablePodsCount(reason)
+				}
+			}
+			spotSnapshot.Revert()
+			continue
+		}
+		// Keep the pods placed so that later nodes are planned around them
+		if err := spotSnapshot.Commit(); err != nil {
+			glog.Errorf("Failed to commit plan for node %s: %v", nodeInfo.Node.Name, err)
+			break
+		}
+
+		// Only observe while warming up, the plan may be based on incomplete data.
+		if result.WarmingUp {
+			glog.V(2).Infof("All pods on %v can be moved. Not draining node while warming up.", nodeInfo.Node.Name)
+			break
+		}
+
+		// If building plan was successful, can drain node.
+		glog.V(2).Infof("All pods on %v can be moved. Will drain node.", nodeInfo.Node.Name)
+		if candidate.partial {
+			result.PartialDrain = true
+		}
+
+		// Only move as many pods at once as their namespaces' quotas allow
+		if r.respectResourceQuotas {
+			fitting := withinQuotaHeadroom(podsForDeletion, quotas)
+			if len(fitting) == 0 {
+				glog.V(2).Infof("No pod on %v can be moved within its namespace's resource quota headroom.", nodeInfo.Node.Name)
+				break
+			}
+			if len(fitting) < len(podsForDeletion) {
+				glog.V(2).Infof("Only evicting %d of the %d pods on %v this pass to stay within resource quotas.", len(fitting), len(podsForDeletion), nodeInfo.Node.Name)
+				result.PartialDrain = true
+			}
+			podsForDeletion = fitting
+		}
+
+		// Only move some of the pods this pass if limited
+		if r.maxEvictionsPerNodePerRun > 0 && len(podsForDeletion) > r.maxEvictionsPerNodePerRun {
+			glog.V(2).Infof("Only evicting %d of the %d pods on %v this pass.", r.maxEvictionsPerNodePerRun, len(podsForDeletion), nodeInfo.Node.Name)
+			podsForDeletion = podsForDeletion[:r.maxEvictionsPerNodePerRun]
+			result.PartialDrain = true
+		}
+
+		// Drain the node - places eviction on each pod moving them in turn.
+		planned := make(drainPlan, len(plan))
+		for id, nodeName := range plan {
+			planned[id] = nodeName
+		}
+		outcomes := &evictionOutcomes{}
+		checkTarget := func(*apiv1.Pod) error {
+			return nil
+		}
+		target := func(pod *apiv1.Pod) string {
+			return plan[podID(pod)]
+		}
+		if r.cordonedTargetPolicy != cordonedTargetIgnore {
+			checker := &targetChecker{
+				policy:           r.cordonedTargetPolicy,
+				predicateChecker: r.predicateChecker,
+				spotSnapshot:     spotSnapshot,
+				spotNodeInfos:    spotNodeInfos,
+				nodeLister:       r.nodeLister,
+				plan:             plan,
+			}
+			checkTarget = checker.check
+			target = checker.target
+		}
+		beforeEviction := func(pod *apiv1.Pod) error {
+			if r.evictionBreaker.pausedFor() > 0 {
+				return fmt.Errorf("evictions are paused after %d consecutive eviction failures", r.evictionBreaker.threshold)
+			}
+			return checkTarget(pod)
+		}
+		afterEviction := func(pod *apiv1.Pod, err error) {
+			outcomes.record(pod, err)
+			if err == nil {
+				r.metrics.UpdateEvictionsCount()
+			}
+			if r.evictionBreaker.record(err) {
+				r.metrics.UpdateEvictionBreakerTripped(true)
+			}
+			r.moveHistory.add(pod, nodeInfo.Node.Name, target(pod), err)
+			if err == nil && r.moveEvents {
+				recordMoveEvent(r.recorder, r.nodeConfig, pod, nodeInfo.Node.Name, target(pod))
+			}
+		}
+		err = drainNode(ctx, r.kubeClient, r.recorder, r.metrics, nodeInfo.Node, podsForDeletion, int(maxGracefulTermination.Seconds()), *podEvictionTimeout, beforeEviction, afterEviction)
+		for _, discrepancy := range planDiscrepancies(podsForDeletion, planned, target, outcomes) {
+			glog.V(2).Infof("Pod %s was planned onto %s but %s.", discrepancy.Pod, discrepancy.PlannedNode, discrepancy.Reason)
+			result.Discrepancies = append(result.Discrepancies, discrepancy)
+		}
+		if err != nil {
+			glog.Errorf("Failed to drain node: %v", err)
+		} else if result.PartialDrain {
+			glog.V(2).Infof("Node %v still has pods to move, not marking it as drained.", nodeInfo.Node.Name)
+		} else if err := markDrainedNode(ctx, r.kubeClient, nodeInfo.Node, r.drainedNodeLabel, r.drainedNodeAnnotation); err != nil {
+			glog.Errorf("Failed to mark node %s as drained: %v", nodeInfo.Node.Name, err)
+		}
+		if err == nil && !result.PartialDrain && r.drainWebhookURL != "" {
+			if err := notifyDrained(ctx, r.drainWebhookClient, r.drainWebhookURL, nodeInfo.Node, podsForDeletion); err != nil {
+				glog.Errorf("Failed to notify drain webhook of node %s: %v", nodeInfo.Node.Name, err)
+			}
+		}
+		if err == nil {
+			if result.DrainedNode == "" {
+				result.DrainedNode = nodeInfo.Node.Name
+			}
+			result.DrainedNodes = append(result.DrainedNodes, nodeInfo.Node.Name)
+		}
+		// Only the pods evicted successfully have moved
+		moved := outcomes.evicted(podsForDeletion)
+		r.recentMoves.record(moved)
+		// The node's pods have moved, the cached map no longer reflects the cluster
+		r.nodeMapCache.invalidate()
+		result.MovedCPU += r.nodeConfig.RequestedCPU(moved)
+		result.MovedPods += len(moved)
+		if err == nil && !result.PartialDrain {
+			result.FreedCPU += nodeInfo.Node.Status.Allocatable.Cpu().MilliValue()
+		}
+		// Add the drain delay to allow system to stabilise, unless the node
+		// still has pods to move in the next pass
+		if !result.PartialDrain {
+			r.nextDrainTime = time.Now().Add(*nodeDrainDelay)
+		}
+
+		// A partially drained node is finished in the next pass before any
+		// other node is drained
+		drains++
+		if result.PartialDrain || drains >= maxDrains {
+			break
+		}
+		if keepBuffer && occupied-drains <= r.minOnDemandNodes {
+			glog.V(2).Infof("Only %d on-demand node(s) left running pods, keeping at least %d.", occupied-drains, r.minOnDemandNodes)
+			break
+		}
+	}
+
+	logRejections(result.Rejections)
+	r.metrics.ObserveMovedResources(result.MovedCPU, result.MovedPods)
+	if result.MovedCPU > 0 {
+		glog.V(2).Infof("Consolidation efficiency: freed %dm of CPU by moving %dm (%.2f).", result.FreedCPU, result.MovedCPU, result.Efficiency())
+		r.metrics.UpdateConsolidationEfficiency(result.Efficiency())
+	}
+
+	return result
+}
+
+// Decides which way pods are moved this pass.
+func (r *rescheduler) direction() Direction {
+	if r.decideDirection == nil {
+		return ToSpot
+	}
+	return r.decideDirection()
+}
+
+// Rebuilds the NodeInfos of the spot nodes to drain them onto on-demand nodes.
+// The spot PriorityThreshold would hide their low priority pods, which would
+// then be left behind on nodes reported as drained, so their pods are
+// considered by the OnDemandPriorityThreshold like those of on-demand nodes
+// being drained, all of them when it is nil.
+func (r *rescheduler) spotSourceNodeInfos(ctx context.Context, spotNodeInfos nodes.NodeInfoArray) (nodes.NodeInfoArray, error) {
+	spotNodes := make([]*apiv1.Node, 0, len(spotNodeInfos))
+	for _, nodeInfo := range spotNodeInfos {
+		spotNodes = append(spotNodes, nodeInfo.Node)
+	}
+
+	config := *r.nodeConfig
+	config.PriorityThreshold = math.MinInt32
+	if config.OnDemandPriorityThreshold != nil {
+		config.PriorityThreshold = *config.OnDemandPriorityThreshold
+	}
+	var nodeMap nodes.Map
+	var err error
+	if r.allPodLister != nil {
+		nodeMap, err = nodes.NewNodeMapFromLister(r.allPodLister, spotNodes, &config)
+	} else {
+		nodeMap, err = nodes.NewNodeMap(ctx, r.kubeClient, spotNodes, &config)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return nodeMap[nodes.Spot], nil
+}
+
+// Determines whether the rescheduler is still within its warm-up period or
+// waiting for its caches to sync.
+func (r *rescheduler) warmingUp() bool {
+	if time.Now().Before(r.warmUpUntil) {
+		return true
+	}
+	for _, synced := range r.cachesSynced {
+		if !synced() {
+			return true
+		}
+	}
+	return false
+}
+
+// Builds the list of on-demand nodes that have pods to move, along with those
+// pods, in the order of the given node infos. Nodes running pods which can't
+// be moved are left out, the pods are recorded in unmovable.
+func (r *rescheduler) getDrainCandidates(onDemandNodeInfos nodes.NodeInfoArray, nodeLabel string, advertised map[apiv1.ResourceName]bool, runtimeClasses map[string]bool, readyReplicas map[types.UID]int, pdbs []*policyv1.PodDisruptionBudget, unmovable map[string][]UnmovableReason) []drainCandidate {
+	candidates := make([]drainCandidate, 0)
+	for _, nodeInfo := range onDemandNodeInfos {
+		// Get a list of pods that we would need to move onto other nodes
+		podsForDeletion, err := getPodsForDeletion(nodeInfo, pdbs)
+		if err != nil {
+			glog.Errorf("Failed to get pods for consideration: %v", err)
+			continue
+		}
+
+		// Update the number of pods on this node's metrics
+		r.metrics.UpdateNodePodsCount(nodeLabel, nodeInfo.Node.Name, len(podsForDeletion))
+		r.metrics.UpdateNodeCPUUtilization(nodeLabel, nodeInfo.Node.Name, nodeInfo.RoundedCPUUtilization(*utilizationPrecision))
+		if len(podsForDeletion) < 1 {
+			// No pods so should just wait for node to be autoscaled away.
+			glog.V(2).Infof("No pods on %s, skipping.", nodeInfo.Node.Name)
+			continue
+		}
+
+		if until, deferred := r.drainDeferred(nodeInfo.Node); deferred {
+			glog.V(2).Infof("Not draining %s before %s, skipping.", nodeInfo.Node.Name, until)
+			continue
+		}
+
+		movable := true
+		for _, pod := range podsForDeletion {
+			if reasons := r.getUnmovableReasons(pod, advertised, runtimeClasses, readyReplicas); len(reasons) > 0 {
+				glog.V(2).Infof("Pod %s on %s can't be moved: %v", podID(pod), nodeInfo.Node.Name, reasons)
+				unmovable[podID(pod)] = reasons
+				movable = false
+			}
+		}
+		if !movable {
+			continue
+		}
+
+		candidates = append(candidates, drainCandidate{nodeInfo: nodeInfo, pods: podsForDeletion})
+	}
+	return candidates
+}
+
+// Determines whether the node's do-not-drain-before annotation holds a time
+// still in the future, returning the time. Nodes with an invalid timestamp are
+// deferred too, as the operator meant them not to be drained.
+func (r *rescheduler) drainDeferred(node *apiv1.Node) (string, bool) {
+	if r.notBeforeAnnotation == "" {
+		return "", false
+	}
+	value, found := node.Annotations[r.notBeforeAnnotation]
+	if !found {
+		return "", false
+	}
+	until, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		glog.Errorf("Invalid %s annotation on node %s, not draining it: %v", r.notBeforeAnnotation, node.Name, err)
+		return value, true
+	}
+	return value, time.Now().Before(until)
+}
+
+// Returns the reasons the pod can't be moved in the order they are checked,
+// only the first unless reporting all of them, or none if it can be moved.
+// Resources are only checked against those advertised by the spot nodes if
+// there are any. runtimeClasses holds the runtime classes supported by any of
+// the spot nodes and readyReplicas the number of Ready pods of each
+// controller.
+func (r *rescheduler) getUnmovableReasons(pod *apiv1.Pod, advertised map[apiv1.ResourceName]bool, runtimeClasses map[string]bool, readyReplicas map[types.UID]int) []UnmovableReason {
+	checks := []struct {
+		reason  UnmovableReason
+		applies func() bool
+	}{
+		{CrashLoopBackOff, func() bool {
+			return r.skipCrashLoopingPods && isCrashLooping(pod)
+		}},
+		{ExcludedNamespace, func() bool {
+			return r.nodeConfig.ExcludedNamespaces[pod.Namespace]
+		}},
+		{ReschedulingDisabled, func() bool {
+			return r.nodeConfig.IsReschedulingDisabled(pod)
+		}},
+		{LocalStorage, func() bool {
+			return r.nodeConfig.ProtectLocalStoragePods && !nodes.IsMovable(pod)
+		}},
+		{LastReadyReplica, func() bool {
+			return r.protectLastReadyReplica && isLastReadyReplica(pod, readyReplicas)
+		}},
+		{RecentlyMoved, func() bool {
+			return r.recentMoves.recentlyMoved(pod)
+		}},
+		{TooYoung, func() bool {
+			return r.minPodAge > 0 && podAge(pod) < r.minPodAge
+		}},
+		{RestrictedRuntimeClass, func() bool {
+			class, found := restrictedRuntimeClass(pod, r.restrictedRuntimeClasses)
+			if found && !runtimeClasses[class] {
+				glog.V(4).Infof("Pod %s uses runtime class %s which no spot node supports", podID(pod), class)
+				return true
+			}
+			return false
+		}},
+		{UnadvertisedResource, func() bool {
+			if len(advertised) == 0 {
+				return false
+			}
+			name, found := unadvertisedResource(pod, advertised)
+			if found {
+				glog.V(4).Infof("Pod %s requests %s which no spot node advertises", podID(pod), name)
+			}
+			return found
+		}},
+	}
+
+	var reasons []UnmovableReason
+	for _, check := range checks {
+		if !check.applies() {
+			continue
+		}
+		reasons = append(reasons, check.reason)
+		if !r.allUnmovableReasons {
+			break
+		}
+	}
+	return reasons
+}
+
+// Returns how long ago the pod started, or was created if it hasn't started.
+func podAge(pod *apiv1.Pod) time.Duration {
+	if pod.Status.StartTime != nil {
+		return time.Since(pod.Status.StartTime.Time)
+	}
+	return time.Since(pod.CreationTimestamp.Time)
+}
+
+// Counts the Ready pods of each controller.
+func countReadyReplicas(pods []*apiv1.Pod) map[types.UID]int {
+	readyReplicas := make(map[types.UID]int)
+	for _, pod := range pods {
+		controller := metav1.GetControllerOf(pod)
+		if controller != nil && isPodReady(pod) {
+			readyReplicas[controller.UID]++
+		}
+	}
+	return readyReplicas
+}
+
+// Determines whether the pod is Ready and the only Ready pod of its controller.
+func isLastReadyReplica(pod *apiv1.Pod, readyReplicas map[types.UID]int) bool {
+	controller := metav1.GetControllerOf(pod)
+	if controller == nil || !isPodReady(pod) {
+		return false
+	}
+	return readyReplicas[controller.UID] <= 1
+}
+
+// Determines whether the pod's Ready condition is true.
+func isPodReady(pod *apiv1.Pod) bool {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == apiv1.PodReady {
+			return condition.Status == apiv1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// Returns the runtime class of the pod if it is one of the restricted ones.
+func restrictedRuntimeClass(pod *apiv1.Pod, restricted map[string]bool) (string, bool) {
+	if pod.Spec.RuntimeClassName == nil || !restricted[*pod.Spec.RuntimeClassName] {
+		return "", false
+	}
+	return *pod.Spec.RuntimeClassName, true
+}
+
+// Determines whether the node is labelled as supporting the runtime class.
+func supportsRuntimeClass(node *apiv1.Node, class string) bool {
+	_, found := node.Labels[runtimeClassLabelPrefix+class]
+	return found
+}
+
+// Returns the runtime classes any of the nodes are labelled as supporting.
+func supportedRuntimeClasses(nodeInfos nodes.NodeInfoArray) map[string]bool {
+	supported := make(map[string]bool)
+	for _, nodeInfo := range nodeInfos {
+		for label := range nodeInfo.Node.Labels {
+			if strings.HasPrefix(label, runtimeClassLabelPrefix) {
+				supported[strings.TrimPrefix(label, runtimeClassLabelPrefix)] = true
+			}
+		}
+	}
+	return supported
+}
+
+// Returns the resources with allocatable capacity on any of the nodes.
+func advertisedResources(nodeInfos nodes.NodeInfoArray) map[apiv1.ResourceName]bool {
+	advertised := make(map[apiv1.ResourceName]bool)
+	for _, nodeInfo := range nodeInfos {
+		for name, quantity := range nodeInfo.Node.Status.Allocatable {
+			if !quantity.IsZero() {
+				advertised[name] = true
+			}
+		}
+	}
+	return advertised
+}
+
+// Returns the first resource requested by one of the pod's containers which
+// isn't advertised.
+func unadvertisedResource(pod *apiv1.Pod, advertised map[apiv1.ResourceName]bool) (apiv1.ResourceName, bool) {
+	for _, containers := range [][]apiv1.Container{pod.Spec.InitContainers, pod.Spec.Containers} {
+		for _, container := range containers {
+			for _, requirements := range []apiv1.ResourceList{container.Resources.Requests, container.Resources.Limits} {
+				for name, quantity := range requirements {
+					if !quantity.IsZero() && !advertised[name] {
+						return name, true
+					}
+				}
+			}
+		}
+	}
+	return "", false
+}
+
+// Determines whether any of the pod's containers are in CrashLoopBackOff.
+func isCrashLooping(pod *apiv1.Pod) bool {
+	for _, statuses := range [][]apiv1.ContainerStatus{pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses} {
+		for _, status := range statuses {
+			if status.State.Waiting != nil && status.State.Waiting.Reason == "CrashLoopBackOff" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Gets the pods that would need to be moved onto other nodes to drain the
+// given node, ignoring pods controlled by DaemonSets.
+func getPodsForDeletion(nodeInfo *nodes.NodeInfo, pdbs []*policyv1.PodDisruptionBudget) ([]*apiv1.Pod, error) {
+	allPods, blockingPod, err := autoscaler_drain.GetPodsForDeletionOnNodeDrain(nodeInfo.Pods, pdbs, *deleteNonReplicatedPods, false, false, nil, 0, time.Now())
+	if blockingPod != nil {
+		glog.Infof("BlockingPod: %v", err)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	podsForDeletion := make([]*apiv1.Pod, 0)
+	for _, pod := range allPods {
+		if isDaemonSetPod(pod) {
+			glog.V(4).Infof("Ignoring pod %s which is controlled by DaemonSet", podID(pod))
+			continue
+		}
+
+		podsForDeletion = append(podsForDeletion, pod)
+	}
+	return podsForDeletion, nil
+}
+
+// Determines whether the pod is controlled by a DaemonSet.
+func isDaemonSetPod(pod *apiv1.Pod) bool {
+	for _, owner := range pod.GetOwnerReferences() {
+		if owner.Controller != nil && *owner.Controller && owner.Kind == "DaemonSet" {
+			return true
+		}
+	}
+	return false
+}
+
+// Logs a summary of the spot nodes that rejected pods during a pass, and the
+// individual reasons at a higher verbosity.
+func logRejections(rejections Rejections) {
+	for nodeName, nodeRejections := range rejections {
+		glog.V(3).Infof("Spot node %s rejected %d pod(s)", nodeName, len(nodeRejections))
+		for _, rejection := range nodeRejections {
+			glog.V(4).Infof("Spot node %s rejected %s", nodeName, rejection)
+		}
+	}
+}
+
+func homeDir() string {
+	if h := os.Getenv("HOME"); h != "" {
+		return h
+	}
+	return os.Getenv("USERPROFILE") // windows
+}
+
+// permission is an API request the rescheduler needs to be allowed to make.
+type permission struct {
+	verb        string
+	group       string
+	resource    string
+	subresource string
+}
+
+func (p permission) String() string {
+	resource := p.resource
+	if p.subresource != "" {
+		resource += "/" + p.subresource
+	}
+	if p.group != "" {
+		resource += "." + p.group
+	}
+	return fmt.Sprintf("%s %s", p.verb, resource)
+}
+
+// Returns the permissions the rescheduler needs with the flags it was given.
+func requiredPermissions() []permission {
+	permissions := []permission{
+		// Listers and informers for nodes and pods, nodes are fetched again
+		// when tainting them conflicts and pods while waiting for them to go.
+		{verb: "get", resource: "nodes"},
+		{verb: "list", resource: "nodes"},
+		{verb: "watch", resource: "nodes"},
+		{verb: "update", resource: "nodes"},
+		{verb: "get", resource: "pods"},
+		{verb: "list", resource: "pods"},
+		{verb: "watch", resource: "pods"},
+		{verb: "create", resource: "pods", subresource: "eviction"},
+		{verb: "list", group: "policy", resource: "poddisruptionbudgets"},
+		{verb: "watch", group: "policy", resource: "poddisruptionbudgets"},
+		{verb: "create", resource: "events"},
+		{verb: "patch", resource: "events"},
+	}
+	// The scheduler plugins run by the predicate checker list and watch these
+	// through their informers.
+	for _, resource := range []struct{ group, resource string }{
+		{"", "services"},
+		{"", "replicationcontrollers"},
+		{"", "persistentvolumes"},
+		{"", "persistentvolumeclaims"},
+		{"apps", "replicasets"},
+		{"apps", "statefulsets"},
+		{"storage.k8s.io", "storageclasses"},
+		{"storage.k8s.io", "csinodes"},
+	} {
+		permissions = append(permissions,
+			permission{verb: "list", group: resource.group, resource: resource.resource},
+			permission{verb: "watch", group: resource.group, resource: resource.resource})
+	}
+	if *drainedNodeLabel != "" || *drainedNodeAnnotation != "" {
+		permissions = append(permissions, permission{verb: "patch", resource: "nodes"})
+	}
+	if *respectResourceQuotas {
+		permissions = append(permissions,
+			permission{verb: "list", resource: "resourcequotas"},
+			permission{verb: "watch", resource: "resourcequotas"})
+	}
+	if *usageBasedPacking {
+		permissions = append(permissions, permission{verb: "list", group: "metrics.k8s.io", resource: "pods"})
+	}
+	return permissions
+}
+
+// Checks with SelfSubjectAccessReviews that the rescheduler is allowed all of
+// the permissions, returning an error listing those it's missing.
+func checkPermissions(ctx context.Context, kubeClient kube_client.Interface, permissions []permission) error {
+	missing := make([]string, 0)
+	for _, p := range permissions {
+		review := &authorizationv1.SelfSubjectAccessReview{
+			Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+				ResourceAttributes: &authorizationv1.ResourceAttributes{
+					Verb:        p.verb,
+					Group:       p.group,
+					Resource:    p.resource,
+					Subresource: p.subresource,
+				},
+			},
+		}
+		review, err := kubeClient.AuthorizationV1().SelfSubjectAccessReviews().Create(ctx, review, metav1.CreateOptions{})
+		if err != nil {
+			return fmt.Errorf("failed to check permission to %s: %v", p, err)
+		}
+		if !review.Status.Allowed {
+			glog.Errorf("Not allowed to %s: %s", p, review.Status.Reason)
+			missing = append(missing, p.String())
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing permissions: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// Configure the kube client used to access the api, either from kubeconfig or
+//from pod environment if running in the cluster
+func createKubeClient(flags *flag.FlagSet, inCluster bool) (kube_client.Interface, error) {
+	var config *kube_restclient.Config
+	var err error
+	if inCluster {
+		// Load config from Kubernetes well known location.
+		config, err = kube_restclient.InClusterConfig()
+	} else {
+
+		// use the current context in kubeconfig
+		config, err = clientcmd.BuildConfigFromFlags("", *kubeconfig)
+		if err != nil {
+			panic(err.Error())
+		}
+
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to the client: %v", err)
+	}
+	config.ContentType = *contentType
+	return kube_client.NewForConfigOrDie(config), nil
+}
+
+// Returns the name the rescheduler reports events as, namespaced by scope so
+// that independent reschedulers can be told apart. Events and metrics are
+// the only things scopes share: the rescheduler keeps its state in memory,
+// without leader election locks or ConfigMaps which would need namespacing.
+func componentName(scope string) string {
+	if scope == "" {
+		return "rescheduler"
+	}
+	return fmt.Sprintf("rescheduler-%s", scope)
+}
+
+// Create an event broadcaster so that we can call events when we modify the system
+func createEventRecorder(client kube_client.Interface, component string) kube_record.EventRecorder {
+	eventBroadcaster := kube_record.NewBroadcaster()
+	eventBroadcaster.StartLogging(glog.Infof)
+	eventBroadcaster.StartRecordingToSink(&v1core.EventSinkImpl{Interface: v1core.New(client.CoreV1().RESTClient()).Events("")})
+	return eventBroadcaster.NewRecorder(runtime.NewScheme(), apiv1.EventSource{Component: component})
+}
+
+// Determines if any of the nodes meet the predicates that allow the Pod to be
+// scheduled on the node, and returns the node if it finds a suitable one.
+// Currently sorts nodes by most requested CPU in an attempt to fill fuller
+// nodes first (Attempting to bin pack)
+func findSpotNodeForPod(predicateChecker simulator.PredicateChecker, spotSnapshot simulator.ClusterSnapshot, nodes nodes.NodeInfoArray, pod *apiv1.Pod, rejections Rejections) string {
+	// Pretend pod isn't scheduled, without changing the informer's copy
+	pod = pod.DeepCopy()
+	pod.Spec.NodeName = ""
+
+	for _, nodeInfo := range nodes {
+		// A pod only tolerating a NoExecute taint for 0 seconds would be
+		// evicted again straight away
+		if taint := unstableNoExecuteTaint(pod, nodeInfo.Node); taint != nil {
+			glog.V(4).Infof("Pod %s can't be rescheduled on node %s: only tolerates taint %s for 0 seconds", podID(pod), nodeInfo.Node.Name, taint.ToString())
+			rejections.add(nodeInfo.Node.Name, pod, TaintToleration, fmt.Sprintf("only tolerates taint %s for 0 seconds", taint.ToString()))
+			continue
+		}
+
+		// Check with the schedulers predicates to find a node to schedule on
+		err := predicateChecker.CheckPredicates(spotSnapshot, pod, nodeInfo.Node.Name)
+		if err == nil {
+			return nodeInfo.Node.Name
+		} else {
+			glog.V(4).Infof("Pod %s can't be rescheduled on node %s: %v", podID(pod), nodeInfo.Node.Name, err)
+			message := fmt.Sprintf("%v", err)
+			rejections.add(nodeInfo.Node.Name, pod, predicateReason(message), message)
+		}
+	}
+
+	return ""
+}
+
+// Determines whether the candidate's node has a PreferNoSchedule taint which
+// any of its pods don't tolerate.
+func hasUntoleratedPreferNoSchedule(candidate drainCandidate) bool {
+	for i := range candidate.nodeInfo.Node.Spec.Taints {
+		taint := &candidate.nodeInfo.Node.Spec.Taints[i]
+		if taint.Effect != apiv1.TaintEffectPreferNoSchedule {
+			continue
+		}
+		for _, pod := range candidate.pods {
+			tolerated := false
+			for j := range pod.Spec.Tolerations {
+				if pod.Spec.Tolerations[j].ToleratesTaint(taint) {
+					tolerated = true
+					break
+				}
+			}
+			if !tolerated {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Returns the first NoExecute taint on the node which the pod only tolerates
+// with a tolerationSeconds of 0, or nil if there is none. Taints the pod
+// doesn't tolerate at all are left to the scheduler predicates.
+func unstableNoExecuteTaint(pod *apiv1.Pod, node *apiv1.Node) *apiv1.Taint {
+	for i := range node.Spec.Taints {
+		taint := &node.Spec.Taints[i]
+		if taint.Effect != apiv1.TaintEffectNoExecute {
+			continue
+		}
+
+		tolerated := false
+		stable := false
+		for j := range pod.Spec.Tolerations {
+			toleration := &pod.Spec.Tolerations[j]
+			if !toleration.ToleratesTaint(taint) {
+				continue
+			}
+			tolerated = true
+			if toleration.TolerationSeconds == nil || *toleration.TolerationSeconds > 0 {
+				stable = true
+				break
+			}
+		}
+
+		if tolerated && !stable {
+			return taint
+		}
+	}
+	return nil
+}
+
+// Goes through a list of pods and works out new nodes to place them on.
+// Returns an error if any of the pods won't fit onto existing spot nodes.
+// The reasons spot nodes were rejected are recorded in rejections.
+func canDrainNode(predicateChecker simulator.PredicateChecker, spotSnapshot simulator.ClusterSnapshot, nodes nodes.NodeInfoArray, pods []*apiv1.Pod, rejections Rejections) error {
+	_, err := planDrain(predicateChecker, spotSnapshot, nodes, pods, rejections, planOptions{})
+	return err
+}
+
+// planOptions adjusts how pods are placed onto spot nodes when planning.
+type planOptions struct {
+	// spread places pods of the same controller on distinct spot nodes where
+	// they fit.
+	spread bool
+	// restrictedRuntimeClasses are the runtime classes whose pods are only
+	// placed onto spot nodes labelled as supporting them.
+	restrictedRuntimeClasses map[string]bool
+	// maxPodsPerNode caps how many pods a spot node may host once the pods
+	// are placed, unlimited when 0.
+	maxPodsPerNode int
+}
+
+// Returns the options pods are planned onto spot nodes with.
+func (r *rescheduler) planOptions() planOptions {
+	return planOptions{
+		spread:                   r.spreadReplicas,
+		restrictedRuntimeClasses: r.restrictedRuntimeClasses,
+		maxPodsPerNode:           r.maxPodsPerSpotNode,
+	}
+}
+
+// Works out which spot node each of the pods would move onto, adding the pods
+// to the snapshot.
+func planDrain(predicateChecker simulator.PredicateChecker, spotSnapshot simulator.ClusterSnapshot, spotNodeInfos nodes.NodeInfoArray, pods []*apiv1.Pod, rejections Rejections, opts planOptions) (drainPlan, error) {
+	plan := make(drainPlan)
+	placements := make(map[string]int)
+	planned := make(map[string][]*apiv1.Pod)
+	for _, pod := range pods {
+		podRejections := make(Rejections)
+
+		// Skip spot nodes which have already been given as many pods as they
+		// may receive
+		available := make(nodes.NodeInfoArray, 0, len(spotNodeInfos))
+		for _, nodeInfo := range spotNodeInfos {
+			if limit, found := maxPlacements(nodeInfo.Node); found && placements[nodeInfo.Node.Name] >= limit {
+				podRejections.add(nodeInfo.Node.Name, pod, MaxPlacements, fmt.Sprintf("already planned %d of at most %d pods", placements[nodeInfo.Node.Name], limit))
+				continue
+			}
+			if hosted := len(nodeInfo.Pods) + len(nodeInfo.DaemonSetPods) + placements[nodeInfo.Node.Name]; opts.maxPodsPerNode > 0 && hosted >= opts.maxPodsPerNode {
+				podRejections.add(nodeInfo.Node.Name, pod, MaxPodDensity, fmt.Sprintf("already hosts %d pods, the pod density cap", hosted))
+				continue
+			}
+			if class, found := restrictedRuntimeClass(pod, opts.restrictedRuntimeClasses); found && !supportsRuntimeClass(nodeInfo.Node, class) {
+				podRejections.add(nodeInfo.Node.Name, pod, RestrictedRuntimeClass, fmt.Sprintf("doesn't support runtime class %s", class))
+				continue
+			}
+			available = append(available, nodeInfo)
+		}
+		if opts.spread {
+			spreadAcrossNodes(available, pod, planned)
+		}
+
+		// Works out if a spot node is available for rescheduling
+		nodeName := findSpotNodeForPod(predicateChecker, spotSnapshot, available, pod, podRejections)
+		rejections.merge(podRejections)
+		if nodeName == "" {
+			return nil, &unplaceablePodError{pod: pod, reasons: podRejections.reasons()}
+		}
+		glog.V(4).Infof("Pod %s can be rescheduled on %s, adding to plan.", podID(pod), nodeName)
+		spotSnapshot.AddPod(pod, nodeName)
+		plan[podID(pod)] = nodeName
+		placements[nodeName]++
+		planned[nodeName] = append(planned[nodeName], pod)
+	}
+
+	return plan, nil
+}
+
+// Works out the fewest of the movable pods on one of the drain candidates
+// which, once moved onto the spot nodes, leave room on the candidate for the
+// pod. The pods requesting the most CPU are moved first. Returns false if the
+// pod already fits on an on-demand node or no such move is possible.
+func (r *rescheduler) findRoomForPod(pod *apiv1.Pod, onDemandNodeInfos nodes.NodeInfoArray, candidates []drainCandidate, spotSnapshot simulator.ClusterSnapshot, spotNodeInfos nodes.NodeInfoArray) (drainCandidate, bool) {
+	pod = pod.DeepCopy()
+	pod.Spec.NodeName = ""
+	onDemandSnapshot := onDemandNodeInfos.GetClusterSnapshot()
+	for _, nodeInfo := range onDemandNodeInfos {
+		if err := r.predicateChecker.CheckPredicates(onDemandSnapshot, pod, nodeInfo.Node.Name); err == nil {
+			glog.V(2).Infof("Pod %s already fits on %s, no pods need to be moved.", podID(pod), nodeInfo.Node.Name)
+			return drainCandidate{}, false
+		}
+	}
+
+	var best drainCandidate
+	found := false
+	for _, candidate := range candidates {
+		pods := make([]*apiv1.Pod, len(candidate.pods))
+		copy(pods, candidate.pods)
+		sort.SliceStable(pods, func(i, j int) bool {
+			return r.nodeConfig.RequestedCPU(pods[i:i+1]) > r.nodeConfig.RequestedCPU(pods[j:j+1])
+		})
+
+		for moves := 1; moves <= len(pods) && (!found || moves < len(best.pods)); moves++ {
+			if !fitsWithout(r.predicateChecker, onDemandSnapshot, pod, candidate.nodeInfo.Node.Name, pods[:moves]) {
+				continue
+			}
+			// Moving more pods wouldn't help if these can't all be moved
+			spotSnapshot.Fork()
+			_, err := planDrain(r.predicateChecker, spotSnapshot, spotNodeInfos, pods[:moves], nil, r.planOptions())
+			spotSnapshot.Revert()
+			if err != nil {
+				break
+			}
+			best = drainCandidate{
+				nodeInfo: candidate.nodeInfo,
+				pods:     pods[:moves],
+				partial:  moves < len(pods),
+			}
+			found = true
+			break
+		}
+	}
+
+	if !found {
+		glog.V(2).Infof("No pods can be moved to make room for pod %s.", podID(pod))
+	}
+	return best, found
+}
+
+// Determines whether the pod fits on the named node once the other pods are
+// removed from it.
+func fitsWithout(predicateChecker simulator.PredicateChecker, snapshot simulator.ClusterSnapshot, pod *apiv1.Pod, nodeName string, removed []*apiv1.Pod) bool {
+	snapshot.Fork()
+	defer snapshot.Revert()
+	for _, other := range removed {
+		if err := snapshot.RemovePod(other.Namespace, other.Name, nodeName); err != nil {
+			glog.Errorf("Failed to remove pod %s from the snapshot: %v", podID(other), err)
+			return false
+		}
+	}
+	return predicateChecker.CheckPredicates(snapshot, pod, nodeName) == nil
+}
+
+// Stably reorders the spot nodes so that those running, or planned, the fewest
+// pods of the pod's controller come first, spreading its replicas across spot
+// nodes. Nodes are otherwise left in packing order.
+func spreadAcrossNodes(nodeInfos nodes.NodeInfoArray, pod *apiv1.Pod, planned map[string][]*apiv1.Pod) {
+	controller := metav1.GetControllerOf(pod)
+	if controller == nil {
+		return
+	}
+
+	replicas := make(map[string]int, len(nodeInfos))
+	for _, nodeInfo := range nodeInfos {
+		for _, pods := range [][]*apiv1.Pod{nodeInfo.Pods, planned[nodeInfo.Node.Name]} {
+			for _, other := range pods {
+				if otherController := metav1.GetControllerOf(other); otherController != nil && otherController.UID == controller.UID {
+					replicas[nodeInfo.Node.Name]++
+				}
+			}
+		}
+	}
+	sort.SliceStable(nodeInfos, func(i, j int) bool {
+		return replicas[nodeInfos[i].Node.Name] < replicas[nodeInfos[j].Node.Name]
+	})
+}
+
+// unplaceablePodError is returned when a pod fits on none of the spot nodes.
+type unplaceablePodError struct {
+	pod *apiv1.Pod
+	// reasons are the distinct reasons of the metrics' fixed set the spot
+	// nodes rejected the pod for.
+	reasons []string
+}
+
+func (e *unplaceablePodError) Error() string {
+	return fmt.Sprintf("pod %s can't be rescheduled on any existing spot node", podID(e.pod))
+}
+
+// optimizerCandidateLimit bounds how many candidates the drain optimizer
+// searches through, as it tries each combination of them.
+const optimizerCandidateLimit = 16
+
+// Returns the candidates reordered so that the largest combination of up to
+// limit nodes whose pods can all be moved onto spot nodes together comes first,
+// followed by the remaining candidates in their original order.
+func optimizeDrainOrder(predicateChecker simulator.PredicateChecker, spotSnapshot simulator.ClusterSnapshot, spotNodeInfos nodes.NodeInfoArray, candidates []drainCandidate, limit int, opts planOptions) []drainCandidate {
+	searched := candidates
+	if len(searched) > optimizerCandidateLimit {
+		searched = searched[:optimizerCandidateLimit]
+	}
+	if limit > len(searched) {
+		limit = len(searched)
+	}
+
+	for size := limit; size > 1; size-- {
+		combination := findDrainableCombination(predicateChecker, spotSnapshot, spotNodeInfos, searched, size, opts)
+		if combination == nil {
+			continue
+		}
+
+		ordered := make([]drainCandidate, 0, len(candidates))
+		chosen := make(map[int]bool)
+		for _, i := range combination {
+			ordered = append(ordered, candidates[i])
+			chosen[i] = true
+		}
+		for i, candidate := range candidates {
+			if !chosen[i] {
+				ordered = append(ordered, candidate)
+			}
+		}
+		return ordered
+	}
+	return candidates
+}
+
+// Returns the indices of the first combination of size candidates whose pods
+// can all be moved onto spot nodes together, or nil if there is none.
+func findDrainableCombination(predicateChecker simulator.PredicateChecker, spotSnapshot simulator.ClusterSnapshot, spotNodeInfos nodes.NodeInfoArray, candidates []drainCandidate, size int, opts planOptions) []int {
+	combination := make([]int, size)
+	for i := range combination {
+		combination[i] = i
+	}
+
+	for {
+		if canDrainTogether(predicateChecker, spotSnapshot, spotNodeInfos, candidates, combination, opts) {
+			return combination
+		}
+
+		// Move on to the next combination in lexicographic order
+		i := size - 1
+		for i >= 0 && combination[i] == len(candidates)-size+i {
+			i--
+		}
+		if i < 0 {
+			return nil
+		}
+		combination[i]++
+		for j := i + 1; j < size; j++ {
+			combination[j] = combination[j-1] + 1
+		}
+	}
+}
+
+// Determines whether the pods of all the candidates in the combination can be
+// moved onto spot nodes together, leaving the snapshot unchanged.
+func canDrainTogether(predicateChecker simulator.PredicateChecker, spotSnapshot simulator.ClusterSnapshot, spotNodeInfos nodes.NodeInfoArray, candidates []drainCandidate, combination []int, opts planOptions) bool {
+	spotSnapshot.Fork()
+	defer spotSnapshot.Revert()
+
+	for _, i := range combination {
+		if _, err := planDrain(predicateChecker, spotSnapshot, spotNodeInfos, candidates[i].pods, nil, opts); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the most pods the rescheduler may plan onto the node in a pass, if
+// the node is annotated with a valid limit.
+func maxPlacements(node *apiv1.Node) (int, bool) {
+	value, found := node.Annotations[maxPlacementsAnnotation]
+	if !found {
+		return 0, false
+	}
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit < 0 {
+		glog.Errorf("Ignoring invalid %s annotation %q on node %s", maxPlacementsAnnotation, value, node.Name)
+		return 0, false
+	}
+	return limit, true
+}
+
+// Returns the pods, in order, whose replacements can be created within the
+// headroom left by their namespace's ResourceQuotas while the evicted pods are
+// still counted against them. Quota scopes are not taken into account.
+func withinQuotaHeadroom(pods []*apiv1.Pod, quotas []*apiv1.ResourceQuota) []*apiv1.Pod {
+	headroom := make(map[string][]apiv1.ResourceList)
+	for _, quota := range quotas {
+		free := apiv1.ResourceList{}
+		for name, hard := range quota.Status.Hard {
+			left := hard.DeepCopy()
+			left.Sub(quota.Status.Used[name])
+			free[name] = left
+		}
+		headroom[quota.Namespace] = append(headroom[quota.Namespace], free)
+	}
+
+	fitting := make([]*apiv1.Pod, 0, len(pods))
+	for _, pod := range pods {
+		usage := quotaUsage(pod)
+		fits := true
+		for _, free := range headroom[pod.Namespace] {
+			for name, needed := range usage {
+				if left, found := free[name]; found && needed.Cmp(left) > 0 {
+					fits = false
+				}
+			}
+		}
+		if !fits {
+			glog.V(4).Infof("Pod %s does not fit in the resource quota headroom of its namespace.", podID(pod))
+			continue
+		}
+		for _, free := range headroom[pod.Namespace] {
+			for name, needed := range usage {
+				if left, found := free[name]; found {
+					left.Sub(needed)
+					free[name] = left
+				}
+			}
+		}
+		fitting = append(fitting, pod)
+	}
+	return fitting
+}
+
+// Returns how much of each quota resource the pod counts against, the way the
+// quota admission evaluator counts it: its pod count, its effective requests
+// under both the plain and "requests." names and its effective limits under
+// the "limits." names, taking init containers and overhead into account.
+func quotaUsage(pod *apiv1.Pod) apiv1.ResourceList {
+	usage := apiv1.ResourceList{
+		apiv1.ResourcePods: *resource.NewQuantity(1, resource.DecimalSI),
+	}
+	requested := make(map[apiv1.ResourceName]bool)
+	limited := make(map[apiv1.ResourceName]bool)
+	for _, containers := range [][]apiv1.Container{pod.Spec.Containers, pod.Spec.InitContainers} {
+		for _, container := range containers {
+			for name := range container.Resources.Requests {
+				requested[name] = true
+			}
+			for name := range container.Resources.Limits {
+				limited[name] = true
+			}
+		}
+	}
+	for name := range pod.Spec.Overhead {
+		requested[name] = true
+	}
+	for name := range requested {
+		request := nodes.PodResource(pod, name, nodes.Requests)
+		usage[name] = request
+		usage[apiv1.ResourceName("requests."+string(name))] = request.DeepCopy()
+	}
+	for name := range limited {
+		usage[apiv1.ResourceName("limits."+string(name))] = nodes.PodResource(pod, name, nodes.Limits)
+	}
+	return usage
+}
+
+// MoveDiscrepancy describes a planned pod move that didn't happen as planned.
+type MoveDiscrepancy struct {
+	Pod         string
+	PlannedNode string
+	// ActualNode is the node the pod was moved onto instead, empty if it
+	// wasn't moved.
+	ActualNode string
+	Reason     string
+}
+
+// evictionOutcomes collects the result of each pod's eviction during a drain.
+type evictionOutcomes struct {
+	sync.Mutex
+	errs map[string]error
+}
+
+// record remembers the result of evicting the pod.
+func (o *evictionOutcomes) record(pod *apiv1.Pod, err error) {
+	o.Lock()
+	defer o.Unlock()
+	if o.errs == nil {
+		o.errs = make(map[string]error)
+	}
+	o.errs[podID(pod)] = err
+}
+
+// evicted returns the pods whose eviction was recorded as successful, in their
+// order.
+func (o *evictionOutcomes) evicted(pods []*apiv1.Pod) []*apiv1.Pod {
+	o.Lock()
+	defer o.Unlock()
+	evicted := make([]*apiv1.Pod, 0, len(pods))
+	for _, pod := range pods {
+		if err, reported := o.errs[podID(pod)]; reported && err == nil {
+			evicted = append(evicted, pod)
+		}
+	}
+	return evicted
+}
+
+// Compares the planned moves of the pods with how their evictions went and
+// the spot nodes they ended up targeting, in the order of the pods.
+func planDiscrepancies(pods []*apiv1.Pod, planned drainPlan, target func(*apiv1.Pod) string, outcomes *evictionOutcomes) []MoveDiscrepancy {
+	outcomes.Lock()
+	defer outcomes.Unlock()
+
+	discrepancies := make([]MoveDiscrepancy, 0)
+	for _, pod := range pods {
+		discrepancy := MoveDiscrepancy{
+			Pod:         podID(pod),
+			PlannedNode: planned[podID(pod)],
+		}
+		err, reported := outcomes.errs[podID(pod)]
+		switch {
+		case !reported:
+			discrepancy.Reason = "it was not evicted"
+		case err != nil:
+			discrepancy.Reason = fmt.Sprintf("its eviction failed: %v", err)
+		case target(pod) != discrepancy.PlannedNode:
+			discrepancy.ActualNode = target(pod)
+			discrepancy.Reason = fmt.Sprintf("it was moved onto %s instead", discrepancy.ActualNode)
+		default:
+			continue
+		}
+		discrepancies = append(discrepancies, discrepancy)
+	}
+	return discrepancies
+}
+
+// targetChecker re-checks the spot node a pod was planned onto just before the
+// pod is evicted, in case the node was cordoned since the plan was made.
+type targetChecker struct {
+	sync.Mutex
+	policy           string
+	predicateChecker simulator.PredicateChecker
+	spotSnapshot     simulator.ClusterSnapshot
+	spotNodeInfos    nodes.NodeInfoArray
+	nodeLister       nodeLister
+	plan             drainPlan
+}
+
+// target returns the spot node the pod is currently planned onto.
+func (c *targetChecker) target(pod *apiv1.Pod) string {
+	c.Lock()
+	defer c.Unlock()
+	return c.plan[podID(pod)]
+}
+
+// check returns an error if the pod's move should be aborted, planning it onto
+// another spot node first if its target was cordoned and the policy allows it.
+func (c *targetChecker) check(pod *apiv1.Pod) error {
+	c.Lock()
+	defer c.Unlock()
+
+	allNodes, err := c.nodeLister.List()
+	if err != nil {
+		glog.Errorf("Failed to list nodes, not checking target of pod %s: %v", podID(pod), err)
+		return nil
+	}
+	cordoned := make(map[string]bool)
+	for _, node := range allNodes {
+		if node.Spec.Unschedulable {
+			cordoned[node.Name] = true
+		}
+	}
+
+	target := c.plan[podID(pod)]
+	if !cordoned[target] {
+		return nil
+	}
+
+	switch c.policy {
+	case cordonedTargetAbort:
+		return fmt.Errorf("target spot node %s of pod %s was cordoned", target, podID(pod))
+	case cordonedTargetReselect:
+		if err := c.spotSnapshot.RemovePod(pod.Namespace, pod.Name, target); err != nil {
+			return fmt.Errorf("failed to remove pod %s from cordoned spot node %s: %v", podID(pod), target, err)
+		}
+		available := make(nodes.NodeInfoArray, 0, len(c.spotNodeInfos))
+		for _, nodeInfo := range c.spotNodeInfos {
+			if !cordoned[nodeInfo.Node.Name] {
+				available = append(available, nodeInfo)
+			}
+		}
+		nodeName := findSpotNodeForPod(c.predicateChecker, c.spotSnapshot, available, pod, nil)
+		if nodeName == "" {
+			return fmt.Errorf("target spot node %s of pod %s was cordoned and no other spot node fits it", target, podID(pod))
+		}
+		glog.V(2).Infof("Target spot node %s of pod %s was cordoned, moving it onto %s instead.", target, podID(pod), nodeName)
+		c.spotSnapshot.AddPod(pod, nodeName)
+		c.plan[podID(pod)] = nodeName
+		return nil
+	}
+
+	glog.V(2).Infof("Target spot node %s of pod %s was cordoned, evicting it anyway.", target, podID(pod))
+	return nil
+}
+
+// Counts the nodes running pods other than those controlled by DaemonSets.
+func countOccupiedNodes(nodeInfos nodes.NodeInfoArray) int {
+	occupied := 0
+	for _, nodeInfo := range nodeInfos {
+		for _, pod := range nodeInfo.Pods {
+			if !isDaemonSetPod(pod) {
+				occupied++
+				break
+			}
+		}
+	}
+	return occupied
+}
+
+// Returns the pods running on the on-demand and spot nodes, other than those
+// controlled by DaemonSets which run on every node anyway.
+func workloadPods(nodeMap nodes.Map) []*apiv1.Pod {
+	pods := make([]*apiv1.Pod, 0)
+	for _, nodeInfos := range []nodes.NodeInfoArray{nodeMap[nodes.OnDemand], nodeMap[nodes.Spot]} {
+		for _, nodeInfo := range nodeInfos {
+			for _, pod := range nodeInfo.Pods {
+				if !isDaemonSetPod(pod) {
+					pods = append(pods, pod)
+				}
+			}
+		}
+	}
+	return pods
+}
+
+// Works out the fewest on-demand nodes which could run the pods if there were
+// no spot capacity left, packing their requested CPU first fit decreasing onto
+// nodes the size of the on-demand nodes, largest first. Once every on-demand
+// node is in use, further nodes are assumed to be the size of the largest.
+func minOnDemandNodes(config *nodes.Config, onDemandNodeInfos nodes.NodeInfoArray, pods []*apiv1.Pod) int {
+	if len(onDemandNodeInfos) == 0 || len(pods) == 0 {
+		return 0
+	}
+
+	sizes := make([]int64, 0, len(onDemandNodeInfos))
+	for _, nodeInfo := range onDemandNodeInfos {
+		sizes = append(sizes, nodeInfo.Node.Status.Allocatable.Cpu().MilliValue())
+	}
+	sort.Slice(sizes, func(i, j int) bool { return sizes[i] > sizes[j] })
+
+	requests := make([]int64, 0, len(pods))
+	for _, pod := range pods {
+		requests = append(requests, config.RequestedCPU([]*apiv1.Pod{pod}))
+	}
+	sort.Slice(requests, func(i, j int) bool { return requests[i] > requests[j] })
+
+	// free holds the CPU left on each node in use
+	free := make([]int64, 0)
+	for _, request := range requests {
+		placed := false
+		for i := range free {
+			if request <= free[i] {
+				free[i] -= request
+				placed = true
+				break
+			}
+		}
+		if placed {
+			continue
+		}
+		size := sizes[0]
+		if len(free) < len(sizes) {
+			size = sizes[len(free)]
+		}
+		// A pod bigger than any node still needs a node of its own
+		free = append(free, size-request)
+	}
+	return len(free)
+}
+
+// Works out the fraction of the CPU used by the pods, according to the
+// config, which fits onto the spot nodes, placing as many of the pods as
+// possible. The snapshot is left unchanged.
+func drainabilityScore(config *nodes.Config, predicateChecker simulator.PredicateChecker, spotSnapshot simulator.ClusterSnapshot, spotNodeInfos nodes.NodeInfoArray, pods []*apiv1.Pod) float64 {
+	requestedCPU := config.RequestedCPU(pods)
+	if requestedCPU == 0 {
+		return 1
+	}
+
+	spotSnapshot.Fork()
+	defer spotSnapshot.Revert()
+
+	var placedCPU int64
+	for _, pod := range pods {
+		nodeName := findSpotNodeForPod(predicateChecker, spotSnapshot, spotNodeInfos, pod, nil)
+		if nodeName == "" {
+			continue
+		}
+		spotSnapshot.AddPod(pod, nodeName)
+		placedCPU += config.RequestedCPU([]*apiv1.Pod{pod})
+	}
+	return float64(placedCPU) / float64(requestedCPU)
+}
+
+// Simulates draining the candidates one after the other onto the spot nodes
+// and returns how many of them could be drained.
+func countDrainableNodes(predicateChecker simulator.PredicateChecker, spotNodeInfos nodes.NodeInfoArray, candidates []drainCandidate) int {
+	spotSnapshot := spotNodeInfos.GetClusterSnapshot()
+	drainable := 0
+	for _, candidate := range candidates {
+		spotSnapshot.Fork()
+		err := canDrainNode(predicateChecker, spotSnapshot, spotNodeInfos, candidate.pods, nil)
+		if err != nil {
+			spotSnapshot.Revert()
+			continue
+		}
+		spotSnapshot.Commit()
+		drainable++
+	}
+	return drainable
+}
+
+// Works out how many more of the candidates could be drained if a spot node
+// with the given allocatable resources were added to the spot nodes.
+func additionalDrainableNodes(predicateChecker simulator.PredicateChecker, spotNodeInfos nodes.NodeInfoArray, candidates []drainCandidate, allocatable apiv1.ResourceList) int {
+	drainable := countDrainableNodes(predicateChecker, spotNodeInfos, candidates)
+
+	withHypotheticalNode := append(spotNodeInfos.CopyNodeInfos(), newHypotheticalSpotNodeInfo(spotNodeInfos, allocatable))
+	return countDrainableNodes(predicateChecker, withHypotheticalNode, candidates) - drainable
+}
+
+// Creates an empty, ready spot node with the given allocatable resources.
+// The node takes the labels of the first existing spot node so that it
+// matches the same node selectors.
+func newHypotheticalSpotNodeInfo(spotNodeInfos nodes.NodeInfoArray, allocatable apiv1.ResourceList) *nodes.NodeInfo {
+	node := &apiv1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "hypothetical-spot-node",
+		},
+		Status: apiv1.NodeStatus{
+			Capacity:    allocatable.DeepCopy(),
+			Allocatable: allocatable.DeepCopy(),
+			Conditions: []apiv1.NodeCondition{
+				{
+					Type:   apiv1.NodeReady,
+					Status: apiv1.ConditionTrue,
+				},
+			},
+		},
+	}
+	if len(spotNodeInfos) > 0 {
+		node.Labels = spotNodeInfos[0].Node.Labels
+	}
+	// Without a pod capacity no pod would fit on the node.
+	if _, found := allocatable[apiv1.ResourcePods]; !found {
+		pods := resource.NewQuantity(110, resource.DecimalSI)
+		node.Status.Capacity[apiv1.ResourcePods] = *pods
+		node.Status.Allocatable[apiv1.ResourcePods] = *pods
+	}
+
+	return &nodes.NodeInfo{
+		Node:    node,
+		Pods:    []*apiv1.Pod{},
+		FreeCPU: node.Status.Allocatable.Cpu().MilliValue(),
+	}
+}
+
+// Reads the JSON pod manifest at path, defaulting its namespace.
+func loadPod(path string) (*apiv1.Pod, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pod spec: %v", err)
+	}
+	pod := &apiv1.Pod{}
+	if err := json.Unmarshal(contents, pod); err != nil {
+		return nil, fmt.Errorf("invalid pod spec %s: %v", path, err)
+	}
+	if pod.Namespace == "" {
+		pod.Namespace = metav1.NamespaceDefault
+	}
+	return pod, nil
+}
+
+// Parses resource quantities given as flags, eg. cpu=4,memory=16Gi.
+func parseResourceList(values map[string]string) (apiv1.ResourceList, error) {
+	resources := apiv1.ResourceList{}
+	for name, value := range values {
+		quantity, err := resource.ParseQuantity(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid quantity %q for resource %s: %v", value, name, err)
+		}
+		resources[apiv1.ResourceName(name)] = quantity
+	}
+	return resources, nil
+}
+
+// Performs a drain on given node and updates the nextDrainTime variable.
+// Returns an error if the drain fails.
+func drainNode(ctx context.Context, kubeClient kube_client.Interface, recorder kube_record.EventRecorder, metricsRecorder *metrics.Recorder, node *apiv1.Node, pods []*apiv1.Pod, maxGracefulTermination int, podEvictionTimeout time.Duration, beforeEviction func(*apiv1.Pod) error, afterEviction func(*apiv1.Pod, error)) error {
+	opts := scaler.DrainOptions{
+		MaxGracefulTerminationSec: maxGracefulTermination,
+		MaxPodEvictionTime:        podEvictionTimeout,
+		WaitBetweenRetries:        scaler.EvictionRetryTime,
+		ReplicaEvictionDelay:      *replicaEvictionDelay,
+		OrderStatefulSets:         *orderStatefulSetEvictions,
+		BeforeEviction:            beforeEviction,
+		AfterEviction:             afterEviction,
+	}
+	err := scaler.DrainNode(ctx, node, pods, kubeClient, recorder, opts)
+	if err != nil {
+		metricsRecorder.UpdateNodeDrainCount("Failure", node.Name)
+		return err
+	}
+
+	metricsRecorder.UpdateNodeDrainCount("Success", node.Name)
+	return nil
+}
+
+// Adds the label and annotation, each in the form <name>=<value>, to a node
+// which has been fully drained. Empty ones are skipped.
+func markDrainedNode(ctx context.Context, kubeClient kube_client.Interface, node *apiv1.Node, label string, annotation string) error {
+	metadata := make(map[string]map[string]string)
+	if label != "" {
+		name, value := splitKeyValue(label)
+		metadata["labels"] = map[string]string{name: value}
+	}
+	if annotation != "" {
+		name, value := splitKeyValue(annotation)
+		metadata["annotations"] = map[string]string{name: value}
+	}
+	if len(metadata) == 0 {
+		return nil
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{"metadata": metadata})
+	if err != nil {
+		return err
+	}
+	_, err = kubeClient.CoreV1().Nodes().Patch(ctx, node.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
+
+// Annotations of the Event recorded for each move, detailing it.
+const (
+	moveSourceNodeAnnotation = "spot-rescheduler.pusher.com/source-node"
+	moveTargetNodeAnnotation = "spot-rescheduler.pusher.com/target-node"
+	moveCPUAnnotation        = "spot-rescheduler.pusher.com/cpu"
+	moveMemoryAnnotation     = "spot-rescheduler.pusher.com/memory"
+)
+
+// Records an Event on the pod moved off the from node onto the to node,
+// detailing the CPU and memory it uses according to the config, and so moved
+// between them.
+func recordMoveEvent(recorder kube_record.EventRecorder, config *nodes.Config, pod *apiv1.Pod, from string, to string) {
+	resources := config.PodResources(pod)
+	cpu := resource.NewMilliQuantity(resources[apiv1.ResourceCPU], resource.DecimalSI)
+	memory := resource.NewQuantity(resources[apiv1.ResourceMemory], resource.BinarySI)
+	annotations := map[string]string{
+		moveSourceNodeAnnotation: from,
+		moveTargetNodeAnnotation: to,
+		moveCPUAnnotation:        cpu.String(),
+		moveMemoryAnnotation:     memory.String(),
+	}
+	recorder.AnnotatedEventf(pod, annotations, apiv1.EventTypeNormal, "ReschedulerMoved",
+		"moved pod %s from %s to %s, requesting cpu %s and memory %s", podID(pod), from, to, cpu, memory)
+}
+
+// drainNotification is the JSON payload posted to the drain webhook once a
+// node has been fully drained.
+type drainNotification struct {
+	Node string   `json:"node"`
+	Pods []string `json:"pods"`
+}
+
+// Posts a drainNotification for the node and the pods moved off it to the
+// webhook at url.
+func notifyDrained(ctx context.Context, client *http.Client, url string, node *apiv1.Node, pods []*apiv1.Pod) error {
+	notification := drainNotification{
+		Node: node.Name,
+		Pods: make([]string, 0, len(pods)),
+	}
+	for _, pod := range pods {
+		notification.Pods = append(notification.Pods, podID(pod))
+	}
+	body, err := json.Marshal(notification)
+	if err != nil {
+		return fmt.Errorf("failed to encode notification: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with %s", resp.Status)
+	}
 	return nil
 }
+
+// Returns the set of the given values.
+func toSet(values []string) map[string]bool {
+	set := make(map[string]bool, len(values))
+	for _, value := range values {
+		set[value] = true
+	}
+	return set
+}
+
+// Splits <name>=<value> into its name and value, the value is empty if there
+// is no "=".
+func splitKeyValue(keyValue string) (string, string) {
+	split := strings.SplitN(keyValue, "=", 2)
+	if len(split) == 1 {
+		return split[0], ""
+	}
+	return split[0], split[1]
+}
+
+// Goes through a list of NodeInfos and updates the metrics system with the
+// number of pods that the rescheduler understands (So not daemonsets for
+// instance) that are on each of the nodes, labelling them as spot nodes.
+func updateSpotNodeMetrics(metricsRecorder *metrics.Recorder, spotNodeInfos nodes.NodeInfoArray, pdbs []*policyv1.PodDisruptionBudget, spotNodeLabel string) {
+	for _, nodeInfo := range spotNodeInfos {
+		// Get a list of pods that are on the node (Only the types considered by the rescheduler)
+		podsOnNode, _, err := autoscaler_drain.GetPodsForDeletionOnNodeDrain(nodeInfo.Pods, pdbs, *deleteNonReplicatedPods, false, false, nil, 0, time.Now())
+		if err != nil {
+			glog.Errorf("Failed to update metrics on spot node %s: %v", nodeInfo.Node.Name, err)
+			continue
+		}
+		metricsRecorder.UpdateNodePodsCount(spotNodeLabel, nodeInfo.Node.Name, len(podsOnNode))
+		metricsRecorder.UpdateNodeCPUUtilization(spotNodeLabel, nodeInfo.Node.Name, nodeInfo.RoundedCPUUtilization(*utilizationPrecision))
+
+	}
+}
+
+// Returns the pods Namespace/Name as a string
+func podID(pod *apiv1.Pod) string {
+	return fmt.Sprintf("%s/%s", pod.Namespace, pod.Name)
+}
+
+// Checks that the cordoned target policy is one of the known policies.
+func validateCordonedTargetPolicy(policy string) error {
+	switch policy {
+	case cordonedTargetIgnore, cordonedTargetReselect, cordonedTargetAbort:
+		return nil
+	}
+	return fmt.Errorf("unknown cordoned target policy %q", policy)
+}
@@ -17,15 +17,37 @@ limitations under the License.
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/pusher/k8s-spot-rescheduler/metrics"
 	"github.com/pusher/k8s-spot-rescheduler/nodes"
+	"github.com/pusher/k8s-spot-rescheduler/scaler"
 	"github.com/stretchr/testify/assert"
+	authorizationv1 "k8s.io/api/authorization/v1"
 	apiv1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1beta1"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/clock"
 	simulator "k8s.io/autoscaler/cluster-autoscaler/simulator"
+	kube_client "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	kube_restclient "k8s.io/client-go/rest"
+	core "k8s.io/client-go/testing"
+	kube_record "k8s.io/client-go/tools/record"
 )
 
 func _createSnapshot(nodes []*nodes.NodeInfo) simulator.ClusterSnapshot {
@@ -66,37 +88,76 @@ func TestFindSpotNodeForPod(t *testing.T) {
 	pod2 := createTestPod("pod2", 200)
 	pod3 := createTestPod("pod3", 700)
 	pod4 := createTestPod("pod4", 2200)
+	pod1.Spec.NodeName = "node4"
 
-	nodeName := findSpotNodeForPod(predicateChecker, snapshot, nodeInfos, pod1)
+	nodeName := findSpotNodeForPod(predicateChecker, snapshot, nodeInfos, pod1, nil)
 	assert.Equal(t, "node1", nodeName)
+	// The pod passed in is left untouched
+	assert.Equal(t, "node4", pod1.Spec.NodeName)
 
-	nodeName = findSpotNodeForPod(predicateChecker, snapshot, nodeInfos, pod2)
+	nodeName = findSpotNodeForPod(predicateChecker, snapshot, nodeInfos, pod2, nil)
 	assert.Equal(t, "node2", nodeName)
 
-	nodeName = findSpotNodeForPod(predicateChecker, snapshot, nodeInfos, pod3)
+	nodeName = findSpotNodeForPod(predicateChecker, snapshot, nodeInfos, pod3, nil)
 	assert.Equal(t, "node3", nodeName)
 
-	nodeName = findSpotNodeForPod(predicateChecker, snapshot, nodeInfos, pod4)
+	nodeName = findSpotNodeForPod(predicateChecker, snapshot, nodeInfos, pod4, nil)
 	assert.Equal(t, "", nodeName)
 
 }
 
-func TestNodeLabelValidation(t *testing.T) {
-	onDemandLabel := "foo.bar/role=worker"
-	spotLabel := "foo.bar/node-role"
+func TestComponentName(t *testing.T) {
+	assert.Equal(t, "rescheduler", componentName(""))
+	assert.Equal(t, "rescheduler-batch", componentName("batch"))
+}
 
-	err := validateArgs(onDemandLabel, spotLabel)
-	assert.NoError(t, err)
+func TestFindSpotNodeForPodNoExecuteToleration(t *testing.T) {
+	predicateChecker, _ := simulator.NewTestPredicateChecker()
+
+	taintedNode := createTestNode("node1", 2000)
+	taintedNode.Spec.Taints = []apiv1.Taint{
+		{
+			Key:    "spot",
+			Value:  "reclaiming",
+			Effect: apiv1.TaintEffectNoExecute,
+		},
+	}
+
+	nodeInfos := []*nodes.NodeInfo{
+		createTestNodeInfo(taintedNode, []*apiv1.Pod{}, 0),
+	}
+	snapshot := _createSnapshot(nodeInfos)
+
+	zero := int64(0)
+	briefPod := createTestPod("pod1", 100)
+	briefPod.Spec.Tolerations = []apiv1.Toleration{
+		{
+			Key:               "spot",
+			Operator:          apiv1.TolerationOpExists,
+			Effect:            apiv1.TaintEffectNoExecute,
+			TolerationSeconds: &zero,
+		},
+	}
+
+	toleratingPod := createTestPod("pod2", 100)
+	toleratingPod.Spec.Tolerations = []apiv1.Toleration{
+		{
+			Key:      "spot",
+			Operator: apiv1.TolerationOpExists,
+			Effect:   apiv1.TaintEffectNoExecute,
+		},
+	}
 
-	onDemandLabel = "foo.bar/broken=worker=true"
-	err = validateArgs(onDemandLabel, spotLabel)
-	assert.EqualError(t, err, "the on demand node label is not correctly formatted: expected '<label_name>' or '<label_name>=<label_value>', but got foo.bar/broken=worker=true")
+	rejections := make(Rejections)
 
-	onDemandLabel = "foo.bar/role=worker"
-	spotLabel = "foo.bar/node-role=spot=fail"
-	err = validateArgs(onDemandLabel, spotLabel)
-	assert.EqualError(t, err, "the spot node label is not correctly formatted: expected '<label_name>' or '<label_name>=<label_value>', but got foo.bar/node-role=spot=fail")
+	nodeName := findSpotNodeForPod(predicateChecker, snapshot, nodeInfos, briefPod, rejections)
+	assert.Equal(t, "", nodeName)
+	assert.Equal(t, 1, len(rejections["node1"]))
+	assert.Equal(t, TaintToleration, rejections["node1"][0].Reason)
 
+	nodeName = findSpotNodeForPod(predicateChecker, snapshot, nodeInfos, toleratingPod, rejections)
+	assert.Equal(t, "node1", nodeName)
+	assert.Equal(t, 1, len(rejections["node1"]))
 }
 
 func TestCanDrainNode(t *testing.T) {
@@ -139,17 +200,1903 @@ func TestCanDrainNode(t *testing.T) {
 
 	snapshot := _createSnapshot(spotNodeInfos)
 
-	err1 := canDrainNode(predicateChecker, snapshot, spotNodeInfos, podsForDeletion1)
+	err1 := canDrainNode(predicateChecker, snapshot, spotNodeInfos, podsForDeletion1, nil)
 	if err1 != nil {
 		assert.Fail(t, "canDrainNode should be successful with podsForDeletion1", "%v", err1)
 	}
 
-	err2 := canDrainNode(predicateChecker, snapshot, spotNodeInfos, podsForDeletion2)
+	err2 := canDrainNode(predicateChecker, snapshot, spotNodeInfos, podsForDeletion2, nil)
 	if err2 == nil {
 		assert.Fail(t, "canDrainNode should fail with podsForDeletion2, too much requested CPU.")
 	}
 }
 
+func TestCanDrainNodeRejections(t *testing.T) {
+	predicateChecker, _ := simulator.NewTestPredicateChecker()
+
+	spotNodeInfos := []*nodes.NodeInfo{
+		createTestNodeInfo(createTestNode("node1", 1000), []*apiv1.Pod{createTestPod("p1n1", 800)}, 800),
+		createTestNodeInfo(createTestNode("node2", 500), []*apiv1.Pod{}, 0),
+		createTestNodeInfo(createTestNode("node3", 2000), []*apiv1.Pod{}, 0),
+	}
+
+	podsForDeletion := []*apiv1.Pod{
+		createTestPod("pod1", 600),
+	}
+
+	snapshot := _createSnapshot(spotNodeInfos)
+	rejections := make(Rejections)
+
+	err := canDrainNode(predicateChecker, snapshot, spotNodeInfos, podsForDeletion, rejections)
+	assert.NoError(t, err)
+
+	// node1 and node2 are too full for pod1, node3 accepts it.
+	assert.Equal(t, 2, len(rejections))
+	assert.Equal(t, 1, len(rejections["node1"]))
+	assert.Equal(t, "kube-system/pod1", rejections["node1"][0].Pod)
+	assert.Equal(t, 1, len(rejections["node2"]))
+	assert.Equal(t, "kube-system/pod1", rejections["node2"][0].Pod)
+	assert.NotContains(t, rejections, "node3")
+}
+
+func TestTargetCheckerCordonedTarget(t *testing.T) {
+	predicateChecker, _ := simulator.NewTestPredicateChecker()
+
+	spot1 := createTestNode("spot1", 1000)
+	spot2 := createTestNode("spot2", 1000)
+	spotNodeInfos := nodes.NodeInfoArray{
+		createTestNodeInfo(spot1, []*apiv1.Pod{}, 0),
+		createTestNodeInfo(spot2, []*apiv1.Pod{}, 0),
+	}
+	pods := []*apiv1.Pod{
+		createTestPod("p1n1", 400),
+		createTestPod("p2n1", 400),
+	}
+
+	snapshot := _createSnapshot(spotNodeInfos)
+	plan, err := planDrain(predicateChecker, snapshot, spotNodeInfos, pods, nil, planOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, "spot1", plan[podID(pods[0])])
+	assert.Equal(t, "spot1", plan[podID(pods[1])])
+
+	// spot1 is cordoned once the drain has started
+	cordoned := spot1.DeepCopy()
+	cordoned.Spec.Unschedulable = true
+	checker := &targetChecker{
+		policy:           cordonedTargetReselect,
+		predicateChecker: predicateChecker,
+		spotSnapshot:     snapshot,
+		spotNodeInfos:    spotNodeInfos,
+		nodeLister:       fakeNodeLister{cordoned, spot2},
+		plan:             plan,
+	}
+
+	// Both pods are moved onto spot2 instead
+	assert.NoError(t, checker.check(pods[0]))
+	assert.NoError(t, checker.check(pods[1]))
+	assert.Equal(t, "spot2", plan[podID(pods[0])])
+	assert.Equal(t, "spot2", plan[podID(pods[1])])
+
+	// A pod which no longer fits anywhere has its move aborted
+	pod := createTestPod("p3n1", 400)
+	plan[podID(pod)] = "spot1"
+	snapshot.AddPod(pod, "spot1")
+	assert.Error(t, checker.check(pod))
+
+	// The abort policy never moves the pod elsewhere
+	checker.policy = cordonedTargetAbort
+	plan[podID(pods[0])] = "spot1"
+	assert.Error(t, checker.check(pods[0]))
+}
+
+func TestPlanDrainMaxPlacements(t *testing.T) {
+	predicateChecker, _ := simulator.NewTestPredicateChecker()
+
+	limitedNode := createTestNode("spot1", 4000)
+	limitedNode.Annotations = map[string]string{maxPlacementsAnnotation: "2"}
+	spotNodeInfos := nodes.NodeInfoArray{
+		createTestNodeInfo(limitedNode, []*apiv1.Pod{}, 0),
+		createTestNodeInfo(createTestNode("spot2", 4000), []*apiv1.Pod{}, 0),
+	}
+	pods := []*apiv1.Pod{
+		createTestPod("p1n1", 100),
+		createTestPod("p2n1", 100),
+		createTestPod("p3n1", 100),
+	}
+
+	rejections := make(Rejections)
+	plan, err := planDrain(predicateChecker, _createSnapshot(spotNodeInfos), spotNodeInfos, pods, rejections, planOptions{})
+	assert.NoError(t, err)
+
+	// Only two pods are placed on spot1 despite its capacity
+	assert.Equal(t, "spot1", plan[podID(pods[0])])
+	assert.Equal(t, "spot1", plan[podID(pods[1])])
+	assert.Equal(t, "spot2", plan[podID(pods[2])])
+	assert.Equal(t, []Rejection{
+		{Pod: "kube-system/p3n1", Reason: MaxPlacements, Detail: "already planned 2 of at most 2 pods"},
+	}, rejections["spot1"])
+
+	// Invalid limits are ignored
+	limitedNode.Annotations[maxPlacementsAnnotation] = "lots"
+	plan, err = planDrain(predicateChecker, _createSnapshot(spotNodeInfos), spotNodeInfos, pods, nil, planOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, "spot1", plan[podID(pods[2])])
+}
+
+func TestPlanDrainMaxPodsPerNode(t *testing.T) {
+	predicateChecker, _ := simulator.NewTestPredicateChecker()
+
+	spotPods := []*apiv1.Pod{createTestPod("p1", 100), createTestPod("p2", 100)}
+	spotNodeInfos := nodes.NodeInfoArray{
+		createTestNodeInfo(createTestNode("spot1", 4000), spotPods, 200),
+		createTestNodeInfo(createTestNode("spot2", 4000), []*apiv1.Pod{}, 0),
+	}
+	pods := []*apiv1.Pod{
+		createTestPod("p3", 100),
+		createTestPod("p4", 100),
+	}
+
+	// spot1 has plenty of free CPU but reaches the cap with the first pod
+	rejections := make(Rejections)
+	plan, err := planDrain(predicateChecker, _createSnapshot(spotNodeInfos), spotNodeInfos, pods, rejections, planOptions{maxPodsPerNode: 3})
+	assert.NoError(t, err)
+	assert.Equal(t, "spot1", plan[podID(pods[0])])
+	assert.Equal(t, "spot2", plan[podID(pods[1])])
+	assert.Equal(t, []Rejection{
+		{Pod: "kube-system/p4", Reason: MaxPodDensity, Detail: "already hosts 3 pods, the pod density cap"},
+	}, rejections["spot1"])
+	assert.Equal(t, "kube-system/p4: already hosts 3 pods, the pod density cap", rejections["spot1"][0].String())
+}
+
+func TestPlanDrainSpreadReplicas(t *testing.T) {
+	predicateChecker, _ := simulator.NewTestPredicateChecker()
+
+	spotNodeInfos := nodes.NodeInfoArray{
+		createTestNodeInfo(createTestNode("spot1", 4000), []*apiv1.Pod{}, 0),
+		createTestNodeInfo(createTestNode("spot2", 4000), []*apiv1.Pod{}, 0),
+	}
+	pods := []*apiv1.Pod{
+		createTestReplicatedPod("web-0", 100),
+		createTestReplicatedPod("web-1", 100),
+	}
+
+	// Both replicas are packed onto the first spot node
+	plan, err := planDrain(predicateChecker, _createSnapshot(spotNodeInfos), spotNodeInfos, pods, nil, planOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, "spot1", plan[podID(pods[0])])
+	assert.Equal(t, "spot1", plan[podID(pods[1])])
+
+	// Or spread across both
+	plan, err = planDrain(predicateChecker, _createSnapshot(spotNodeInfos), spotNodeInfos, pods, nil, planOptions{spread: true})
+	assert.NoError(t, err)
+	assert.Equal(t, "spot1", plan[podID(pods[0])])
+	assert.Equal(t, "spot2", plan[podID(pods[1])])
+
+	// Unless the other spot node can't fit the pod
+	spotNodeInfos[1] = createTestNodeInfo(createTestNode("spot2", 50), []*apiv1.Pod{}, 0)
+	plan, err = planDrain(predicateChecker, _createSnapshot(spotNodeInfos), spotNodeInfos, pods, nil, planOptions{spread: true})
+	assert.NoError(t, err)
+	assert.Equal(t, "spot1", plan[podID(pods[1])])
+}
+
+func TestPlanDrainUnplaceablePodReasons(t *testing.T) {
+	predicateChecker, _ := simulator.NewTestPredicateChecker()
+
+	limitedNode := createTestNode("spot1", 4000)
+	limitedNode.Annotations = map[string]string{maxPlacementsAnnotation: "0"}
+	spotNodeInfos := nodes.NodeInfoArray{
+		createTestNodeInfo(limitedNode, []*apiv1.Pod{}, 0),
+		createTestNodeInfo(createTestNode("spot2", 500), []*apiv1.Pod{}, 0),
+	}
+	pods := []*apiv1.Pod{
+		createTestPod("p1n1", 1000),
+	}
+
+	_, err := planDrain(predicateChecker, _createSnapshot(spotNodeInfos), spotNodeInfos, pods, nil, planOptions{})
+	unplaceable, ok := err.(*unplaceablePodError)
+	assert.True(t, ok)
+	assert.Contains(t, unplaceable.reasons, metrics.UnmovableReasonMaxPlacements)
+	for _, reason := range unplaceable.reasons {
+		assert.Contains(t, metrics.UnmovableReasons, reason)
+	}
+
+	assert.Equal(t, UnmovableReason("NodeAffinity"), predicateReason("NodeAffinity predicate mismatch"))
+	assert.Equal(t, UnmovableReason(metrics.UnmovableReasonOther), predicateReason("something else"))
+}
+
+func TestAdditionalDrainableNodes(t *testing.T) {
+	predicateChecker, _ := simulator.NewTestPredicateChecker()
+
+	spotNodeInfos := nodes.NodeInfoArray{
+		createTestNodeInfo(createTestNode("spot1", 1000), []*apiv1.Pod{}, 0),
+	}
+
+	candidates := []drainCandidate{
+		{
+			nodeInfo: createTestNodeInfo(createTestNode("node1", 2000), []*apiv1.Pod{}, 600),
+			pods:     []*apiv1.Pod{createTestPod("p1n1", 600)},
+		},
+		{
+			nodeInfo: createTestNodeInfo(createTestNode("node2", 2000), []*apiv1.Pod{}, 700),
+			pods:     []*apiv1.Pod{createTestPod("p1n2", 700)},
+		},
+		{
+			nodeInfo: createTestNodeInfo(createTestNode("node3", 2000), []*apiv1.Pod{}, 1500),
+			pods:     []*apiv1.Pod{createTestPod("p1n3", 1500)},
+		},
+	}
+
+	// Only node1 fits onto the existing spot node.
+	assert.Equal(t, 1, countDrainableNodes(predicateChecker, spotNodeInfos, candidates))
+
+	allocatable := apiv1.ResourceList{
+		apiv1.ResourceCPU:    *resource.NewMilliQuantity(1000, resource.DecimalSI),
+		apiv1.ResourceMemory: *resource.NewQuantity(2*1024*1024*1024, resource.DecimalSI),
+	}
+	// A second small spot node would take node2's pod as well.
+	assert.Equal(t, 1, additionalDrainableNodes(predicateChecker, spotNodeInfos, candidates, allocatable))
+
+	allocatable[apiv1.ResourceCPU] = *resource.NewMilliQuantity(2500, resource.DecimalSI)
+	// A bigger one would take both node2 and node3's pods.
+	assert.Equal(t, 2, additionalDrainableNodes(predicateChecker, spotNodeInfos, candidates, allocatable))
+
+	// The existing spot nodes are left untouched.
+	assert.Equal(t, 1, len(spotNodeInfos))
+}
+
+func TestDrainabilityScore(t *testing.T) {
+	predicateChecker, _ := simulator.NewTestPredicateChecker()
+
+	spotNodeInfos := nodes.NodeInfoArray{
+		createTestNodeInfo(createTestNode("spot1", 1000), []*apiv1.Pod{createTestPod("p1s1", 500)}, 500),
+	}
+	snapshot := spotNodeInfos.GetClusterSnapshot()
+
+	// Only one of the two pods fits in the remaining 500m
+	pods := []*apiv1.Pod{
+		createTestPod("p1n1", 400),
+		createTestPod("p2n1", 400),
+	}
+	assert.Equal(t, 0.5, drainabilityScore(nodes.NewConfig(), predicateChecker, snapshot, spotNodeInfos, pods))
+
+	// The snapshot is left untouched so both fit once the other is gone
+	pods = []*apiv1.Pod{
+		createTestPod("p1n2", 400),
+	}
+	assert.Equal(t, float64(1), drainabilityScore(nodes.NewConfig(), predicateChecker, snapshot, spotNodeInfos, pods))
+
+	pods = []*apiv1.Pod{
+		createTestPod("p1n3", 600),
+	}
+	assert.Equal(t, float64(0), drainabilityScore(nodes.NewConfig(), predicateChecker, snapshot, spotNodeInfos, pods))
+
+	// The CPU is weighed the way the config's extractor accounts for it
+	config := nodes.NewConfig()
+	config.ResourceExtractor = nodes.ResourceExtractorFunc(func(pod *apiv1.Pod) map[apiv1.ResourceName]int64 {
+		if pod.Name == "p1n4" {
+			return map[apiv1.ResourceName]int64{apiv1.ResourceCPU: 100}
+		}
+		return map[apiv1.ResourceName]int64{apiv1.ResourceCPU: 300}
+	})
+	pods = []*apiv1.Pod{
+		createTestPod("p1n4", 400),
+		createTestPod("p2n4", 400),
+	}
+	assert.Equal(t, 0.25, drainabilityScore(config, predicateChecker, snapshot, spotNodeInfos, pods))
+}
+
+func TestMinOnDemandNodes(t *testing.T) {
+	onDemandNodeInfos := nodes.NodeInfoArray{
+		createTestNodeInfo(createTestNode("node1", 1000), []*apiv1.Pod{}, 0),
+		createTestNodeInfo(createTestNode("node2", 2000), []*apiv1.Pod{}, 0),
+	}
+	pods := []*apiv1.Pod{
+		createTestPod("p1", 400),
+		createTestPod("p2", 1500),
+		createTestPod("p3", 700),
+		createTestPod("p4", 500),
+		createTestPod("p5", 800),
+	}
+
+	// 1500 and 500 fill the 2000 node, 800 goes on the 1000 node and 700 and
+	// 400 need another node the size of the largest.
+	assert.Equal(t, 3, minOnDemandNodes(nodes.NewConfig(), onDemandNodeInfos, pods))
+
+	// Everything fits on the largest node
+	assert.Equal(t, 1, minOnDemandNodes(nodes.NewConfig(), onDemandNodeInfos, pods[:2]))
+
+	assert.Equal(t, 0, minOnDemandNodes(nodes.NewConfig(), onDemandNodeInfos, []*apiv1.Pod{}))
+}
+
+func TestParseResourceList(t *testing.T) {
+	resources, err := parseResourceList(map[string]string{"cpu": "4", "memory": "16Gi"})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(4000), resources.Cpu().MilliValue())
+	assert.Equal(t, int64(16*1024*1024*1024), resources.Memory().Value())
+
+	_, err = parseResourceList(map[string]string{"cpu": "four"})
+	assert.Error(t, err)
+}
+
+func TestReconcileWarmUp(t *testing.T) {
+	onDemandNode := createTestNodeWithLabel("node1", 2000, map[string]string{"kubernetes.io/role": "worker"})
+	spotNode := createTestNodeWithLabel("node2", 2000, map[string]string{"kubernetes.io/role": "spot-worker"})
+
+	podsOnNodes := map[string][]*apiv1.Pod{
+		"node1": {createTestReplicatedPod("p1n1", 300)},
+		"node2": {},
+	}
+
+	r, fakeClient := createTestRescheduler(t, []*apiv1.Node{onDemandNode, spotNode}, podsOnNodes)
+	r.warmUpUntil = time.Now().Add(time.Hour)
+
+	result := r.Reconcile(context.Background())
+	assert.True(t, result.WarmingUp)
+	assert.Equal(t, "", result.DrainedNode)
+	assert.Equal(t, 0, len(evictionActions(fakeClient)), "no pods should be evicted during warm-up")
+
+	// Unsynced caches also keep the rescheduler warming up.
+	r.warmUpUntil = time.Time{}
+	r.cachesSynced = append(r.cachesSynced, func() bool { return false })
+
+	result = r.Reconcile(context.Background())
+	assert.True(t, result.WarmingUp)
+	assert.Equal(t, 0, len(evictionActions(fakeClient)), "no pods should be evicted before caches sync")
+}
+
+func TestReconcileUnmovablePods(t *testing.T) {
+	crashLoop := func(pod *apiv1.Pod) {
+		pod.Status.ContainerStatuses = []apiv1.ContainerStatus{
+			{
+				State: apiv1.ContainerState{
+					Waiting: &apiv1.ContainerStateWaiting{Reason: "CrashLoopBackOff"},
+				},
+			},
+		}
+	}
+	crashLoopingPod := createTestReplicatedPod("p1n1", 300)
+	crashLoop(crashLoopingPod)
+	assert.True(t, isCrashLooping(crashLoopingPod))
+	assert.False(t, isCrashLooping(createTestReplicatedPod("p2n1", 300)))
+
+	for _, test := range []struct {
+		reason UnmovableReason
+		// pod makes the pod unmovable for the reason
+		pod func(pod *apiv1.Pod)
+		// configure sets the rescheduler up to notice the reason, if needed
+		configure func(r *rescheduler)
+	}{
+		{
+			reason:    CrashLoopBackOff,
+			pod:       crashLoop,
+			configure: func(r *rescheduler) { r.skipCrashLoopingPods = true },
+		},
+		{
+			reason:    ExcludedNamespace,
+			pod:       func(pod *apiv1.Pod) { pod.Namespace = "monitoring" },
+			configure: func(r *rescheduler) { r.nodeConfig.ExcludedNamespaces = map[string]bool{"monitoring": true} },
+		},
+		{
+			reason: ReschedulingDisabled,
+			pod: func(pod *apiv1.Pod) {
+				pod.Annotations = map[string]string{nodes.DefaultReschedulingAnnotation: "false"}
+			},
+		},
+		{
+			reason: LocalStorage,
+			pod: func(pod *apiv1.Pod) {
+				pod.Spec.Volumes = []apiv1.Volume{
+					{Name: "cache", VolumeSource: apiv1.VolumeSource{EmptyDir: &apiv1.EmptyDirVolumeSource{}}},
+				}
+			},
+			configure: func(r *rescheduler) { r.nodeConfig.ProtectLocalStoragePods = true },
+		},
+	} {
+		t.Run(string(test.reason), func(t *testing.T) {
+			onDemandNode := createTestNodeWithLabel("node1", 2000, map[string]string{"kubernetes.io/role": "worker"})
+			spotNode := createTestNodeWithLabel("node2", 2000, map[string]string{"kubernetes.io/role": "spot-worker"})
+
+			unmovablePod := createTestReplicatedPod("p1n1", 300)
+			test.pod(unmovablePod)
+			podsOnNodes := map[string][]*apiv1.Pod{
+				"node1": {unmovablePod, createTestReplicatedPod("p2n1", 300)},
+				"node2": {},
+			}
+
+			r, fakeClient := createTestRescheduler(t, []*apiv1.Node{onDemandNode, spotNode}, podsOnNodes)
+			if test.configure != nil {
+				test.configure(r)
+			}
+
+			// The node can't be drained while the pod is on it
+			result := r.Reconcile(context.Background())
+			assert.Equal(t, "", result.DrainedNode)
+			assert.Equal(t, map[string]UnmovableReason{podID(unmovablePod): test.reason}, result.UnmovablePods)
+			assert.Equal(t, 0, len(evictionActions(fakeClient)))
+		})
+	}
+}
+
+func TestReconcileProtectsLastReadyReplica(t *testing.T) {
+	onDemandNode := createTestNodeWithLabel("node1", 2000, map[string]string{"kubernetes.io/role": "worker"})
+	spotNode := createTestNodeWithLabel("node2", 2000, map[string]string{"kubernetes.io/role": "spot-worker"})
+
+	// A single replica Deployment without a PodDisruptionBudget
+	pod := createTestReplicatedPod("p1n1", 300)
+	pod.Status.Conditions = []apiv1.PodCondition{
+		{Type: apiv1.PodReady, Status: apiv1.ConditionTrue},
+	}
+	podsOnNodes := map[string][]*apiv1.Pod{
+		"node1": {pod},
+		"node2": {},
+	}
+
+	r, fakeClient := createTestRescheduler(t, []*apiv1.Node{onDemandNode, spotNode}, podsOnNodes)
+	acceptEvictions(fakeClient)
+	r.protectLastReadyReplica = true
+
+	result := r.Reconcile(context.Background())
+	assert.Equal(t, "", result.DrainedNode)
+	assert.Equal(t, map[string]UnmovableReason{"default/p1n1": LastReadyReplica}, result.UnmovablePods)
+	assert.Equal(t, 0, len(evictionActions(fakeClient)))
+
+	// Once another replica is Ready the pod can be moved
+	replica := createTestReplicatedPod("p1n2", 300)
+	replica.Status.Conditions = pod.Status.Conditions
+	podsOnNodes["node2"] = []*apiv1.Pod{replica}
+	result = r.Reconcile(context.Background())
+	assert.Equal(t, "node1", result.DrainedNode)
+	assert.Equal(t, []string{"p1n1"}, evictionActions(fakeClient))
+}
+
+func TestReconcileMarksDrainedNode(t *testing.T) {
+	onDemandNode := createTestNodeWithLabel("node1", 2000, map[string]string{"kubernetes.io/role": "worker"})
+	spotNode := createTestNodeWithLabel("node2", 2000, map[string]string{"kubernetes.io/role": "spot-worker"})
+
+	podsOnNodes := map[string][]*apiv1.Pod{
+		"node1": {createTestReplicatedPod("p1n1", 300)},
+		"node2": {},
+	}
+
+	r, fakeClient := createTestRescheduler(t, []*apiv1.Node{onDemandNode, spotNode}, podsOnNodes)
+	acceptEvictions(fakeClient)
+	r.drainedNodeLabel = "example.com/drained=true"
+	r.drainedNodeAnnotation = "example.com/drained-by=rescheduler"
+
+	result := r.Reconcile(context.Background())
+	assert.Equal(t, "node1", result.DrainedNode)
+	assert.Equal(t, []string{"p1n1"}, evictionActions(fakeClient))
+
+	node, err := fakeClient.CoreV1().Nodes().Get(context.Background(), "node1", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, "true", node.Labels["example.com/drained"])
+	assert.Equal(t, "worker", node.Labels["kubernetes.io/role"])
+	assert.Equal(t, "rescheduler", node.Annotations["example.com/drained-by"])
+
+	// The spot node is left alone
+	node, err = fakeClient.CoreV1().Nodes().Get(context.Background(), "node2", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.NotContains(t, node.Labels, "example.com/drained")
+}
+
+func TestReconcileSkipsPodsRequestingUnadvertisedResources(t *testing.T) {
+	onDemandNode := createTestNodeWithLabel("node1", 2000, map[string]string{"kubernetes.io/role": "worker"})
+	onDemandNode.Status.Allocatable["example.com/device"] = *resource.NewQuantity(1, resource.DecimalSI)
+	spotNode := createTestNodeWithLabel("node2", 2000, map[string]string{"kubernetes.io/role": "spot-worker"})
+
+	devicePod := createTestReplicatedPod("p1n1", 300)
+	devicePod.Spec.Containers[0].Resources.Limits = apiv1.ResourceList{
+		"example.com/device": *resource.NewQuantity(1, resource.DecimalSI),
+	}
+
+	podsOnNodes := map[string][]*apiv1.Pod{
+		"node1": {devicePod, createTestReplicatedPod("p2n1", 300)},
+		"node2": {},
+	}
+
+	r, fakeClient := createTestRescheduler(t, []*apiv1.Node{onDemandNode, spotNode}, podsOnNodes)
+	acceptEvictions(fakeClient)
+
+	result := r.Reconcile(context.Background())
+	assert.Equal(t, "", result.DrainedNode)
+	assert.Equal(t, map[string]UnmovableReason{"default/p1n1": UnadvertisedResource}, result.UnmovablePods)
+	assert.Empty(t, result.Rejections, "no placement should be attempted")
+	assert.Equal(t, 0, len(evictionActions(fakeClient)))
+}
+
+func TestReconcileMaxEvictionsPerNodePerRun(t *testing.T) {
+	onDemandNode := createTestNodeWithLabel("node1", 2000, map[string]string{"kubernetes.io/role": "worker"})
+	spotNode := createTestNodeWithLabel("node2", 2000, map[string]string{"kubernetes.io/role": "spot-worker"})
+
+	podsOnNodes := map[string][]*apiv1.Pod{
+		"node1": {
+			createTestReplicatedPod("p1n1", 500),
+			createTestReplicatedPod("p2n1", 400),
+			createTestReplicatedPod("p3n1", 300),
+		},
+		"node2": {},
+	}
+
+	r, fakeClient := createTestRescheduler(t, []*apiv1.Node{onDemandNode, spotNode}, podsOnNodes)
+	acceptEvictions(fakeClient)
+	r.maxEvictionsPerNodePerRun = 2
+
+	result := r.Reconcile(context.Background())
+	assert.Equal(t, "node1", result.DrainedNode)
+	assert.True(t, result.PartialDrain)
+	assert.Equal(t, 2, result.MovedPods)
+	// Pods are moved biggest first
+	assert.ElementsMatch(t, []string{"p1n1", "p2n1"}, evictionActions(fakeClient))
+
+	// The rest of the node is drained in the next pass
+	podsOnNodes["node1"] = podsOnNodes["node1"][2:]
+	result = r.Reconcile(context.Background())
+	assert.Equal(t, "node1", result.DrainedNode)
+	assert.False(t, result.PartialDrain)
+	assert.Equal(t, 1, result.MovedPods)
+	assert.ElementsMatch(t, []string{"p1n1", "p2n1", "p3n1"}, evictionActions(fakeClient))
+}
+
+func TestReconcileConsolidationEfficiency(t *testing.T) {
+	onDemandNode := createTestNodeWithLabel("node1", 2000, map[string]string{"kubernetes.io/role": "worker"})
+	spotNode := createTestNodeWithLabel("node2", 2000, map[string]string{"kubernetes.io/role": "spot-worker"})
+
+	podsOnNodes := map[string][]*apiv1.Pod{
+		"node1": {
+			createTestReplicatedPod("p1n1", 300),
+			createTestReplicatedPod("p2n1", 200),
+		},
+		"node2": {},
+	}
+
+	r, fakeClient := createTestRescheduler(t, []*apiv1.Node{onDemandNode, spotNode}, podsOnNodes)
+	acceptEvictions(fakeClient)
+
+	// Moving 500m frees the whole 2000m node
+	result := r.Reconcile(context.Background())
+	assert.Equal(t, "node1", result.DrainedNode)
+	assert.Equal(t, int64(500), result.MovedCPU)
+	assert.Equal(t, int64(2000), result.FreedCPU)
+	assert.Equal(t, float64(4), result.Efficiency())
+
+	// Nothing is freed by a partial drain
+	assert.Equal(t, float64(0), Result{MovedCPU: 500}.Efficiency())
+	assert.Equal(t, float64(0), Result{}.Efficiency())
+}
+
+// timerClock is a fake clock reporting the duration of every timer started on
+// it, so that tests only step it once the debouncer has caught up.
+type timerClock struct {
+	*clock.FakeClock
+	timers chan time.Duration
+}
+
+func newTimerClock() timerClock {
+	return timerClock{clock.NewFakeClock(time.Now()), make(chan time.Duration)}
+}
+
+func (c timerClock) NewTimer(d time.Duration) clock.Timer {
+	timer := c.FakeClock.NewTimer(d)
+	c.timers <- d
+	return timer
+}
+
+// Waits for the debounced function to run once.
+func waitForRun(t *testing.T, runs <-chan struct{}) {
+	select {
+	case <-runs:
+	case <-time.After(time.Second):
+		t.Fatal("expected the debounced function to run")
+	}
+}
+
+func TestDebouncer(t *testing.T) {
+	fakeClock := newTimerClock()
+	d := newDebouncer(fakeClock, 100*time.Millisecond, time.Second)
+	runs := make(chan struct{}, 10)
+	stop := make(chan struct{})
+	defer close(stop)
+	go d.Run(stop, func() { runs <- struct{}{} })
+
+	// A burst of events only runs the function once it's over
+	for i := 0; i < 5; i++ {
+		d.Trigger()
+		assert.Equal(t, 100*time.Millisecond, <-fakeClock.timers)
+		fakeClock.Step(50 * time.Millisecond)
+	}
+	assert.Equal(t, 0, len(runs))
+
+	fakeClock.Step(50 * time.Millisecond)
+	waitForRun(t, runs)
+
+	// Later events run it again
+	d.Trigger()
+	assert.Equal(t, 100*time.Millisecond, <-fakeClock.timers)
+	fakeClock.Step(100 * time.Millisecond)
+	waitForRun(t, runs)
+	assert.Equal(t, 0, len(runs))
+}
+
+func TestDebouncerMaxWait(t *testing.T) {
+	fakeClock := newTimerClock()
+	d := newDebouncer(fakeClock, 100*time.Millisecond, 200*time.Millisecond)
+	runs := make(chan struct{}, 10)
+	stop := make(chan struct{})
+	defer close(stop)
+	go d.Run(stop, func() { runs <- struct{}{} })
+
+	// A steady stream of events never goes quiet, but the waits shrink so
+	// that the function still runs once the maximum wait is up
+	for _, wait := range []time.Duration{100, 100, 80, 20} {
+		d.Trigger()
+		assert.Equal(t, wait*time.Millisecond, <-fakeClock.timers)
+		assert.Equal(t, 0, len(runs))
+		fakeClock.Step(60 * time.Millisecond)
+	}
+	waitForRun(t, runs)
+
+	// The next burst gets a maximum wait of its own
+	d.Trigger()
+	assert.Equal(t, 100*time.Millisecond, <-fakeClock.timers)
+}
+
+func TestReconcileScopes(t *testing.T) {
+	// Two scopes managing disjoint sets of nodes within the same cluster,
+	// with their metrics scraped from the same registry.
+	allNodes := []*apiv1.Node{
+		createTestNodeWithLabel("node1", 2000, map[string]string{"pool": "a-on-demand"}),
+		createTestNodeWithLabel("node2", 2000, map[string]string{"pool": "a-spot"}),
+		createTestNodeWithLabel("node3", 2000, map[string]string{"pool": "b-on-demand"}),
+		createTestNodeWithLabel("node4", 2000, map[string]string{"pool": "b-spot"}),
+	}
+	podsOnNodes := map[string][]*apiv1.Pod{
+		"node1": {createTestReplicatedPod("a-0", 300), createTestReplicatedPod("a-1", 300)},
+		"node2": {},
+		"node3": {createTestReplicatedPod("b-0", 300)},
+		"node4": {},
+	}
+	registry := prometheus.NewRegistry()
+
+	newScope := func(scope string, onDemandLabel string, spotLabel string) (*rescheduler, *fake.Clientset) {
+		r, fakeClient := createTestRescheduler(t, allNodes, podsOnNodes)
+		acceptEvictions(fakeClient)
+		r.metrics = metrics.NewRecorder(scope, registry)
+		r.nodeConfig.OnDemandNodeLabels = []string{onDemandLabel}
+		r.nodeConfig.SpotNodeLabels = []string{spotLabel}
+		return r, fakeClient
+	}
+	poolA, clientA := newScope("pool-a", "pool=a-on-demand", "pool=a-spot")
+	poolB, clientB := newScope("pool-b", "pool=b-on-demand", "pool=b-spot")
+
+	assert.Equal(t, "node1", poolA.Reconcile(context.Background()).DrainedNode)
+	assert.ElementsMatch(t, []string{"a-0", "a-1"}, evictionActions(clientA))
+	assert.Equal(t, "node3", poolB.Reconcile(context.Background()).DrainedNode)
+	assert.ElementsMatch(t, []string{"b-0"}, evictionActions(clientB))
+
+	expected := `
+# HELP spot_rescheduler_pool_a_evicted_pods_total Number of pods evicted by the rescheduler.
+# TYPE spot_rescheduler_pool_a_evicted_pods_total counter
+spot_rescheduler_pool_a_evicted_pods_total 2
+# HELP spot_rescheduler_pool_b_evicted_pods_total Number of pods evicted by the rescheduler.
+# TYPE spot_rescheduler_pool_b_evicted_pods_total counter
+spot_rescheduler_pool_b_evicted_pods_total 1
+`
+	assert.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(expected),
+		"spot_rescheduler_pool_a_evicted_pods_total", "spot_rescheduler_pool_b_evicted_pods_total"))
+}
+
+func TestReconcileMoveCooldown(t *testing.T) {
+	onDemandNode := createTestNodeWithLabel("node1", 2000, map[string]string{"kubernetes.io/role": "worker"})
+	spotNode := createTestNodeWithLabel("node2", 2000, map[string]string{"kubernetes.io/role": "spot-worker"})
+
+	podsOnNodes := map[string][]*apiv1.Pod{
+		"node1": {createTestReplicatedPod("web-0", 300)},
+		"node2": {},
+	}
+
+	r, fakeClient := createTestRescheduler(t, []*apiv1.Node{onDemandNode, spotNode}, podsOnNodes)
+	acceptEvictions(fakeClient)
+	fakeClock := clock.NewFakeClock(time.Now())
+	r.recentMoves = recentMoves{clock: fakeClock, cooldown: 10 * time.Minute}
+
+	result := r.Reconcile(context.Background())
+	assert.Equal(t, "node1", result.DrainedNode)
+
+	// The pod comes back onto the on-demand node straight away
+	r.nextDrainTime = time.Now()
+	result = r.Reconcile(context.Background())
+	assert.Equal(t, "", result.DrainedNode)
+	assert.Equal(t, map[string]UnmovableReason{"default/web-0": RecentlyMoved}, result.UnmovablePods)
+	assert.Equal(t, []string{"web-0"}, evictionActions(fakeClient))
+
+	// It can be moved again once the cooldown has passed
+	fakeClock.Step(10 * time.Minute)
+	r.nextDrainTime = time.Now()
+	result = r.Reconcile(context.Background())
+	assert.Equal(t, "node1", result.DrainedNode)
+	assert.Equal(t, []string{"web-0", "web-0"}, evictionActions(fakeClient))
+}
+
+func TestReconcileMoveCooldownReplacements(t *testing.T) {
+	onDemandNode1 := createTestNodeWithLabel("node1", 2000, map[string]string{"kubernetes.io/role": "worker"})
+	onDemandNode2 := createTestNodeWithLabel("node2", 2000, map[string]string{"kubernetes.io/role": "worker"})
+	spotNode := createTestNodeWithLabel("node3", 4000, map[string]string{"kubernetes.io/role": "spot-worker"})
+
+	fakeClock := clock.NewFakeClock(time.Now())
+	olderReplica := createTestReplicatedPod("web-older", 500)
+	olderReplica.CreationTimestamp = metav1.NewTime(fakeClock.Now().Add(-time.Hour))
+	podsOnNodes := map[string][]*apiv1.Pod{
+		"node1": {createTestReplicatedPod("web-abcde", 300)},
+		"node2": {olderReplica},
+		"node3": {},
+	}
+
+	r, fakeClient := createTestRescheduler(t, []*apiv1.Node{onDemandNode1, onDemandNode2, spotNode}, podsOnNodes)
+	acceptEvictions(fakeClient)
+	r.recentMoves = recentMoves{clock: fakeClock, cooldown: 10 * time.Minute}
+
+	result := r.Reconcile(context.Background())
+	assert.Equal(t, "node1", result.DrainedNode)
+
+	// The ReplicaSet replaces the pod under a new name straight away, its
+	// older replicas can still be moved
+	replacement := createTestReplicatedPod("web-fghij", 300)
+	replacement.CreationTimestamp = metav1.NewTime(fakeClock.Now())
+	podsOnNodes["node1"] = []*apiv1.Pod{replacement}
+	r.nextDrainTime = time.Now()
+	result = r.Reconcile(context.Background())
+	assert.Equal(t, "node2", result.DrainedNode)
+	assert.Equal(t, map[string]UnmovableReason{"default/web-fghij": RecentlyMoved}, result.UnmovablePods)
+	assert.Equal(t, []string{"web-abcde", "web-older"}, evictionActions(fakeClient))
+
+	// The replacement can be moved once the cooldown has passed
+	fakeClock.Step(10 * time.Minute)
+	podsOnNodes["node2"] = []*apiv1.Pod{}
+	r.nextDrainTime = time.Now()
+	result = r.Reconcile(context.Background())
+	assert.Equal(t, "node1", result.DrainedNode)
+	assert.Equal(t, []string{"web-abcde", "web-older", "web-fghij"}, evictionActions(fakeClient))
+}
+
+func TestReconcileZeroAllocatableCPU(t *testing.T) {
+	initializingOnDemandNode := createTestNodeWithLabel("node1", 0, map[string]string{"kubernetes.io/role": "worker"})
+	onDemandNode := createTestNodeWithLabel("node2", 2000, map[string]string{"kubernetes.io/role": "worker"})
+	initializingSpotNode := createTestNodeWithLabel("node3", 0, map[string]string{"kubernetes.io/role": "spot-worker"})
+	spotNode := createTestNodeWithLabel("node4", 2000, map[string]string{"kubernetes.io/role": "spot-worker"})
+
+	podsOnNodes := map[string][]*apiv1.Pod{
+		"node1": {createTestPod("p1", 100)},
+		"node2": {createTestPod("p2", 300)},
+		"node3": {},
+		"node4": {},
+	}
+
+	r, fakeClient := createTestRescheduler(t, []*apiv1.Node{initializingOnDemandNode, onDemandNode, initializingSpotNode, spotNode}, podsOnNodes)
+	acceptEvictions(fakeClient)
+
+	// The emptiest on-demand node isn't drained and nothing is planned onto
+	// the initializing spot node
+	result := r.Reconcile(context.Background())
+	assert.Equal(t, "node2", result.DrainedNode)
+	assert.Equal(t, []string{"p2"}, evictionActions(fakeClient))
+	assert.NotContains(t, result.Rejections, "node3")
+}
+
+func TestReconcileMoveEvents(t *testing.T) {
+	onDemandNode := createTestNodeWithLabel("node1", 2000, map[string]string{"kubernetes.io/role": "worker"})
+	spotNode := createTestNodeWithLabel("node2", 2000, map[string]string{"kubernetes.io/role": "spot-worker"})
+
+	pod := createTestPod("p1", 300)
+	pod.Spec.Containers[0].Resources.Requests[apiv1.ResourceMemory] = resource.MustParse("256Mi")
+	pod.Spec.Overhead = apiv1.ResourceList{apiv1.ResourceCPU: resource.MustParse("50m")}
+	podsOnNodes := map[string][]*apiv1.Pod{
+		"node1": {pod},
+		"node2": {},
+	}
+
+	r, fakeClient := createTestRescheduler(t, []*apiv1.Node{onDemandNode, spotNode}, podsOnNodes)
+	acceptEvictions(fakeClient)
+	recorder := kube_record.NewFakeRecorder(100)
+	r.recorder = recorder
+	r.moveEvents = true
+
+	result := r.Reconcile(context.Background())
+	assert.Equal(t, "node1", result.DrainedNode)
+
+	// The pod's overhead is moved along with it
+	moves := make([]string, 0)
+	for len(recorder.Events) > 0 {
+		if event := <-recorder.Events; strings.HasPrefix(event, "Normal ReschedulerMoved ") {
+			moves = append(moves, event)
+		}
+	}
+	assert.Equal(t, []string{"Normal ReschedulerMoved moved pod kube-system/p1 from node1 to node2, requesting cpu 350m and memory 256Mi"}, moves)
+}
+
+func TestReconcileMinOnDemandNodes(t *testing.T) {
+	onDemandNode1 := createTestNodeWithLabel("node1", 2000, map[string]string{"kubernetes.io/role": "worker"})
+	onDemandNode2 := createTestNodeWithLabel("node2", 2000, map[string]string{"kubernetes.io/role": "worker"})
+	spotNode := createTestNodeWithLabel("node3", 4000, map[string]string{"kubernetes.io/role": "spot-worker"})
+
+	podsOnNodes := map[string][]*apiv1.Pod{
+		"node1": {createTestReplicatedPod("p1n1", 300)},
+		"node2": {createTestReplicatedPod("p1n2", 500)},
+		"node3": {},
+	}
+
+	r, fakeClient := createTestRescheduler(t, []*apiv1.Node{onDemandNode1, onDemandNode2, spotNode}, podsOnNodes)
+	acceptEvictions(fakeClient)
+	r.minOnDemandNodes = 1
+
+	// Both nodes could be drained, but only the emptiest is
+	result := r.Reconcile(context.Background())
+	assert.Equal(t, "node1", result.DrainedNode)
+
+	podsOnNodes["node3"] = podsOnNodes["node1"]
+	podsOnNodes["node1"] = []*apiv1.Pod{}
+	r.nextDrainTime = time.Now()
+	result = r.Reconcile(context.Background())
+	assert.Equal(t, "", result.DrainedNode)
+	assert.Equal(t, []string{"p1n1"}, evictionActions(fakeClient))
+}
+
+func TestReconcileMinOnDemandNodesMultipleDrains(t *testing.T) {
+	for _, optimizeDrains := range []bool{false, true} {
+		allNodes := []*apiv1.Node{
+			createTestNodeWithLabel("node1", 2000, map[string]string{"kubernetes.io/role": "worker"}),
+			createTestNodeWithLabel("node2", 2000, map[string]string{"kubernetes.io/role": "worker"}),
+			createTestNodeWithLabel("node3", 2000, map[string]string{"kubernetes.io/role": "worker"}),
+			createTestNodeWithLabel("node4", 8000, map[string]string{"kubernetes.io/role": "spot-worker"}),
+		}
+		podsOnNodes := map[string][]*apiv1.Pod{
+			"node1": {createTestReplicatedPod("p1n1", 300)},
+			"node2": {createTestReplicatedPod("p1n2", 400)},
+			"node3": {createTestReplicatedPod("p1n3", 500)},
+			"node4": {},
+		}
+
+		r, fakeClient := createTestRescheduler(t, allNodes, podsOnNodes)
+		acceptEvictions(fakeClient)
+		r.minOnDemandNodes = 2
+		r.maxDrainsPerRun = 3
+		r.optimizeDrains = optimizeDrains
+
+		// Every node could be drained, but only one can be while keeping two
+		result := r.Reconcile(context.Background())
+		assert.Equal(t, 1, len(result.DrainedNodes), "optimizeDrains %v", optimizeDrains)
+		assert.Equal(t, 1, len(evictionActions(fakeClient)), "optimizeDrains %v", optimizeDrains)
+	}
+}
+
+func TestReconcileDirection(t *testing.T) {
+	onDemandNode := createTestNodeWithLabel("node1", 2000, map[string]string{"kubernetes.io/role": "worker"})
+	spotNode := createTestNodeWithLabel("node2", 2000, map[string]string{"kubernetes.io/role": "spot-worker"})
+
+	podsOnNodes := map[string][]*apiv1.Pod{
+		"node1": {},
+		"node2": {createTestReplicatedPod("web-0", 300)},
+	}
+
+	r, fakeClient := createTestRescheduler(t, []*apiv1.Node{onDemandNode, spotNode}, podsOnNodes)
+	acceptEvictions(fakeClient)
+	spotHealthy := false
+	r.decideDirection = func() Direction {
+		if spotHealthy {
+			return ToSpot
+		}
+		return ToOnDemand
+	}
+
+	// Spot is unhealthy so the spot node is drained onto the on-demand node
+	result := r.Reconcile(context.Background())
+	assert.Equal(t, ToOnDemand, result.Direction)
+	assert.Equal(t, "node2", result.DrainedNode)
+
+	// Once spot is healthy again the pod is moved back
+	spotHealthy = true
+	podsOnNodes["node1"] = podsOnNodes["node2"]
+	podsOnNodes["node2"] = []*apiv1.Pod{}
+	r.nextDrainTime = time.Now()
+	result = r.Reconcile(context.Background())
+	assert.Equal(t, ToSpot, result.Direction)
+	assert.Equal(t, "node1", result.DrainedNode)
+	assert.Equal(t, []string{"web-0", "web-0"}, evictionActions(fakeClient))
+}
+
+func TestReconcileToOnDemandLowPriorityPods(t *testing.T) {
+	threshold := 0
+	for _, test := range []struct {
+		name                      string
+		onDemandPriorityThreshold *int
+		evicted                   []string
+	}{
+		{
+			// The spot PriorityThreshold doesn't hide the low priority pod
+			name:    "all pods",
+			evicted: []string{"web-0", "batch-0"},
+		},
+		{
+			name:                      "on-demand priority threshold",
+			onDemandPriorityThreshold: &threshold,
+			evicted:                   []string{"web-0"},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			onDemandNode := createTestNodeWithLabel("node1", 2000, map[string]string{"kubernetes.io/role": "worker"})
+			spotNode := createTestNodeWithLabel("node2", 2000, map[string]string{"kubernetes.io/role": "spot-worker"})
+
+			lowPriority := int32(-1)
+			batchPod := createTestReplicatedPod("batch-0", 300)
+			batchPod.Spec.Priority = &lowPriority
+			podsOnNodes := map[string][]*apiv1.Pod{
+				"node1": {},
+				"node2": {createTestReplicatedPod("web-0", 300), batchPod},
+			}
+
+			r, fakeClient := createTestRescheduler(t, []*apiv1.Node{onDemandNode, spotNode}, podsOnNodes)
+			acceptEvictions(fakeClient)
+			r.nodeConfig.OnDemandPriorityThreshold = test.onDemandPriorityThreshold
+			r.decideDirection = func() Direction { return ToOnDemand }
+
+			result := r.Reconcile(context.Background())
+			assert.Equal(t, "node2", result.DrainedNode)
+			assert.ElementsMatch(t, test.evicted, evictionActions(fakeClient))
+		})
+	}
+}
+
+func TestFileDirectionDecider(t *testing.T) {
+	assert.Nil(t, fileDirectionDecider(""))
+
+	dir, err := ioutil.TempDir("", "direction")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "direction")
+	decide := fileDirectionDecider(path)
+
+	// Missing files move pods onto spot nodes
+	assert.Equal(t, ToSpot, decide())
+
+	for contents, expected := range map[string]Direction{
+		"on-demand\n": ToOnDemand,
+		"spot":        ToSpot,
+		"sideways":    ToSpot,
+	} {
+		assert.NoError(t, ioutil.WriteFile(path, []byte(contents), 0644))
+		assert.Equal(t, expected, decide(), contents)
+	}
+}
+
+func TestReconcileMoveHistory(t *testing.T) {
+	onDemandNode := createTestNodeWithLabel("node1", 2000, map[string]string{"kubernetes.io/role": "worker"})
+	spotNode := createTestNodeWithLabel("node2", 2000, map[string]string{"kubernetes.io/role": "spot-worker"})
+
+	podsOnNodes := map[string][]*apiv1.Pod{
+		"node1": {createTestReplicatedPod("web-0", 500), createTestReplicatedPod("web-1", 300)},
+		"node2": {},
+	}
+
+	r, fakeClient := createTestRescheduler(t, []*apiv1.Node{onDemandNode, spotNode}, podsOnNodes)
+	acceptEvictions(fakeClient)
+	now := time.Now().UTC().Truncate(time.Second)
+	r.moveHistory = newMoveHistory(10)
+	r.moveHistory.clock = clock.NewFakeClock(now)
+
+	result := r.Reconcile(context.Background())
+	assert.Equal(t, "node1", result.DrainedNode)
+
+	w := httptest.NewRecorder()
+	r.moveHistory.ServeHTTP(w, httptest.NewRequest("GET", "/moves", nil))
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+	var records []MoveRecord
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &records))
+	assert.ElementsMatch(t, []MoveRecord{
+		{Pod: "default/web-0", From: "node1", To: "node2", Time: now, Result: "Success"},
+		{Pod: "default/web-1", From: "node1", To: "node2", Time: now, Result: "Success"},
+	}, records)
+}
+
+func TestMoveHistoryRingBuffer(t *testing.T) {
+	assert.Nil(t, newMoveHistory(0))
+
+	history := newMoveHistory(2)
+	history.add(createTestPod("p1", 100), "node1", "node2", nil)
+	history.add(createTestPod("p2", 100), "node1", "node2", fmt.Errorf("eviction refused"))
+	history.add(createTestPod("p3", 100), "node1", "node3", nil)
+
+	// The oldest record is replaced once full
+	records := history.list()
+	assert.Equal(t, 2, len(records))
+	assert.Equal(t, "kube-system/p2", records[0].Pod)
+	assert.Equal(t, "eviction refused", records[0].Result)
+	assert.Equal(t, "kube-system/p3", records[1].Pod)
+	assert.Equal(t, "node3", records[1].To)
+}
+
+func TestReconcileRespectsResourceQuotas(t *testing.T) {
+	withLimit := func(pod *apiv1.Pod, cpu string) *apiv1.Pod {
+		pod.Spec.Containers[0].Resources.Limits = apiv1.ResourceList{apiv1.ResourceCPU: resource.MustParse(cpu)}
+		return pod
+	}
+
+	for _, test := range []struct {
+		name string
+		hard apiv1.ResourceList
+		used apiv1.ResourceList
+	}{
+		{
+			// Only 400m of headroom, so only one of the pods is moved at a
+			// time
+			name: "requests",
+			hard: apiv1.ResourceList{apiv1.ResourceRequestsCPU: resource.MustParse("1000m")},
+			used: apiv1.ResourceList{apiv1.ResourceRequestsCPU: resource.MustParse("600m")},
+		},
+		{
+			// The pods' 500m of requests fit, but only one of their limits
+			name: "limits",
+			hard: apiv1.ResourceList{apiv1.ResourceLimitsCPU: resource.MustParse("1000m")},
+			used: apiv1.ResourceList{apiv1.ResourceLimitsCPU: resource.MustParse("400m")},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			onDemandNode := createTestNodeWithLabel("node1", 2000, map[string]string{"kubernetes.io/role": "worker"})
+			spotNode := createTestNodeWithLabel("node2", 2000, map[string]string{"kubernetes.io/role": "spot-worker"})
+
+			podsOnNodes := map[string][]*apiv1.Pod{
+				"node1": {
+					withLimit(createTestReplicatedPod("web-0", 300), "600m"),
+					withLimit(createTestReplicatedPod("web-1", 200), "400m"),
+				},
+				"node2": {},
+			}
+
+			r, fakeClient := createTestRescheduler(t, []*apiv1.Node{onDemandNode, spotNode}, podsOnNodes)
+			acceptEvictions(fakeClient)
+			r.respectResourceQuotas = true
+			r.resourceQuotaLister = fakeResourceQuotaLister{
+				{
+					ObjectMeta: metav1.ObjectMeta{Name: "quota", Namespace: "default"},
+					Status:     apiv1.ResourceQuotaStatus{Hard: test.hard, Used: test.used},
+				},
+			}
+
+			result := r.Reconcile(context.Background())
+			assert.Equal(t, "node1", result.DrainedNode)
+			assert.True(t, result.PartialDrain)
+			assert.Equal(t, []string{"web-0"}, evictionActions(fakeClient))
+		})
+	}
+}
+
+func TestQuotaUsage(t *testing.T) {
+	pod := createTestReplicatedPod("web-0", 300)
+	pod.Spec.Containers[0].Resources.Limits = apiv1.ResourceList{apiv1.ResourceCPU: resource.MustParse("500m")}
+	pod.Spec.InitContainers = []apiv1.Container{{
+		Resources: apiv1.ResourceRequirements{
+			Requests: apiv1.ResourceList{apiv1.ResourceCPU: resource.MustParse("400m")},
+			Limits:   apiv1.ResourceList{apiv1.ResourceCPU: resource.MustParse("400m")},
+		},
+	}}
+	pod.Spec.Overhead = apiv1.ResourceList{apiv1.ResourceCPU: resource.MustParse("50m")}
+
+	// The init container's request is the larger, overhead is added to both
+	usage := quotaUsage(pod)
+	for name, expected := range map[apiv1.ResourceName]int64{
+		apiv1.ResourceCPU:         450,
+		apiv1.ResourceRequestsCPU: 450,
+		apiv1.ResourceLimitsCPU:   550,
+	} {
+		quantity := usage[name]
+		assert.Equal(t, expected, quantity.MilliValue(), "%s", name)
+	}
+	pods := usage[apiv1.ResourcePods]
+	assert.Equal(t, int64(1), pods.Value())
+}
+
+func TestReconcileOptimizeDrains(t *testing.T) {
+	withMemory := func(pod *apiv1.Pod, memory string) *apiv1.Pod {
+		pod.Spec.Containers[0].Resources.Requests[apiv1.ResourceMemory] = resource.MustParse(memory)
+		return pod
+	}
+
+	for _, test := range []struct {
+		name           string
+		optimizeDrains bool
+		drainedNodes   []string
+	}{
+		{
+			// The emptiest node uses up the spot node's memory, so neither of
+			// the others fit afterwards
+			name:         "greedy",
+			drainedNodes: []string{"node1"},
+		},
+		{
+			name:           "optimized",
+			optimizeDrains: true,
+			drainedNodes:   []string{"node2", "node3"},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			allNodes := []*apiv1.Node{
+				createTestNodeWithLabel("node1", 2000, map[string]string{"kubernetes.io/role": "worker"}),
+				createTestNodeWithLabel("node2", 2000, map[string]string{"kubernetes.io/role": "worker"}),
+				createTestNodeWithLabel("node3", 2000, map[string]string{"kubernetes.io/role": "worker"}),
+				createTestNodeWithLabel("node4", 1000, map[string]string{"kubernetes.io/role": "spot-worker"}),
+			}
+			podsOnNodes := map[string][]*apiv1.Pod{
+				"node1": {withMemory(createTestReplicatedPod("p1n1", 100), "1900Mi")},
+				"node2": {withMemory(createTestReplicatedPod("p1n2", 400), "200Mi")},
+				"node3": {withMemory(createTestReplicatedPod("p1n3", 450), "200Mi")},
+				"node4": {},
+			}
+
+			r, fakeClient := createTestRescheduler(t, allNodes, podsOnNodes)
+			acceptEvictions(fakeClient)
+			r.maxDrainsPerRun = 2
+			r.optimizeDrains = test.optimizeDrains
+
+			result := r.Reconcile(context.Background())
+			assert.Equal(t, test.drainedNodes, result.DrainedNodes)
+			assert.Equal(t, test.drainedNodes[0], result.DrainedNode)
+		})
+	}
+}
+
+func TestReconcileUsageBasedPacking(t *testing.T) {
+	onDemandNode := createTestNodeWithLabel("node1", 2000, map[string]string{"kubernetes.io/role": "worker"})
+	spotNode := createTestNodeWithLabel("node2", 1000, map[string]string{"kubernetes.io/role": "spot-worker"})
+
+	pod := createTestReplicatedPod("web-0", 1500)
+	pod.Spec.Containers[0].Name = "web"
+	podsOnNodes := map[string][]*apiv1.Pod{
+		"node1": {pod},
+		"node2": {},
+	}
+
+	r, fakeClient := createTestRescheduler(t, []*apiv1.Node{onDemandNode, spotNode}, podsOnNodes)
+	acceptEvictions(fakeClient)
+
+	// The pod's request doesn't fit on the spot node
+	result := r.Reconcile(context.Background())
+	assert.Equal(t, "", result.DrainedNode)
+
+	// Its usage, with headroom, does
+	r.usageSource = fakeUsageSource{
+		"default/web-0": {"web": {apiv1.ResourceCPU: resource.MustParse("500m")}},
+	}
+	r.usageHeadroom = 1.5
+	result = r.Reconcile(context.Background())
+	assert.Equal(t, "node1", result.DrainedNode)
+	assert.Equal(t, int64(750), result.MovedCPU)
+	assert.Equal(t, []string{"web-0"}, evictionActions(fakeClient))
+
+	// The pod itself is left untouched
+	assert.Equal(t, int64(1500), pod.Spec.Containers[0].Resources.Requests.Cpu().MilliValue())
+}
+
+func TestRightsizeNodeInfos(t *testing.T) {
+	pod := createTestReplicatedPod("web-0", 1500)
+	pod.Spec.Containers[0].Name = "web"
+	other := createTestReplicatedPod("web-1", 200)
+	nodeInfo := createTestNodeInfo(createTestNode("node1", 2000), []*apiv1.Pod{pod, other}, 1700)
+
+	usage := map[string]podUsage{
+		"default/web-0": {"web": {apiv1.ResourceCPU: resource.MustParse("500m")}},
+	}
+	rightsized := rightsizeNodeInfos(nodes.NodeInfoArray{nodeInfo}, usage, 1.5)
+
+	// The copy accounts for the rightsized request, pods without usage keep
+	// theirs
+	assert.Equal(t, int64(950), rightsized[0].RequestedCPU)
+	assert.Equal(t, int64(1050), rightsized[0].FreeCPU)
+	assert.Equal(t, int64(950), rightsized[0].Requested[apiv1.ResourceCPU])
+	assert.True(t, rightsized[0].Pods[1] == other)
+
+	// The original is left as it was
+	assert.Equal(t, int64(1700), nodeInfo.RequestedCPU)
+	assert.Equal(t, int64(300), nodeInfo.FreeCPU)
+	assert.True(t, nodeInfo.Pods[0] == pod)
+}
+
+func TestMetricsServerUsageSource(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "/apis/metrics.k8s.io/v1beta1/pods", req.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{
+			"kind": "PodMetricsList",
+			"apiVersion": "metrics.k8s.io/v1beta1",
+			"items": [{
+				"metadata": {"name": "web-0", "namespace": "default"},
+				"timestamp": "2020-10-01T00:00:00Z",
+				"window": "30s",
+				"containers": [
+					{"name": "web", "usage": {"cpu": "250m", "memory": "64Mi"}},
+					{"name": "sidecar", "usage": {"cpu": "10m", "memory": "8Mi"}}
+				]
+			}]
+		}`)
+	}))
+	defer server.Close()
+	client, err := kube_client.NewForConfig(&kube_restclient.Config{Host: server.URL})
+	assert.NoError(t, err)
+
+	usage, err := metricsServerUsageSource{client}.Usage(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(usage))
+	web := usage["default/web-0"]
+	assert.Equal(t, int64(250), web["web"].Cpu().MilliValue())
+	assert.Equal(t, int64(64<<20), web["web"].Memory().Value())
+	assert.Equal(t, int64(10), web["sidecar"].Cpu().MilliValue())
+
+	// A failing metrics API is reported
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "service unavailable", http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+	client, err = kube_client.NewForConfig(&kube_restclient.Config{Host: failing.URL})
+	assert.NoError(t, err)
+	_, err = metricsServerUsageSource{client}.Usage(context.Background())
+	assert.Error(t, err)
+}
+
+func TestReconcileDoNotDrainBefore(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		annotation string
+		drained    string
+	}{
+		{
+			name:       "future",
+			annotation: time.Now().Add(time.Hour).Format(time.RFC3339),
+			drained:    "",
+		},
+		{
+			name:       "past",
+			annotation: time.Now().Add(-time.Hour).Format(time.RFC3339),
+			drained:    "node1",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			onDemandNode := createTestNodeWithLabel("node1", 2000, map[string]string{"kubernetes.io/role": "worker"})
+			onDemandNode.Annotations = map[string]string{"do-not-drain-before": test.annotation}
+			spotNode := createTestNodeWithLabel("node2", 2000, map[string]string{"kubernetes.io/role": "spot-worker"})
+
+			podsOnNodes := map[string][]*apiv1.Pod{
+				"node1": {createTestReplicatedPod("web-0", 300)},
+				"node2": {},
+			}
+
+			r, fakeClient := createTestRescheduler(t, []*apiv1.Node{onDemandNode, spotNode}, podsOnNodes)
+			acceptEvictions(fakeClient)
+			r.notBeforeAnnotation = "do-not-drain-before"
+
+			result := r.Reconcile(context.Background())
+			assert.Equal(t, test.drained, result.DrainedNode)
+		})
+	}
+}
+
+func TestReconcileReportsDiscrepancies(t *testing.T) {
+	onDemandNode := createTestNodeWithLabel("node1", 2000, map[string]string{"kubernetes.io/role": "worker"})
+	spotNode := createTestNodeWithLabel("node2", 2000, map[string]string{"kubernetes.io/role": "spot-worker"})
+
+	podsOnNodes := map[string][]*apiv1.Pod{
+		"node1": {createTestReplicatedPod("web-0", 300), createTestReplicatedPod("web-1", 200)},
+		"node2": {},
+	}
+
+	r, fakeClient := createTestRescheduler(t, []*apiv1.Node{onDemandNode, spotNode}, podsOnNodes)
+	acceptEvictions(fakeClient)
+	fakeClient.PrependReactor("create", "pods", func(action core.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "eviction" || action.(core.CreateAction).GetObject().(*policyv1.Eviction).Name != "web-1" {
+			return false, nil, nil
+		}
+		return true, nil, fmt.Errorf("too many requests")
+	})
+
+	r.recentMoves.cooldown = time.Hour
+
+	// The drain gives up on web-1 once the pass's deadline passes
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	result := r.Reconcile(ctx)
+	assert.Equal(t, "", result.DrainedNode, "expected a failed drain not to be reported as drained")
+	assert.Empty(t, result.DrainedNodes)
+	assert.Equal(t, 1, result.MovedPods, "expected only the evicted pod to count as moved")
+	assert.Equal(t, int64(300), result.MovedCPU)
+	assert.True(t, r.recentMoves.recentlyMoved(podsOnNodes["node1"][0]))
+	assert.False(t, r.recentMoves.recentlyMoved(podsOnNodes["node1"][1]), "expected the pod which wasn't evicted not to be in cooldown")
+	assert.Equal(t, 1, len(result.Discrepancies))
+	assert.Equal(t, "default/web-1", result.Discrepancies[0].Pod)
+	assert.Equal(t, "node2", result.Discrepancies[0].PlannedNode)
+	assert.Equal(t, "", result.Discrepancies[0].ActualNode)
+}
+
+func TestPlanDiscrepancies(t *testing.T) {
+	pods := []*apiv1.Pod{
+		createTestPod("p1", 100),
+		createTestPod("p2", 100),
+		createTestPod("p3", 100),
+		createTestPod("p4", 100),
+	}
+	planned := drainPlan{
+		"kube-system/p1": "node2",
+		"kube-system/p2": "node2",
+		"kube-system/p3": "node2",
+		"kube-system/p4": "node2",
+	}
+	target := func(pod *apiv1.Pod) string {
+		if pod.Name == "p2" {
+			return "node3"
+		}
+		return "node2"
+	}
+	outcomes := &evictionOutcomes{}
+	outcomes.record(pods[0], nil)
+	outcomes.record(pods[1], nil)
+	outcomes.record(pods[2], fmt.Errorf("refused"))
+
+	discrepancies := planDiscrepancies(pods, planned, target, outcomes)
+	assert.Equal(t, []MoveDiscrepancy{
+		{Pod: "kube-system/p2", PlannedNode: "node2", ActualNode: "node3", Reason: "it was moved onto node3 instead"},
+		{Pod: "kube-system/p3", PlannedNode: "node2", Reason: "its eviction failed: refused"},
+		{Pod: "kube-system/p4", PlannedNode: "node2", Reason: "it was not evicted"},
+	}, discrepancies)
+}
+
+func TestReconcileMinPodAge(t *testing.T) {
+	onDemandNode1 := createTestNodeWithLabel("node1", 2000, map[string]string{"kubernetes.io/role": "worker"})
+	onDemandNode2 := createTestNodeWithLabel("node2", 2000, map[string]string{"kubernetes.io/role": "worker"})
+	spotNode := createTestNodeWithLabel("node3", 2000, map[string]string{"kubernetes.io/role": "spot-worker"})
+
+	justStarted := metav1.Now()
+	youngPod := createTestReplicatedPod("young", 300)
+	youngPod.Status.StartTime = &justStarted
+	started := metav1.NewTime(time.Now().Add(-time.Hour))
+	oldPod := createTestReplicatedPod("old", 500)
+	oldPod.Status.StartTime = &started
+
+	podsOnNodes := map[string][]*apiv1.Pod{
+		"node1": {youngPod},
+		"node2": {oldPod},
+		"node3": {},
+	}
+
+	r, fakeClient := createTestRescheduler(t, []*apiv1.Node{onDemandNode1, onDemandNode2, spotNode}, podsOnNodes)
+	acceptEvictions(fakeClient)
+	r.minPodAge = 10 * time.Minute
+
+	// The emptiest node is skipped as its pod only just started
+	result := r.Reconcile(context.Background())
+	assert.Equal(t, "node2", result.DrainedNode)
+	assert.Equal(t, map[string]UnmovableReason{"default/young": TooYoung}, result.UnmovablePods)
+	assert.Equal(t, []string{"old"}, evictionActions(fakeClient))
+}
+
+func TestReconcileRestrictedRuntimeClass(t *testing.T) {
+	onDemandNode := createTestNodeWithLabel("node1", 2000, map[string]string{"kubernetes.io/role": "worker"})
+	spotNode1 := createTestNodeWithLabel("node2", 2000, map[string]string{"kubernetes.io/role": "spot-worker"})
+	spotNode2 := createTestNodeWithLabel("node3", 2000, map[string]string{"kubernetes.io/role": "spot-worker", "runtime.spot-rescheduler.pusher.com/gvisor": ""})
+
+	gvisor := "gvisor"
+	// Fits best on node2 but only node3 supports its runtime class
+	sandboxedPod := createTestPod("sandboxed", 300)
+	sandboxedPod.Spec.RuntimeClassName = &gvisor
+	spotPod := createTestPod("spotPod", 1000)
+
+	podsOnNodes := map[string][]*apiv1.Pod{
+		"node1": {sandboxedPod},
+		"node2": {spotPod},
+		"node3": {},
+	}
+
+	r, fakeClient := createTestRescheduler(t, []*apiv1.Node{onDemandNode, spotNode1, spotNode2}, podsOnNodes)
+	acceptEvictions(fakeClient)
+	r.restrictedRuntimeClasses = map[string]bool{gvisor: true}
+
+	result := r.Reconcile(context.Background())
+	assert.Equal(t, "node1", result.DrainedNode)
+	assert.Equal(t, []string{"sandboxed"}, evictionActions(fakeClient))
+	assert.Equal(t, []Rejection{
+		{Pod: "kube-system/sandboxed", Reason: RestrictedRuntimeClass, Detail: "doesn't support runtime class gvisor"},
+	}, result.Rejections["node2"])
+
+	// Without a spot node supporting it the pod can't be moved at all
+	spotNode2.Labels = map[string]string{"kubernetes.io/role": "spot-worker"}
+	r, fakeClient = createTestRescheduler(t, []*apiv1.Node{onDemandNode, spotNode1, spotNode2}, podsOnNodes)
+	acceptEvictions(fakeClient)
+	r.restrictedRuntimeClasses = map[string]bool{gvisor: true}
+
+	result = r.Reconcile(context.Background())
+	assert.Equal(t, "", result.DrainedNode)
+	assert.Equal(t, map[string]UnmovableReason{"kube-system/sandboxed": RestrictedRuntimeClass}, result.UnmovablePods)
+	assert.Empty(t, evictionActions(fakeClient))
+}
+
+func TestReconcilePendingPod(t *testing.T) {
+	onDemandNode1 := createTestNodeWithLabel("node1", 2000, map[string]string{"kubernetes.io/role": "worker"})
+	onDemandNode2 := createTestNodeWithLabel("node2", 2000, map[string]string{"kubernetes.io/role": "worker"})
+	spotNode := createTestNodeWithLabel("node3", 4000, map[string]string{"kubernetes.io/role": "spot-worker"})
+
+	podsOnNodes := map[string][]*apiv1.Pod{
+		"node1": {
+			createTestPod("p1", 300),
+			createTestPod("p2", 600),
+			createTestPod("p3", 900),
+		},
+		"node2": {
+			createTestPod("p4", 1200),
+			createTestPod("p5", 700),
+		},
+		"node3": {createTestPod("p6", 1000)},
+	}
+
+	// Room is made on node1 by moving two pods but on node2 by moving one
+	r, fakeClient := createTestRescheduler(t, []*apiv1.Node{onDemandNode1, onDemandNode2, spotNode}, podsOnNodes)
+	acceptEvictions(fakeClient)
+	r.pendingPod = createTestPod("pending", 1200)
+
+	result := r.Reconcile(context.Background())
+	assert.Equal(t, "node2", result.PendingPodNode)
+	assert.True(t, result.PartialDrain)
+	assert.Equal(t, []string{"p4"}, evictionActions(fakeClient))
+
+	// Nothing is moved when the pod already fits
+	r, fakeClient = createTestRescheduler(t, []*apiv1.Node{onDemandNode1, onDemandNode2, spotNode}, podsOnNodes)
+	acceptEvictions(fakeClient)
+	r.pendingPod = createTestPod("pending", 100)
+
+	result = r.Reconcile(context.Background())
+	assert.Equal(t, "", result.PendingPodNode)
+	assert.Equal(t, "", result.DrainedNode)
+	assert.Empty(t, evictionActions(fakeClient))
+}
+
+func TestReconcileDeprioritizePreferNoSchedule(t *testing.T) {
+	onDemandNode1 := createTestNodeWithLabel("node1", 2000, map[string]string{"kubernetes.io/role": "worker"})
+	onDemandNode1.Spec.Taints = []apiv1.Taint{{Key: "maintenance", Effect: apiv1.TaintEffectPreferNoSchedule}}
+	onDemandNode2 := createTestNodeWithLabel("node2", 2000, map[string]string{"kubernetes.io/role": "worker"})
+	spotNode := createTestNodeWithLabel("node3", 2000, map[string]string{"kubernetes.io/role": "spot-worker"})
+
+	podsOnNodes := map[string][]*apiv1.Pod{
+		"node1": {createTestPod("p1", 300)},
+		"node2": {createTestPod("p2", 500)},
+		"node3": {},
+	}
+
+	// The emptiest node is drained first
+	r, fakeClient := createTestRescheduler(t, []*apiv1.Node{onDemandNode1, onDemandNode2, spotNode}, podsOnNodes)
+	acceptEvictions(fakeClient)
+	result := r.Reconcile(context.Background())
+	assert.Equal(t, "node1", result.DrainedNode)
+	assert.Equal(t, []string{"p1"}, evictionActions(fakeClient))
+
+	// Unless its pods don't tolerate its PreferNoSchedule taint
+	r, fakeClient = createTestRescheduler(t, []*apiv1.Node{onDemandNode1, onDemandNode2, spotNode}, podsOnNodes)
+	acceptEvictions(fakeClient)
+	r.avoidPreferNoSchedule = true
+	result = r.Reconcile(context.Background())
+	assert.Equal(t, "node2", result.DrainedNode)
+	assert.Equal(t, []string{"p2"}, evictionActions(fakeClient))
+
+	// A tolerated taint doesn't change the order
+	tolerating := createTestPod("p1", 300)
+	tolerating.Spec.Tolerations = []apiv1.Toleration{{Key: "maintenance", Operator: apiv1.TolerationOpExists}}
+	podsOnNodes["node1"] = []*apiv1.Pod{tolerating}
+	r, fakeClient = createTestRescheduler(t, []*apiv1.Node{onDemandNode1, onDemandNode2, spotNode}, podsOnNodes)
+	acceptEvictions(fakeClient)
+	r.avoidPreferNoSchedule = true
+	result = r.Reconcile(context.Background())
+	assert.Equal(t, "node1", result.DrainedNode)
+}
+
+func TestReconcileAllUnmovableReasons(t *testing.T) {
+	onDemandNode := createTestNodeWithLabel("node1", 2000, map[string]string{"kubernetes.io/role": "worker"})
+	spotNode := createTestNodeWithLabel("node2", 2000, map[string]string{"kubernetes.io/role": "spot-worker"})
+
+	// The pod is both too young and uses a runtime class no spot node supports
+	gvisor := "gvisor"
+	justStarted := metav1.Now()
+	pod := createTestPod("sandboxed", 300)
+	pod.Status.StartTime = &justStarted
+	pod.Spec.RuntimeClassName = &gvisor
+	podsOnNodes := map[string][]*apiv1.Pod{
+		"node1": {pod},
+		"node2": {},
+	}
+
+	for _, all := range []bool{false, true} {
+		r, fakeClient := createTestRescheduler(t, []*apiv1.Node{onDemandNode, spotNode}, podsOnNodes)
+		acceptEvictions(fakeClient)
+		r.minPodAge = 10 * time.Minute
+		r.restrictedRuntimeClasses = map[string]bool{gvisor: true}
+		r.allUnmovableReasons = all
+
+		expected := []UnmovableReason{TooYoung}
+		if all {
+			expected = []UnmovableReason{TooYoung, RestrictedRuntimeClass}
+		}
+		result := r.Reconcile(context.Background())
+		assert.Equal(t, "", result.DrainedNode)
+		assert.Equal(t, map[string][]UnmovableReason{"kube-system/sandboxed": expected}, result.UnmovableReasons)
+		assert.Equal(t, map[string]UnmovableReason{"kube-system/sandboxed": TooYoung}, result.UnmovablePods)
+	}
+}
+
+func TestCheckPermissions(t *testing.T) {
+	fakeClient := fake.NewSimpleClientset()
+	fakeClient.PrependReactor("create", "selfsubjectaccessreviews", func(action core.Action) (bool, runtime.Object, error) {
+		review := action.(core.CreateAction).GetObject().(*authorizationv1.SelfSubjectAccessReview)
+		attributes := review.Spec.ResourceAttributes
+		review.Status.Allowed = !(attributes.Resource == "pods" && attributes.Subresource == "eviction")
+		return true, review, nil
+	})
+	permissions := []permission{
+		{verb: "list", resource: "pods"},
+		{verb: "create", resource: "pods", subresource: "eviction"},
+		{verb: "list", group: "policy", resource: "poddisruptionbudgets"},
+	}
+
+	err := checkPermissions(context.Background(), fakeClient, permissions)
+	assert.EqualError(t, err, "missing permissions: create pods/eviction")
+
+	err = checkPermissions(context.Background(), fakeClient, []permission{permissions[0], permissions[2]})
+	assert.NoError(t, err)
+
+	// The required permissions cover everything the rescheduler and the
+	// predicate checker's informers use
+	names := func() []string {
+		names := make([]string, 0)
+		for _, p := range requiredPermissions() {
+			names = append(names, p.String())
+		}
+		return names
+	}
+
+	for _, expected := range []string{
+		"get pods",
+		"watch poddisruptionbudgets.policy",
+		"list services",
+		"watch persistentvolumes",
+		"watch persistentvolumeclaims",
+		"watch replicasets.apps",
+		"watch statefulsets.apps",
+		"watch storageclasses.storage.k8s.io",
+		"watch csinodes.storage.k8s.io",
+	} {
+		assert.Contains(t, names(), expected)
+	}
+	assert.NotContains(t, names(), "watch resourcequotas")
+	assert.NotContains(t, names(), "patch nodes")
+
+	defer func(respect bool, label string) {
+		*respectResourceQuotas = respect
+		*drainedNodeLabel = label
+	}(*respectResourceQuotas, *drainedNodeLabel)
+	*respectResourceQuotas = true
+	*drainedNodeLabel = "drained=true"
+	assert.Contains(t, names(), "list resourcequotas")
+	assert.Contains(t, names(), "watch resourcequotas")
+	assert.Contains(t, names(), "patch nodes")
+}
+
+func TestEvictionBreaker(t *testing.T) {
+	fakeClock := clock.NewFakeClock(time.Now())
+	breaker := evictionBreaker{clock: fakeClock, threshold: 3, cooldown: 10 * time.Minute}
+	failure := fmt.Errorf("admission webhook denied the request")
+
+	// A success resets the count of failures in a row
+	breaker.record(failure)
+	breaker.record(failure)
+	breaker.record(nil)
+	breaker.record(failure)
+	breaker.record(failure)
+	assert.Equal(t, time.Duration(0), breaker.pausedFor())
+
+	// Evictions which were never attempted aren't counted
+	breaker.record(&scaler.SkippedEvictionError{Pod: createTestPod("p1", 100), Reason: context.Canceled})
+	assert.Equal(t, time.Duration(0), breaker.pausedFor())
+
+	// The third failure in a row trips the breaker
+	breaker.record(failure)
+	assert.Equal(t, 10*time.Minute, breaker.pausedFor())
+
+	fakeClock.Step(10 * time.Minute)
+	assert.Equal(t, time.Duration(0), breaker.pausedFor())
+
+	// A breaker without a threshold never trips
+	breaker = evictionBreaker{clock: fakeClock}
+	breaker.record(failure)
+	assert.Equal(t, time.Duration(0), breaker.pausedFor())
+}
+
+func TestReconcileEvictionBreakerTripped(t *testing.T) {
+	onDemandNode := createTestNodeWithLabel("node1", 2000, map[string]string{"kubernetes.io/role": "worker"})
+	spotNode := createTestNodeWithLabel("node2", 2000, map[string]string{"kubernetes.io/role": "spot-worker"})
+
+	podsOnNodes := map[string][]*apiv1.Pod{
+		"node1": {createTestReplicatedPod("web-0", 300)},
+		"node2": {},
+	}
+
+	r, fakeClient := createTestRescheduler(t, []*apiv1.Node{onDemandNode, spotNode}, podsOnNodes)
+	acceptEvictions(fakeClient)
+	fakeClock := clock.NewFakeClock(time.Now())
+	r.evictionBreaker = evictionBreaker{clock: fakeClock, threshold: 1, cooldown: 10 * time.Minute}
+	r.evictionBreaker.record(fmt.Errorf("admission webhook denied the request"))
+
+	result := r.Reconcile(context.Background())
+	assert.True(t, result.EvictionsPaused)
+	assert.Equal(t, "", result.DrainedNode)
+	assert.Empty(t, evictionActions(fakeClient))
+
+	fakeClock.Step(10 * time.Minute)
+	result = r.Reconcile(context.Background())
+	assert.False(t, result.EvictionsPaused)
+	assert.Equal(t, "node1", result.DrainedNode)
+}
+
+func TestReconcileNotifiesDrainWebhook(t *testing.T) {
+	var notifications []drainNotification
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "POST", req.Method)
+		assert.Equal(t, "application/json", req.Header.Get("Content-Type"))
+		var notification drainNotification
+		assert.NoError(t, json.NewDecoder(req.Body).Decode(&notification))
+		notifications = append(notifications, notification)
+	}))
+	defer server.Close()
+
+	onDemandNode := createTestNodeWithLabel("node1", 2000, map[string]string{"kubernetes.io/role": "worker"})
+	spotNode := createTestNodeWithLabel("node2", 2000, map[string]string{"kubernetes.io/role": "spot-worker"})
+
+	podsOnNodes := map[string][]*apiv1.Pod{
+		"node1": {createTestReplicatedPod("web-0", 500), createTestReplicatedPod("web-1", 300)},
+		"node2": {},
+	}
+
+	r, fakeClient := createTestRescheduler(t, []*apiv1.Node{onDemandNode, spotNode}, podsOnNodes)
+	acceptEvictions(fakeClient)
+	r.drainWebhookURL = server.URL
+	r.drainWebhookClient = server.Client()
+
+	result := r.Reconcile(context.Background())
+	assert.Equal(t, "node1", result.DrainedNode)
+	assert.Equal(t, []drainNotification{
+		{Node: "node1", Pods: []string{"default/web-0", "default/web-1"}},
+	}, notifications)
+}
+
+func TestNotifyDrainedTimeout(t *testing.T) {
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-done
+	}))
+	defer server.Close()
+	defer close(done)
+
+	client := server.Client()
+	client.Timeout = 50 * time.Millisecond
+	node := createTestNodeWithLabel("node1", 2000, map[string]string{"kubernetes.io/role": "worker"})
+
+	// A webhook which never responds doesn't hold the pass up
+	start := time.Now()
+	err := notifyDrained(context.Background(), client, server.URL, node, nil)
+	assert.Error(t, err)
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+func TestNodeMapCacheMaxAge(t *testing.T) {
+	fakeClock := clock.NewFakeClock(time.Now())
+	cache := nodeMapCache{
+		clock:  fakeClock,
+		maxAge: time.Minute,
+	}
+
+	builds := 0
+	build := func() (nodes.Map, error) {
+		builds++
+		return nodes.Map{}, nil
+	}
+
+	_, err := cache.get(build)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, builds)
+
+	// Within the max age the cached map is reused
+	fakeClock.Step(30 * time.Second)
+	_, err = cache.get(build)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, builds)
+
+	// Past the max age the map is rebuilt
+	fakeClock.Step(31 * time.Second)
+	_, err = cache.get(build)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, builds)
+
+	// Invalidating forces a rebuild
+	cache.invalidate()
+	_, err = cache.get(build)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, builds)
+
+	// Without a max age the map is rebuilt every time
+	cache.maxAge = 0
+	_, err = cache.get(build)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, builds)
+}
+
+func TestNodeMapCacheInvalidateOnChange(t *testing.T) {
+	builds := 0
+	build := func() (nodes.Map, error) {
+		builds++
+		return nodes.Map{}, nil
+	}
+	cache := nodeMapCache{maxAge: time.Hour}
+	handler := cache.invalidateOnChange()
+	pod := createTestPod("pod1", 100)
+
+	_, err := cache.get(build)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, builds)
+
+	for _, change := range []func(){
+		func() { handler.OnAdd(pod) },
+		func() { handler.OnUpdate(pod, pod) },
+		func() { handler.OnDelete(pod) },
+	} {
+		change()
+		_, err = cache.get(build)
+		assert.NoError(t, err)
+		_, err = cache.get(build)
+		assert.NoError(t, err)
+	}
+	// Every change forces a single rebuild
+	assert.Equal(t, 4, builds)
+}
+
+func TestNodeMapCacheInvalidatedDuringBuild(t *testing.T) {
+	cache := nodeMapCache{maxAge: time.Hour}
+	builds := 0
+	_, err := cache.get(func() (nodes.Map, error) {
+		builds++
+		cache.invalidate()
+		return nodes.Map{}, nil
+	})
+	assert.NoError(t, err)
+
+	// The map built across the invalidation isn't kept
+	_, err = cache.get(func() (nodes.Map, error) {
+		builds++
+		return nodes.Map{}, nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, builds)
+}
+
+func TestReconcileCachedNodeMapDeletedNode(t *testing.T) {
+	onDemandNode := createTestNodeWithLabel("node1", 2000, map[string]string{"kubernetes.io/role": "worker"})
+	spotNode1 := createTestNodeWithLabel("node2", 2000, map[string]string{"kubernetes.io/role": "spot-worker"})
+	spotNode2 := createTestNodeWithLabel("node3", 1000, map[string]string{"kubernetes.io/role": "spot-worker"})
+
+	podsOnNodes := map[string][]*apiv1.Pod{
+		"node1": {createTestReplicatedPod("p1n1", 1500)},
+		"node2": {},
+		"node3": {},
+	}
+
+	r, fakeClient := createTestRescheduler(t, []*apiv1.Node{onDemandNode, spotNode1, spotNode2}, podsOnNodes)
+	acceptEvictions(fakeClient)
+	r.nodeMapCache.maxAge = time.Hour
+
+	// The map is cached while warming up
+	r.warmUpUntil = time.Now().Add(time.Hour)
+	result := r.Reconcile(context.Background())
+	assert.True(t, result.WarmingUp)
+
+	// The only spot node the pod fits on is deleted before the next pass
+	r.warmUpUntil = time.Time{}
+	r.nodeLister = fakeNodeLister{onDemandNode, spotNode2}
+	result = r.Reconcile(context.Background())
+	assert.Equal(t, "", result.DrainedNode)
+	assert.Equal(t, 0, len(evictionActions(fakeClient)))
+}
+
+type fakeNodeLister []*apiv1.Node
+
+func (l fakeNodeLister) List() ([]*apiv1.Node, error) {
+	return l, nil
+}
+
+type fakePodLister []*apiv1.Pod
+
+func (l fakePodLister) List() ([]*apiv1.Pod, error) {
+	return l, nil
+}
+
+type fakeUsageSource map[string]podUsage
+
+func (s fakeUsageSource) Usage(ctx context.Context) (map[string]podUsage, error) {
+	return s, nil
+}
+
+type fakeResourceQuotaLister []*apiv1.ResourceQuota
+
+func (l fakeResourceQuotaLister) List() ([]*apiv1.ResourceQuota, error) {
+	return l, nil
+}
+
+type fakePodDisruptionBudgetLister []*policyv1.PodDisruptionBudget
+
+func (l fakePodDisruptionBudgetLister) List() ([]*policyv1.PodDisruptionBudget, error) {
+	return l, nil
+}
+
+// Creates a rescheduler backed by a fake client which serves the given pods
+// for each node.
+func createTestRescheduler(t *testing.T, allNodes []*apiv1.Node, podsOnNodes map[string][]*apiv1.Pod) (*rescheduler, *fake.Clientset) {
+	objects := make([]runtime.Object, 0)
+	for _, node := range allNodes {
+		objects = append(objects, node)
+	}
+	fakeClient := fake.NewSimpleClientset(objects...)
+	fakeClient.PrependReactor("list", "pods", func(action core.Action) (bool, runtime.Object, error) {
+		listAction, ok := action.(core.ListAction)
+		assert.True(t, ok)
+		restrictions := listAction.GetListRestrictions().Fields.String()
+
+		podList := &apiv1.PodList{}
+		for nodeName, pods := range podsOnNodes {
+			if restrictions != fmt.Sprintf("spec.nodeName=%s", nodeName) {
+				continue
+			}
+			for _, pod := range pods {
+				pod.Spec.NodeName = nodeName
+				podList.Items = append(podList.Items, *pod)
+			}
+		}
+		return true, podList, nil
+	})
+
+	predicateChecker, err := simulator.NewTestPredicateChecker()
+	assert.NoError(t, err)
+
+	r := &rescheduler{
+		kubeClient:                fakeClient,
+		recorder:                  kube_record.NewFakeRecorder(100),
+		predicateChecker:          predicateChecker,
+		metrics:                   metrics.NewRecorder("", prometheus.NewRegistry()),
+		nodeConfig:                nodes.NewConfig(),
+		nodeLister:                fakeNodeLister(allNodes),
+		podDisruptionBudgetLister: fakePodDisruptionBudgetLister{},
+		unschedulablePodLister:    fakePodLister{},
+		cordonedTargetPolicy:      cordonedTargetIgnore,
+		nextDrainTime:             time.Now(),
+	}
+	return r, fakeClient
+}
+
+// Makes the fake client accept evictions.
+func acceptEvictions(fakeClient *fake.Clientset) {
+	fakeClient.PrependReactor("create", "pods", func(action core.Action) (bool, runtime.Object, error) {
+		return action.GetSubresource() == "eviction", nil, nil
+	})
+}
+
+// Returns the names of the pods the fake client was asked to evict.
+func evictionActions(fakeClient *fake.Clientset) []string {
+	evicted := make([]string, 0)
+	for _, action := range fakeClient.Actions() {
+		if action.GetVerb() == "create" && action.GetSubresource() == "eviction" {
+			evicted = append(evicted, action.(core.CreateAction).GetObject().(*policyv1.Eviction).Name)
+		}
+	}
+	return evicted
+}
+
 func createTestPod(name string, cpu int64) *apiv1.Pod {
 	pod := &apiv1.Pod{
 		ObjectMeta: metav1.ObjectMeta{
@@ -195,6 +2142,31 @@ func createTestNode(name string, cpu int64) *apiv1.Node {
 	return node
 }
 
+func createTestNodeWithLabel(name string, cpu int64, labels map[string]string) *apiv1.Node {
+	node := createTestNode(name, cpu)
+	node.ObjectMeta.Labels = labels
+	return node
+}
+
+// Creates a pod controlled by a ReplicaSet in the default namespace.
+func createTestReplicatedPod(name string, cpu int64) *apiv1.Pod {
+	controller := true
+	priority := int32(0)
+	pod := createTestPod(name, cpu)
+	pod.Namespace = "default"
+	pod.Spec.Priority = &priority
+	pod.OwnerReferences = []metav1.OwnerReference{
+		{
+			APIVersion: "apps/v1",
+			Kind:       "ReplicaSet",
+			Name:       "rs",
+			UID:        "rs-uid",
+			Controller: &controller,
+		},
+	}
+	return pod
+}
+
 func createTestNodeInfo(node *apiv1.Node, pods []*apiv1.Pod, requests int64) *nodes.NodeInfo {
 	nodeInfo := &nodes.NodeInfo{
 		Node:         node,
@@ -20,14 +20,18 @@ package scaler
 import (
 	"context"
 	"fmt"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/golang/glog"
-	"github.com/pusher/k8s-spot-rescheduler/metrics"
 	apiv1 "k8s.io/api/core/v1"
 	policyv1 "k8s.io/api/policy/v1beta1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/clock"
 	"k8s.io/autoscaler/cluster-autoscaler/utils/deletetaint"
 	kube_client "k8s.io/client-go/kubernetes"
 	kube_record "k8s.io/client-go/tools/record"
@@ -38,13 +42,54 @@ const (
 	EvictionRetryTime = 10 * time.Second
 )
 
+// DrainOptions configures how DrainNode evicts the pods on a node.
+type DrainOptions struct {
+	// MaxGracefulTerminationSec is the grace period given to evicted pods.
+	MaxGracefulTerminationSec int
+	// MaxPodEvictionTime is how long a pod's eviction is retried for.
+	MaxPodEvictionTime time.Duration
+	// WaitBetweenRetries is how long to wait between eviction attempts.
+	WaitBetweenRetries time.Duration
+	// ReplicaEvictionDelay is how long to wait after evicting a pod before
+	// evicting the next pod with the same controller. Pods are evicted all at
+	// once when zero.
+	ReplicaEvictionDelay time.Duration
+	// OrderStatefulSets evicts the pods of a StatefulSet one at a time in
+	// reverse ordinal order, waiting for each pod to be deleted before
+	// evicting the next.
+	OrderStatefulSets bool
+	// BeforeEviction is called just before each pod is evicted, the pod is not
+	// evicted if it returns an error.
+	BeforeEviction func(pod *apiv1.Pod) error
+	// AfterEviction is called once each pod has been evicted, or with the
+	// reason it wasn't. Pods whose eviction was never attempted are given a
+	// *SkippedEvictionError.
+	AfterEviction func(pod *apiv1.Pod, err error)
+	// DeletionPollInterval is how often the evicted pods are checked for
+	// having been deleted, every 5 seconds when zero.
+	DeletionPollInterval time.Duration
+	// Clock is used to pace evictions, the real clock is used when nil.
+	Clock clock.Clock
+}
+
+// SkippedEvictionError is reported for a pod whose eviction was never
+// attempted.
+type SkippedEvictionError struct {
+	Pod    *apiv1.Pod
+	Reason error
+}
+
+func (e *SkippedEvictionError) Error() string {
+	return fmt.Sprintf("Did not evict pod %s/%s: %v", e.Pod.Namespace, e.Pod.Name, e.Reason)
+}
+
 // Originally from https://github.com/kubernetes/autoscaler/blob/bf59e3daa5922c0e44027fa211948b50cb6b7a12/cluster-autoscaler/core/scale_down.go#L690-L723
-func evictPod(podToEvict *apiv1.Pod, client kube_client.Interface, recorder kube_record.EventRecorder,
+func evictPod(ctx context.Context, podToEvict *apiv1.Pod, client kube_client.Interface, recorder kube_record.EventRecorder,
 	maxGracefulTerminationSec int, retryUntil time.Time, waitBetweenRetries time.Duration) error {
 	recorder.Eventf(podToEvict, apiv1.EventTypeNormal, "Rescheduler", "deleting pod from on-demand node")
 	maxGraceful64 := int64(maxGracefulTerminationSec)
 	var lastError error
-	for first := true; first || time.Now().Before(retryUntil); time.Sleep(waitBetweenRetries) {
+	for first := true; first || time.Now().Before(retryUntil); {
 		first = false
 		eviction := &policyv1.Eviction{
 			ObjectMeta: metav1.ObjectMeta{
@@ -55,22 +100,38 @@ func evictPod(podToEvict *apiv1.Pod, client kube_client.Interface, recorder kube
 				GracePeriodSeconds: &maxGraceful64,
 			},
 		}
-		lastError = client.CoreV1().Pods(podToEvict.Namespace).Evict(context.Background(), eviction)
+		lastError = client.CoreV1().Pods(podToEvict.Namespace).Evict(ctx, eviction)
 		if lastError == nil {
 			return nil
 		}
+		if !sleep(ctx, waitBetweenRetries) {
+			lastError = ctx.Err()
+			break
+		}
 	}
 	glog.Errorf("Failed to evict pod %s, error: %v", podToEvict.Name, lastError)
 	recorder.Eventf(podToEvict, apiv1.EventTypeWarning, "ReschedulerFailed", "failed to delete pod from on-demand node")
 	return fmt.Errorf("Failed to evict pod %s/%s within allowed timeout (last error: %v)", podToEvict.Namespace, podToEvict.Name, lastError)
 }
 
+// Waits for the given duration, returning false early if the context is done
+// first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
 // DrainNode performs drain logic on the node. Marks the node as unschedulable and later removes all pods, giving
-// them up to MaxGracefulTerminationTime to finish.
+// them up to MaxGracefulTerminationTime to finish. Once the context is done,
+// no further pods are evicted and the node is made schedulable again.
 //
 // Originally from https://github.com/kubernetes/autoscaler/blob/bf59e3daa5922c0e44027fa211948b50cb6b7a12/cluster-autoscaler/core/scale_down.go#L725-L783
-func DrainNode(node *apiv1.Node, pods []*apiv1.Pod, client kube_client.Interface, recorder kube_record.EventRecorder,
-	maxGracefulTerminationSec int, maxPodEvictionTime time.Duration, waitBetweenRetries time.Duration) error {
+func DrainNode(ctx context.Context, node *apiv1.Node, pods []*apiv1.Pod, client kube_client.Interface, recorder kube_record.EventRecorder,
+	opts DrainOptions) error {
 
 	drainSuccessful := false
 	toEvict := len(pods)
@@ -89,12 +150,60 @@ func DrainNode(node *apiv1.Node, pods []*apiv1.Pod, client kube_client.Interface
 
 	recorder.Eventf(node, apiv1.EventTypeNormal, "Rescheduler", "marked the node as draining/unschedulable")
 
-	retryUntil := time.Now().Add(maxPodEvictionTime)
+	evictionClock := opts.Clock
+	if evictionClock == nil {
+		evictionClock = clock.RealClock{}
+	}
+
+	// Pods with the same controller are evicted one after the other when
+	// paced or ordered, so the last eviction may start well after the first.
+	groups := groupPodsForEviction(pods, opts.ReplicaEvictionDelay > 0, opts.OrderStatefulSets)
+	var longestWait time.Duration
+	for _, group := range groups {
+		wait := time.Duration(len(group)-1) * opts.ReplicaEvictionDelay
+		if opts.OrderStatefulSets && isStatefulSetPod(group[0]) {
+			wait += time.Duration(len(group)-1) * opts.MaxPodEvictionTime
+		}
+		if wait > longestWait {
+			longestWait = wait
+		}
+	}
+	retryUntil := time.Now().Add(opts.MaxPodEvictionTime + longestWait)
+
 	confirmations := make(chan error, toEvict)
-	for _, pod := range pods {
-		go func(podToEvict *apiv1.Pod) {
-			confirmations <- evictPod(podToEvict, client, recorder, maxGracefulTerminationSec, retryUntil, waitBetweenRetries)
-		}(pod)
+	for _, group := range groups {
+		go func(group []*apiv1.Pod) {
+			serialized := opts.OrderStatefulSets && isStatefulSetPod(group[0])
+			for i, podToEvict := range group {
+				if i > 0 {
+					// Once the context is done the remaining pods are
+					// skipped without waiting
+					select {
+					case <-ctx.Done():
+					case <-evictionClock.After(opts.ReplicaEvictionDelay):
+					}
+				}
+				err := func() error {
+					if ctx.Err() != nil {
+						return &SkippedEvictionError{Pod: podToEvict, Reason: ctx.Err()}
+					}
+					if opts.BeforeEviction != nil {
+						if err := opts.BeforeEviction(podToEvict); err != nil {
+							return &SkippedEvictionError{Pod: podToEvict, Reason: err}
+						}
+					}
+					err := evictPod(ctx, podToEvict, client, recorder, opts.MaxGracefulTerminationSec, time.Now().Add(opts.MaxPodEvictionTime), opts.WaitBetweenRetries)
+					if err == nil && serialized && i < len(group)-1 {
+						err = waitForPodDeletion(ctx, podToEvict, client, time.Now().Add(opts.MaxPodEvictionTime), opts.WaitBetweenRetries)
+					}
+					return err
+				}()
+				if opts.AfterEviction != nil {
+					opts.AfterEviction(podToEvict, err)
+				}
+				confirmations <- err
+			}
+		}(group)
 	}
 
 	evictionErrs := make([]error, 0)
@@ -104,25 +213,34 @@ func DrainNode(node *apiv1.Node, pods []*apiv1.Pod, client kube_client.Interface
 		case err := <-confirmations:
 			if err != nil {
 				evictionErrs = append(evictionErrs, err)
-			} else {
-				metrics.UpdateEvictionsCount()
 			}
 		case <-time.After(retryUntil.Sub(time.Now()) + 5*time.Second):
 			return fmt.Errorf("Failed to drain node %s/%s: timeout when waiting for creating evictions", node.Namespace, node.Name)
+		case <-ctx.Done():
+			return fmt.Errorf("Failed to drain node %s/%s: %v", node.Namespace, node.Name, ctx.Err())
 		}
 	}
 	if len(evictionErrs) != 0 {
 		return fmt.Errorf("Failed to drain node %s/%s, due to following errors: %v", node.Namespace, node.Name, evictionErrs)
 	}
 
-	// Evictions created successfully, wait for the remainder of maxPodEvictionTime to see if pods have been evicted
+	// Evictions created successfully, wait for the remainder of maxPodEvictionTime to see if pods have been evicted.
+	// Pods held by finalizers are still running on the node until they are actually deleted.
+	pollInterval := opts.DeletionPollInterval
+	if pollInterval <= 0 {
+		pollInterval = 5 * time.Second
+	}
 	var allGone bool
 	for time.Now().Before(retryUntil.Add(5 * time.Second)) {
 		allGone = true
 		for _, pod := range pods {
-			podreturned, err := client.CoreV1().Pods(pod.Namespace).Get(context.Background(), pod.Name, metav1.GetOptions{})
-			if err == nil && (podreturned != nil && podreturned.Spec.NodeName == node.Name) {
-				glog.Errorf("Not deleted yet %v", podreturned.Name)
+			podreturned, err := client.CoreV1().Pods(pod.Namespace).Get(ctx, pod.Name, metav1.GetOptions{})
+			if err == nil && podreturned.UID == pod.UID {
+				if podreturned.DeletionTimestamp != nil && len(podreturned.Finalizers) > 0 {
+					glog.V(4).Infof("Pod %s/%s is terminating, waiting for finalizers %v", pod.Namespace, pod.Name, podreturned.Finalizers)
+				} else {
+					glog.Errorf("Not deleted yet %v", podreturned.Name)
+				}
 				allGone = false
 				break
 			}
@@ -140,7 +258,80 @@ func DrainNode(node *apiv1.Node, pods []*apiv1.Pod, client kube_client.Interface
 			deletetaint.CleanToBeDeleted(node, client)
 			return nil
 		}
-		time.Sleep(5 * time.Second)
+		if !sleep(ctx, pollInterval) {
+			return fmt.Errorf("Failed to drain node %s/%s: %v", node.Namespace, node.Name, ctx.Err())
+		}
 	}
 	return fmt.Errorf("Failed to drain node %s/%s: pods remaining after timeout", node.Namespace, node.Name)
 }
+
+// Waits until the evicted pod has been deleted, or replaced by a new pod with
+// the same name as StatefulSets do.
+func waitForPodDeletion(ctx context.Context, pod *apiv1.Pod, client kube_client.Interface, retryUntil time.Time, waitBetweenRetries time.Duration) error {
+	for first := true; first || time.Now().Before(retryUntil); {
+		first = false
+		podreturned, err := client.CoreV1().Pods(pod.Namespace).Get(ctx, pod.Name, metav1.GetOptions{})
+		if errors.IsNotFound(err) || (err == nil && podreturned.UID != pod.UID) {
+			return nil
+		}
+		if !sleep(ctx, waitBetweenRetries) {
+			return fmt.Errorf("Stopped waiting for pod %s/%s to be deleted: %v", pod.Namespace, pod.Name, ctx.Err())
+		}
+	}
+	return fmt.Errorf("Pod %s/%s was not deleted within allowed timeout", pod.Namespace, pod.Name)
+}
+
+// Splits the pods into groups evicted one after the other. When byController
+// is set, pods with the same controller are grouped together, otherwise each
+// pod is evicted on its own. When orderStatefulSets is set, the pods of a
+// StatefulSet are always grouped together, highest ordinal first.
+func groupPodsForEviction(pods []*apiv1.Pod, byController bool, orderStatefulSets bool) [][]*apiv1.Pod {
+	groups := make([][]*apiv1.Pod, 0)
+	controllerGroups := make(map[types.UID]int)
+	for _, pod := range pods {
+		controller := metav1.GetControllerOf(pod)
+		statefulSet := orderStatefulSets && isStatefulSetPod(pod)
+		if controller == nil || !(byController || statefulSet) {
+			groups = append(groups, []*apiv1.Pod{pod})
+			continue
+		}
+		if i, found := controllerGroups[controller.UID]; found {
+			groups[i] = append(groups[i], pod)
+			continue
+		}
+		controllerGroups[controller.UID] = len(groups)
+		groups = append(groups, []*apiv1.Pod{pod})
+	}
+
+	if orderStatefulSets {
+		for _, group := range groups {
+			if !isStatefulSetPod(group[0]) {
+				continue
+			}
+			sort.SliceStable(group, func(i, j int) bool {
+				return podOrdinal(group[i]) > podOrdinal(group[j])
+			})
+		}
+	}
+	return groups
+}
+
+// Checks whether the pod is controlled by a StatefulSet.
+func isStatefulSetPod(pod *apiv1.Pod) bool {
+	controller := metav1.GetControllerOf(pod)
+	return controller != nil && controller.Kind == "StatefulSet"
+}
+
+// Returns the ordinal of a StatefulSet pod, taken from the end of its name,
+// or -1 if the name has none.
+func podOrdinal(pod *apiv1.Pod) int {
+	i := strings.LastIndex(pod.Name, "-")
+	if i < 0 {
+		return -1
+	}
+	ordinal, err := strconv.Atoi(pod.Name[i+1:])
+	if err != nil {
+		return -1
+	}
+	return ordinal
+}
@@ -0,0 +1,389 @@
+/*
+Copyright 2017 Pusher Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package scaler
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/autoscaler/cluster-autoscaler/utils/deletetaint"
+	"k8s.io/client-go/kubernetes/fake"
+	core "k8s.io/client-go/testing"
+	kube_record "k8s.io/client-go/tools/record"
+)
+
+func TestDrainNodeReplicaEvictionDelay(t *testing.T) {
+	node := createTestNode("node1")
+	pods := []*apiv1.Pod{
+		createTestPod("rs1-a", "rs1"),
+		createTestPod("rs1-b", "rs1"),
+		createTestPod("rs1-c", "rs1"),
+	}
+
+	start := time.Now()
+	fakeClock := clock.NewFakeClock(start)
+	fakeClient := fake.NewSimpleClientset(node)
+	evictions := recordEvictions(fakeClient, fakeClock)
+
+	opts := DrainOptions{
+		MaxPodEvictionTime:   time.Second,
+		WaitBetweenRetries:   10 * time.Millisecond,
+		ReplicaEvictionDelay: 30 * time.Second,
+		Clock:                fakeClock,
+	}
+	go stepWhenWaiting(fakeClock, opts.ReplicaEvictionDelay, 2)
+	err := DrainNode(context.Background(), node, pods, fakeClient, kube_record.NewFakeRecorder(100), opts)
+	assert.NoError(t, err)
+
+	// Replicas of the same controller are evicted one after the other,
+	// ReplicaEvictionDelay apart.
+	assert.Equal(t, 3, len(evictions.times))
+	assert.Equal(t, time.Duration(0), evictions.times["rs1-a"].Sub(start))
+	assert.Equal(t, 30*time.Second, evictions.times["rs1-b"].Sub(start))
+	assert.Equal(t, 60*time.Second, evictions.times["rs1-c"].Sub(start))
+}
+
+func TestDrainNodeReplicaEvictionDelayCancelled(t *testing.T) {
+	node := createTestNode("node1")
+	pods := []*apiv1.Pod{
+		createTestPod("rs1-a", "rs1"),
+		createTestPod("rs1-b", "rs1"),
+	}
+
+	// The clock is never stepped, so only the context ends the wait
+	fakeClock := clock.NewFakeClock(time.Now())
+	fakeClient := fake.NewSimpleClientset(node)
+	recordEvictions(fakeClient, fakeClock)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	results := make(chan error, len(pods))
+	opts := DrainOptions{
+		MaxPodEvictionTime:   time.Second,
+		WaitBetweenRetries:   10 * time.Millisecond,
+		ReplicaEvictionDelay: time.Hour,
+		Clock:                fakeClock,
+		AfterEviction: func(pod *apiv1.Pod, err error) {
+			if pod.Name == "rs1-a" {
+				cancel()
+			}
+			results <- err
+		},
+	}
+	err := DrainNode(ctx, node, pods, fakeClient, kube_record.NewFakeRecorder(100), opts)
+	assert.Error(t, err)
+
+	// The second replica is skipped rather than waited for
+	for i := range pods {
+		select {
+		case err := <-results:
+			if i == 0 {
+				assert.NoError(t, err)
+			} else {
+				assert.IsType(t, &SkippedEvictionError{}, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected every pod to be reported")
+		}
+	}
+}
+
+func TestDrainNodeDeadline(t *testing.T) {
+	node := createTestNode("node1")
+	pods := []*apiv1.Pod{
+		createTestPod("rs1-a", "rs1"),
+		createTestPod("rs2-a", "rs2"),
+	}
+	fakeClient := fake.NewSimpleClientset(node)
+
+	// Evictions keep being refused, so the drain outlives its deadline.
+	var attempts int32
+	fakeClient.PrependReactor("create", "pods", func(action core.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "eviction" {
+			return false, nil, nil
+		}
+		atomic.AddInt32(&attempts, 1)
+		return true, nil, errors.New("too many requests")
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	opts := DrainOptions{
+		MaxPodEvictionTime: time.Minute,
+		WaitBetweenRetries: 10 * time.Millisecond,
+	}
+	start := time.Now()
+	err := DrainNode(ctx, node, pods, fakeClient, kube_record.NewFakeRecorder(100), opts)
+	assert.Error(t, err)
+	assert.True(t, time.Since(start) < 5*time.Second)
+	assert.True(t, atomic.LoadInt32(&attempts) > 0)
+
+	// The node isn't left marked as draining
+	updated, err := fakeClient.CoreV1().Nodes().Get(context.Background(), "node1", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.False(t, deletetaint.HasToBeDeletedTaint(updated))
+}
+
+func TestDrainNodeAfterEviction(t *testing.T) {
+	node := createTestNode("node1")
+	pods := []*apiv1.Pod{
+		createTestPod("rs1-a", "rs1"),
+		createTestPod("rs2-a", "rs2"),
+	}
+	fakeClient := fake.NewSimpleClientset(node)
+	recordEvictions(fakeClient, clock.RealClock{})
+
+	var lock sync.Mutex
+	results := make(map[string]error)
+	opts := DrainOptions{
+		MaxPodEvictionTime: time.Second,
+		WaitBetweenRetries: 10 * time.Millisecond,
+		BeforeEviction: func(pod *apiv1.Pod) error {
+			if pod.Name == "rs2-a" {
+				return errors.New("not today")
+			}
+			return nil
+		},
+		AfterEviction: func(pod *apiv1.Pod, err error) {
+			lock.Lock()
+			defer lock.Unlock()
+			results[pod.Name] = err
+		},
+	}
+	err := DrainNode(context.Background(), node, pods, fakeClient, kube_record.NewFakeRecorder(100), opts)
+	assert.Error(t, err)
+
+	// Every pod is reported, including those that weren't evicted
+	assert.Equal(t, 2, len(results))
+	assert.NoError(t, results["rs1-a"])
+	assert.Error(t, results["rs2-a"])
+}
+
+func TestGroupPodsForEviction(t *testing.T) {
+	pods := []*apiv1.Pod{
+		createTestPod("rs1-a", "rs1"),
+		createTestPod("rs2-a", "rs2"),
+		createTestPod("rs1-b", "rs1"),
+		createTestPod("bare", ""),
+	}
+
+	groups := groupPodsForEviction(pods, false, false)
+	assert.Equal(t, 4, len(groups))
+
+	groups = groupPodsForEviction(pods, true, false)
+	assert.Equal(t, 3, len(groups))
+	assert.Equal(t, []*apiv1.Pod{pods[0], pods[2]}, groups[0])
+	assert.Equal(t, []*apiv1.Pod{pods[1]}, groups[1])
+	assert.Equal(t, []*apiv1.Pod{pods[3]}, groups[2])
+}
+
+func TestDrainNodeOrderStatefulSets(t *testing.T) {
+	node := createTestNode("node1")
+	pods := []*apiv1.Pod{
+		createTestStatefulSetPod("web-0", "web"),
+		createTestStatefulSetPod("web-2", "web"),
+		createTestStatefulSetPod("web-1", "web"),
+	}
+
+	objects := []runtime.Object{node}
+	for _, pod := range pods {
+		objects = append(objects, pod)
+	}
+	fakeClient := fake.NewSimpleClientset(objects...)
+	evictions := recordEvictions(fakeClient, clock.RealClock{})
+
+	// Evicted pods are deleted straight away, remembering which pods were
+	// still present when each eviction was created.
+	stillPresent := make(map[string][]string)
+	fakeClient.PrependReactor("create", "pods", func(action core.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "eviction" {
+			return false, nil, nil
+		}
+		name := action.(core.CreateAction).GetObject().(*policyv1.Eviction).Name
+		for _, pod := range pods {
+			if _, err := fakeClient.Tracker().Get(apiv1.SchemeGroupVersion.WithResource("pods"), pod.Namespace, pod.Name); err == nil {
+				stillPresent[name] = append(stillPresent[name], pod.Name)
+			}
+		}
+		fakeClient.Tracker().Delete(apiv1.SchemeGroupVersion.WithResource("pods"), "default", name)
+		return false, nil, nil
+	})
+
+	opts := DrainOptions{
+		MaxPodEvictionTime: time.Second,
+		WaitBetweenRetries: 10 * time.Millisecond,
+		OrderStatefulSets:  true,
+	}
+	err := DrainNode(context.Background(), node, pods, fakeClient, kube_record.NewFakeRecorder(100), opts)
+	assert.NoError(t, err)
+
+	// Pods are evicted highest ordinal first, each once the previous is gone.
+	assert.Equal(t, []string{"web-2", "web-1", "web-0"}, evictions.order)
+	assert.Equal(t, []string{"web-0", "web-2", "web-1"}, stillPresent["web-2"])
+	assert.Equal(t, []string{"web-0", "web-1"}, stillPresent["web-1"])
+	assert.Equal(t, []string{"web-0"}, stillPresent["web-0"])
+}
+
+func TestDrainNodeWaitsForFinalizers(t *testing.T) {
+	node := createTestNode("node1")
+	pod := createTestPod("rs1-a", "rs1")
+	pod.Finalizers = []string{"example.com/cleanup"}
+	fakeClient := fake.NewSimpleClientset(node, pod)
+
+	// Evicted pods start terminating, but the finalizer keeps them around for
+	// a while before they are deleted.
+	podsResource := apiv1.SchemeGroupVersion.WithResource("pods")
+	deleted := make(chan time.Time, 1)
+	fakeClient.PrependReactor("create", "pods", func(action core.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "eviction" {
+			return false, nil, nil
+		}
+		terminating := pod.DeepCopy()
+		now := metav1.Now()
+		terminating.DeletionTimestamp = &now
+		fakeClient.Tracker().Update(podsResource, terminating, pod.Namespace)
+		time.AfterFunc(200*time.Millisecond, func() {
+			fakeClient.Tracker().Delete(podsResource, pod.Namespace, pod.Name)
+			deleted <- time.Now()
+		})
+		return true, nil, nil
+	})
+
+	opts := DrainOptions{
+		MaxPodEvictionTime:   time.Second,
+		WaitBetweenRetries:   10 * time.Millisecond,
+		DeletionPollInterval: 10 * time.Millisecond,
+	}
+	err := DrainNode(context.Background(), node, []*apiv1.Pod{pod}, fakeClient, kube_record.NewFakeRecorder(100), opts)
+	finished := time.Now()
+	assert.NoError(t, err)
+
+	// The drain only completes once the pod has actually been deleted
+	select {
+	case deletedAt := <-deleted:
+		assert.False(t, finished.Before(deletedAt))
+	default:
+		t.Fatal("drain completed before the pod was deleted")
+	}
+}
+
+func TestGroupPodsForEvictionStatefulSets(t *testing.T) {
+	pods := []*apiv1.Pod{
+		createTestStatefulSetPod("web-1", "web"),
+		createTestPod("rs1-a", "rs1"),
+		createTestStatefulSetPod("web-10", "web"),
+		createTestStatefulSetPod("web-2", "web"),
+		createTestPod("rs1-b", "rs1"),
+	}
+
+	// StatefulSet pods are grouped even when replicas aren't paced
+	groups := groupPodsForEviction(pods, false, true)
+	assert.Equal(t, 3, len(groups))
+	assert.Equal(t, []*apiv1.Pod{pods[2], pods[3], pods[0]}, groups[0])
+	assert.Equal(t, []*apiv1.Pod{pods[1]}, groups[1])
+	assert.Equal(t, []*apiv1.Pod{pods[4]}, groups[2])
+}
+
+// evictionRecord records when each pod was evicted.
+type evictionRecord struct {
+	sync.Mutex
+	times map[string]time.Time
+	order []string
+}
+
+// Steps the fake clock by d each time something is waiting on it, the given
+// number of times.
+func stepWhenWaiting(fakeClock *clock.FakeClock, d time.Duration, times int) {
+	for i := 0; i < times; i++ {
+		for !fakeClock.HasWaiters() {
+			time.Sleep(time.Millisecond)
+		}
+		fakeClock.Step(d)
+	}
+}
+
+// Makes the fake client accept evictions, recording the time of each
+// according to the given clock.
+func recordEvictions(fakeClient *fake.Clientset, evictionClock clock.Clock) *evictionRecord {
+	record := &evictionRecord{times: make(map[string]time.Time)}
+	fakeClient.PrependReactor("create", "pods", func(action core.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "eviction" {
+			return false, nil, nil
+		}
+		eviction := action.(core.CreateAction).GetObject().(*policyv1.Eviction)
+		record.Lock()
+		defer record.Unlock()
+		record.times[eviction.Name] = evictionClock.Now()
+		record.order = append(record.order, eviction.Name)
+		return true, nil, nil
+	})
+	return record
+}
+
+func createTestNode(name string) *apiv1.Node {
+	return &apiv1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+		},
+	}
+}
+
+// Creates a pod on node1 controlled by the named ReplicaSet, or by nothing if
+// the name is empty.
+func createTestPod(name string, controllerName string) *apiv1.Pod {
+	pod := &apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Name:      name,
+			UID:       types.UID(name),
+		},
+		Spec: apiv1.PodSpec{
+			NodeName: "node1",
+		},
+	}
+	if controllerName != "" {
+		controller := true
+		pod.OwnerReferences = []metav1.OwnerReference{
+			{
+				APIVersion: "apps/v1",
+				Kind:       "ReplicaSet",
+				Name:       controllerName,
+				UID:        types.UID(controllerName),
+				Controller: &controller,
+			},
+		}
+	}
+	return pod
+}
+
+// Creates a pod on node1 controlled by the named StatefulSet.
+func createTestStatefulSetPod(name string, statefulSetName string) *apiv1.Pod {
+	pod := createTestPod(name, statefulSetName)
+	pod.OwnerReferences[0].Kind = "StatefulSet"
+	return pod
+}